@@ -28,12 +28,14 @@ import (
 	"sync"
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/network"
 )
 
 
 var (
-	once     sync.Once
-	instance *Configs
+	// instance is the configs created last, it is guarded by instanceMutex
+	instanceMutex sync.Mutex
+	instance      *Configs
 	//QPS rateLimit qps
 	QPS int
 	//sessionInstance *SessionConfigs
@@ -51,15 +53,41 @@ type Configs struct {
 	Security      map[string]Security
 	ImageList map[string]string
 	Secret map[string]Secret
+	Mirrors map[string]Mirror
 	//ConfMap       map[string]interface{}
 	//ConfMapString map[string]string
 }
 
-// Security describes the authentication information of a registry
+// Security describes the authentication information of a registry.
+// Credentials may be secret references like "${ENV_NAME}" or "file:/path/to/secret"
 type Security struct {
 	Username string `json:"username" yaml:"username"`
 	Password string `json:"password" yaml:"password"`
-	Insecure bool   `json:"insecure" yaml:"insecure"`
+	// Insecure skips verifying the certificate of registry and falls back to plain http if https fails
+	Insecure bool `json:"insecure" yaml:"insecure"`
+	// PlainHTTP is set if the registry serves plain http only. Requests of the registry client use http only,
+	// image copies by containers/image can not force http and behave as Insecure
+	PlainHTTP bool `json:"plainHTTP" yaml:"plainHTTP"`
+	// CAFile is a ca bundle to verify the certificate of registry in addition to system cas
+	CAFile string `json:"caFile" yaml:"caFile"`
+	// CertFile and KeyFile are the client certificate and key for mutual tls
+	CertFile string `json:"certFile" yaml:"certFile"`
+	KeyFile  string `json:"keyFile" yaml:"keyFile"`
+	// CertDir contains *.crt ca certificates and *.cert/*.key client certificates like docker certs.d
+	CertDir string `json:"certDir" yaml:"certDir"`
+	// Proxy is the http, https or socks5 proxy url of registry, or "direct" to skip the default proxy
+	Proxy string `json:"proxy" yaml:"proxy"`
+	// IdentityToken is an OAuth2 refresh token used instead of username and password
+	IdentityToken string `json:"identityToken" yaml:"identityToken"`
+	// RegistryToken is a bearer token sent to the registry as is
+	RegistryToken string `json:"registryToken" yaml:"registryToken"`
+	// TokenProvider obtains temporary credentials of cloud registries instead of static ones
+	TokenProvider *TokenProvider `json:"tokenProvider" yaml:"tokenProvider"`
+	// Type of registry: registry, harbor, dockerhub, quay, gitlab or tcr, it decides the api to list repositories
+	// and is detected if empty
+	Type string `json:"type" yaml:"type"`
+	// NamespaceProvisioner creates missing namespaces before images are pushed to the registry
+	NamespaceProvisioner *NamespaceProvisioner `json:"namespaceProvisioner" yaml:"namespaceProvisioner"`
 }
 
 // Secret describes secret info for tencent cloud
@@ -69,59 +97,80 @@ type Secret struct {
 }
 
 
-// InitConfigs InitLogger initializes logger the way we want for tke.
+// InitConfigs reads the config files of opts into a new Configs, so each transfer cycle has its own
+// configs and the configs in use are not changed by a reload
 func InitConfigs(opts *options.ClientOptions) (*Configs, error) {
-	//log.Println(opts.Config.ConfigFile)
-	once.Do(func() {
-		instance = &Configs{}
+	config := &Configs{FlagConf: opts}
 
-		instance.FlagConf = opts
-	})
+	if config.FlagConf.Config.CCRToTCR && config.FlagConf.Config.TCRToTCR {
+		return nil, errors.New("ccrToTcr and tcrToTcr should not be set together, Exit")
+	}
+
+	if config.FlagConf.Config.TCRToTCR && len(config.FlagConf.Config.SourceTCRName) == 0 {
+		return nil, errors.New("no source tcr name is provided, Exit")
+	}
 
-	if instance.FlagConf.Config.CCRToTCR == true {
-		if len(instance.FlagConf.Config.SecretFile) == 0 || len(instance.FlagConf.Config.SecurityFile) == 0 {
-			return nil, errors.New("no SecretFile or security file is provided, Exit")
-		} else if len(instance.FlagConf.Config.TCRName) == 0 {
+	if config.FlagConf.Config.CCRToTCR == true || config.FlagConf.Config.TCRToTCR {
+		if len(config.FlagConf.Config.SecretFile) == 0 {
+			return nil, errors.New("no SecretFile is provided, Exit")
+		} else if len(config.FlagConf.Config.TCRName) == 0 {
 			return nil, errors.New("no tcr name is provided, Exit")
 		} else {
-			secret, err := instance.GetSecret()
+			secret, err := config.GetSecret()
 			if err != nil {
 				return nil, err
 			}
-			instance.Secret = secret
-			securityList, err := instance.GetSecurity()
+			config.Secret = secret
+			securityList, err := config.GetSecurity()
 			if err != nil {
 				return nil, err
 			}
-			instance.Security = securityList
+			config.Security = securityList
 		}
 	} else {
-		if len(instance.FlagConf.Config.RuleFile) == 0 || len(instance.FlagConf.Config.SecurityFile) == 0 {
-			return nil, errors.New("no rule file or security file is provided, Exit")
+		if len(config.FlagConf.Config.RuleFile) == 0 {
+			return nil, errors.New("no rule file is provided, Exit")
 		}
-		instance.ImageList = instance.GetImageList()
+		config.ImageList = config.GetImageList()
 
-		securityList, err := instance.GetSecurity()
+		// secret file is optional in this mode, it provides tencent cloud secret of tcr token provider
+		if len(config.FlagConf.Config.SecretFile) != 0 {
+			secret, err := config.GetSecret()
+			if err != nil {
+				return nil, err
+			}
+			config.Secret = secret
+		}
+
+		securityList, err := config.GetSecurity()
 		if err != nil {
 			return nil, err
 		}
-		instance.Security = securityList
+		config.Security = securityList
 
 
 	}
 
-	if instance.FlagConf.Config.RoutineNums > maxRoutineNums {
-		instance.FlagConf.Config.RoutineNums = maxRoutineNums
+	mirrors, err := config.GetMirrors()
+	if err != nil {
+		return nil, err
 	}
+	config.Mirrors = mirrors
 
-	if instance.FlagConf.Config.QPS > maxRatelimit {
-		instance.FlagConf.Config.QPS = maxRatelimit
+	if config.FlagConf.Config.RoutineNums > maxRoutineNums {
+		config.FlagConf.Config.RoutineNums = maxRoutineNums
 	}
 
-	QPS = instance.FlagConf.Config.QPS
+	if config.FlagConf.Config.QPS > maxRatelimit {
+		config.FlagConf.Config.QPS = maxRatelimit
+	}
 
+	instanceMutex.Lock()
+	instance = config
+	QPS = config.FlagConf.Config.QPS
+	instanceMutex.Unlock()
 
-	return instance, nil
+	return config, nil
 }
 
 // GetConfigs get config of Configs instance
@@ -129,9 +178,18 @@ func GetConfigs() *Configs {
 	/*if instance == nil{
 		log.Fatalf("Fail to get instance: %v", instance)
 	}*/
+	instanceMutex.Lock()
+	defer instanceMutex.Unlock()
 	return instance
 }
 
+// WithImageList returns a copy of Configs which transfers imageList instead of the rules of rule file
+func (c *Configs) WithImageList(imageList map[string]string) *Configs {
+	config := *c
+	config.ImageList = imageList
+	return &config
+}
+
 // GetImageList get images list of configs instance
 func (c *Configs) GetImageList() map[string]string {
 	var imageList map[string]string
@@ -146,30 +204,76 @@ func (c *Configs) GetImageList() map[string]string {
 	return imageList
 }
 
-// GetSecurity gets the Security information in Config
+// GetSecurity gets the Security information in Config, secret references are resolved.
+// It is empty if no security file is provided, credentials are looked up in docker config then
 func (c *Configs) GetSecurity() (map[string]Security, error) {
-	var securityList map[string]Security
+	// docker config files may be changed since the last load too
+	resetCredentialCache()
+	securityList := map[string]Security{}
+	if len(c.FlagConf.Config.SecurityFile) == 0 {
+		return securityList, nil
+	}
 
 	if err := openAndDecode(c.FlagConf.Config.SecurityFile, &securityList); err != nil {
 		log.Errorf("decode config file %v error: %v", c.FlagConf.Config.SecurityFile, err)
 		return securityList, err
 	}
 
+	for key, security := range securityList {
+		resolved, err := security.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("resolve credentials of %s in %s error: %v", key, c.FlagConf.Config.SecurityFile, err)
+		}
+		if (resolved.CertFile == "") != (resolved.KeyFile == "") {
+			return nil, fmt.Errorf("certFile and keyFile of %s in %s should be set together", key, c.FlagConf.Config.SecurityFile)
+		}
+		securityList[key] = resolved
+	}
+
+	if err := network.SetProxies(registryProxies(securityList)); err != nil {
+		return nil, fmt.Errorf("proxies in %s error: %v", c.FlagConf.Config.SecurityFile, err)
+	}
 
 	return securityList, nil
 }
 
 
-// GetSecuritySpecific gets the specific authentication information in Config
+// GetSecuritySpecific gets the specific authentication information in Config, temporary credentials
+// of token providers are refreshed before expiry, credentials not in security file are looked up
+// in docker config files and credential helpers
 func (c *Configs) GetSecuritySpecific(registry string, namespace string) (Security, bool) {
 
 	// key of each AuthList item can be "registry/namespace" or "registry" only
-	registryAndNamespace := registry + "/" + namespace
+	key := registry + "/" + namespace
+
+	auth, exist := c.Security[key]
+	if !exist {
+		key = registry
+		auth, exist = c.Security[key]
+	}
+	if auth.TokenProvider != nil {
+		creds, err := c.tokenCredentials(key, registry, *auth.TokenProvider)
+		if err != nil {
+			log.Errorf("%v", err)
+			return auth, exist
+		}
+		auth.Username = creds.Username
+		auth.Password = creds.Password
+		auth.IdentityToken = creds.IdentityToken
+		auth.RegistryToken = creds.RegistryToken
+		return auth, exist
+	}
+	if auth.HasCredentials() {
+		return auth, exist
+	}
 
-	if moreSpecificAuth, exist := c.Security[registryAndNamespace]; exist {
-		return moreSpecificAuth, exist
+	// keep other settings of the security file, e.g. insecure
+	if creds, ok := dockerCredentials(c.FlagConf.Config.AuthFile, registry); ok {
+		auth.Username = creds.Username
+		auth.Password = creds.Password
+		auth.IdentityToken = creds.IdentityToken
+		return auth, true
 	}
-	auth, exist := c.Security[registry]
 	return auth, exist
 }
 
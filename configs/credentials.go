@@ -0,0 +1,243 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	dockerconfig "github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/docker-credential-helpers/client"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// fileRefPrefix marks a secret value read from a file
+const fileRefPrefix = "file:"
+
+// credentialCacheTTL is how long credentials found in docker config files and helpers are cached
+const credentialCacheTTL = 5 * time.Minute
+
+// dockerHubServers are the names of docker hub in docker config files and credential helpers,
+// "docker login" stores its credentials by the legacy index server
+var dockerHubServers = []string{"docker.io", "https://index.docker.io/v1/"}
+
+// cachedCredentials are the credentials of a registry found at some time
+type cachedCredentials struct {
+	security Security
+	found    time.Time
+	// done is closed when the lookup is finished, security and found are set then
+	done chan struct{}
+}
+
+// expired reports whether the lookup is finished and its result is out of date
+func (c *cachedCredentials) expired() bool {
+	select {
+	case <-c.done:
+		return time.Since(c.found) >= credentialCacheTTL
+	default:
+		return false
+	}
+}
+
+// credentialCache caches credentials found in docker config files and helpers by auth file and registry,
+// so a helper program is not executed for every image. It is cleared when the security file is loaded,
+// and entries expire after credentialCacheTTL so long running servers see updated credentials
+var credentialCache = struct {
+	sync.Mutex
+	m map[string]*cachedCredentials
+}{m: make(map[string]*cachedCredentials)}
+
+// resetCredentialCache removes all cached credentials
+func resetCredentialCache() {
+	credentialCache.Lock()
+	defer credentialCache.Unlock()
+	credentialCache.m = make(map[string]*cachedCredentials)
+}
+
+// HasCredentials returns true if s contains any credentials
+func (s Security) HasCredentials() bool {
+	return s.Username != "" || s.Password != "" || s.IdentityToken != "" || s.RegistryToken != ""
+}
+
+// resolve returns a copy of s with the secret references of its credentials replaced by their values
+func (s Security) resolve() (Security, error) {
+	for _, field := range []*string{&s.Username, &s.Password, &s.IdentityToken, &s.RegistryToken} {
+		value, err := resolveSecretRef(*field)
+		if err != nil {
+			return s, err
+		}
+		*field = value
+	}
+	if s.TokenProvider != nil {
+		provider, err := s.TokenProvider.resolve()
+		if err != nil {
+			return s, err
+		}
+		s.TokenProvider = &provider
+	}
+	if s.NamespaceProvisioner != nil {
+		provisioner, err := s.NamespaceProvisioner.resolve()
+		if err != nil {
+			return s, err
+		}
+		s.NamespaceProvisioner = &provisioner
+	}
+	return s, nil
+}
+
+// resolveSecretRef returns the value of a secret reference, "file:<path>" is replaced by the content
+// of the file, "${NAME}" is replaced by the environment variable NAME, other values are returned as is
+func resolveSecretRef(value string) (string, error) {
+	if strings.HasPrefix(value, fileRefPrefix) {
+		path := strings.TrimPrefix(value, fileRefPrefix)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read secret file %s error: %v", path, err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+	var missing []string
+	value = os.Expand(value, func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) != 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return value, nil
+}
+
+// dockerCredentials looks up credentials of registry in authFile, or in the default docker config.json
+// and containers auth.json if authFile is empty, including credHelpers and credsStore helpers.
+// A registry is looked up once at the same time, the cache is not locked while helpers run
+func dockerCredentials(authFile, registry string) (Security, bool) {
+	key := authFile + "|" + registry
+	credentialCache.Lock()
+	cached, ok := credentialCache.m[key]
+	if ok && !cached.expired() {
+		credentialCache.Unlock()
+		<-cached.done
+		return cached.security, cached.security.HasCredentials()
+	}
+	cached = &cachedCredentials{done: make(chan struct{})}
+	credentialCache.m[key] = cached
+	credentialCache.Unlock()
+
+	cached.security = lookupDockerCredentials(authFile, registry)
+	cached.found = time.Now()
+	close(cached.done)
+	return cached.security, cached.security.HasCredentials()
+}
+
+func lookupDockerCredentials(authFile, registry string) Security {
+	servers := []string{registry, "https://" + registry}
+	if registry == utils.DefaultRegistry {
+		registry, servers = dockerHubServers[0], dockerHubServers
+	}
+
+	sys := &types.SystemContext{AuthFilePath: authFile}
+	auth, err := dockerconfig.GetCredentials(sys, registry)
+	if err != nil {
+		log.Warnf("get credentials of %s from docker config error: %v", registry, err)
+	}
+	if auth.Username != "" || auth.IdentityToken != "" {
+		log.Infof("Find credentials of %s in docker config", registry)
+		return Security{Username: auth.Username, Password: auth.Password, IdentityToken: auth.IdentityToken}
+	}
+
+	// credsStore of docker config.json is the default helper of all registries
+	store := credsStore(authFile)
+	if store == "" {
+		return Security{}
+	}
+	helper := client.NewShellProgramFunc("docker-credential-" + store)
+	for _, server := range servers {
+		c, err := client.Get(helper, server)
+		if err != nil {
+			continue
+		}
+		log.Infof("Find credentials of %s in credsStore %s", registry, store)
+		// docker stores an identity token with username <token>
+		if c.Username == "<token>" {
+			return Security{IdentityToken: c.Secret}
+		}
+		return Security{Username: c.Username, Password: c.Secret}
+	}
+	return Security{}
+}
+
+// credsStore returns the credsStore of authFile or of the default docker config.json
+func credsStore(authFile string) string {
+	path := authFile
+	if path == "" {
+		dir := os.Getenv("DOCKER_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return ""
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		path = filepath.Join(dir, "config.json")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		CredsStore string `json:"credsStore"`
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		log.Warnf("decode docker config %s error: %v", path, err)
+		return ""
+	}
+	return config.CredsStore
+}
+
+// registryProxies returns the proxies of registry hosts in securityList, keys of securityList may have namespaces
+func registryProxies(securityList map[string]Security) map[string]string {
+	proxies := map[string]string{}
+	for key, security := range securityList {
+		if security.Proxy == "" {
+			continue
+		}
+		host := strings.SplitN(key, "/", 2)[0]
+		if proxy, ok := proxies[host]; ok && proxy != security.Proxy {
+			log.Warnf("different proxies of %s are set in security file, use %s", host, security.Proxy)
+		}
+		proxies[host] = security.Proxy
+	}
+	return proxies
+}
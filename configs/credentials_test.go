@@ -0,0 +1,54 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+func TestDockerCredentialsOfDockerHub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-transfer-auth-")
+	if err != nil {
+		t.Fatalf("create temp dir error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// docker login stores the credentials of docker hub by the legacy index server
+	auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	path := filepath.Join(dir, "config.json")
+	content := `{"auths": {"https://index.docker.io/v1/": {"auth": "` + auth + `"}}}`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("write auth file error: %v", err)
+	}
+
+	resetCredentialCache()
+	creds, ok := dockerCredentials(path, utils.DefaultRegistry)
+	if !ok || creds.Username != "user" || creds.Password != "secret" {
+		t.Errorf("credentials of %s = %+v, %v", utils.DefaultRegistry, creds, ok)
+	}
+	if _, ok := dockerCredentials(path, "registry.example.com"); ok {
+		t.Errorf("credentials of docker hub should not be used by other registries")
+	}
+}
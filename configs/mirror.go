@@ -0,0 +1,80 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"fmt"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// Mirror maps a logical registry name used in rules to physical endpoints
+type Mirror struct {
+	// Endpoints are tried in order before the logical registry itself, e.g. a pull-through cache
+	// or a vpc endpoint
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+	// MirrorsOnly is set if the logical registry should not be accessed if all endpoints fail
+	MirrorsOnly bool `json:"mirrorsOnly" yaml:"mirrorsOnly"`
+}
+
+// Endpoint is a physical registry host with its security settings
+type Endpoint struct {
+	Registry string
+	Security Security
+}
+
+// GetMirrors gets mirrors from mirrors file, keys are "registry" or "registry/namespace".
+// It is empty if no mirrors file is provided
+func (c *Configs) GetMirrors() (map[string]Mirror, error) {
+	mirrors := map[string]Mirror{}
+	if len(c.FlagConf.Config.MirrorsFile) == 0 {
+		return mirrors, nil
+	}
+
+	if err := openAndDecode(c.FlagConf.Config.MirrorsFile, &mirrors); err != nil {
+		log.Errorf("decode mirrors file %v error: %v", c.FlagConf.Config.MirrorsFile, err)
+		return mirrors, err
+	}
+	for key, mirror := range mirrors {
+		if len(mirror.Endpoints) == 0 && mirror.MirrorsOnly {
+			return nil, fmt.Errorf("no endpoints of %s in %s", key, c.FlagConf.Config.MirrorsFile)
+		}
+	}
+	return mirrors, nil
+}
+
+// GetEndpoints returns the endpoints of a logical registry in the order they should be tried,
+// the security settings of an endpoint are looked up by its host
+func (c *Configs) GetEndpoints(registry string, namespace string) []Endpoint {
+	mirror, exist := c.Mirrors[registry+"/"+namespace]
+	if !exist {
+		mirror = c.Mirrors[registry]
+	}
+
+	var endpoints []Endpoint
+	for _, host := range mirror.Endpoints {
+		security, _ := c.GetSecuritySpecific(host, namespace)
+		endpoints = append(endpoints, Endpoint{Registry: host, Security: security})
+	}
+	if !mirror.MirrorsOnly {
+		security, _ := c.GetSecuritySpecific(registry, namespace)
+		endpoints = append(endpoints, Endpoint{Registry: registry, Security: security})
+	}
+	return endpoints
+}
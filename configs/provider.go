@@ -0,0 +1,148 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// maxRefreshMargin is the longest time before expiry that a temporary credential is refreshed
+	maxRefreshMargin = 10 * time.Minute
+	// refreshRetryInterval is the time to wait before retrying a failed refresh of a valid credential
+	refreshRetryInterval = 30 * time.Second
+)
+
+// TokenProvider describes how to obtain short-lived credentials of a cloud registry.
+// String fields may be secret references like "${ENV_NAME}" or "file:/path/to/secret"
+type TokenProvider struct {
+	// Type is the provider name: ecr, gcr, acr or tcr
+	Type string `json:"type" yaml:"type"`
+	// Region of the ecr or tcr registry, parsed from the registry host if empty
+	Region string `json:"region" yaml:"region"`
+	// AccessKeyID, SecretAccessKey and SessionToken are aws credentials of ecr
+	AccessKeyID     string `json:"accessKeyId" yaml:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey" yaml:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken" yaml:"sessionToken"`
+	// KeyFile is a gcp service account key file of gcr and artifact registry
+	KeyFile string `json:"keyFile" yaml:"keyFile"`
+	// TenantID, ClientID and ClientSecret are the azure service principal of acr
+	TenantID     string `json:"tenantId" yaml:"tenantId"`
+	ClientID     string `json:"clientId" yaml:"clientId"`
+	ClientSecret string `json:"clientSecret" yaml:"clientSecret"`
+	// SecretID and SecretKey are tencent cloud credentials of tcr, secret file is used if empty
+	SecretID  string `json:"secretId" yaml:"secretId"`
+	SecretKey string `json:"secretKey" yaml:"secretKey"`
+	// InstanceID of tcr, it is looked up by the instance name of registry host if empty
+	InstanceID string `json:"instanceId" yaml:"instanceId"`
+}
+
+// CredentialProvider obtains temporary credentials of a registry
+type CredentialProvider interface {
+	// Credentials returns the credentials of registry and the time they expire
+	Credentials(registry string, conf TokenProvider, secret map[string]Secret) (Security, time.Time, error)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]CredentialProvider)
+)
+
+// RegisterCredentialProvider makes a credential provider available by name in security file
+func RegisterCredentialProvider(name string, provider CredentialProvider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = provider
+}
+
+// tokenCache caches temporary credentials by key of security file until they need to be refreshed
+var tokenCache = struct {
+	sync.Mutex
+	m map[string]*cachedToken
+}{m: make(map[string]*cachedToken)}
+
+type cachedToken struct {
+	sync.Mutex
+	conf      TokenProvider
+	creds     Security
+	expiry    time.Time
+	refreshAt time.Time
+}
+
+// resolve returns a copy of p with secret references replaced by their values
+func (p TokenProvider) resolve() (TokenProvider, error) {
+	for _, field := range []*string{&p.AccessKeyID, &p.SecretAccessKey, &p.SessionToken, &p.KeyFile,
+		&p.TenantID, &p.ClientID, &p.ClientSecret, &p.SecretID, &p.SecretKey, &p.InstanceID} {
+		value, err := resolveSecretRef(*field)
+		if err != nil {
+			return p, err
+		}
+		*field = value
+	}
+	return p, nil
+}
+
+// tokenCredentials returns the credentials of registry from the token provider of key,
+// they are refreshed before they expire
+func (c *Configs) tokenCredentials(key, registry string, conf TokenProvider) (Security, error) {
+	tokenCache.Lock()
+	token, ok := tokenCache.m[key]
+	if !ok || token.conf != conf {
+		token = &cachedToken{conf: conf}
+		tokenCache.m[key] = token
+	}
+	tokenCache.Unlock()
+
+	token.Lock()
+	defer token.Unlock()
+	now := time.Now()
+	if now.Before(token.refreshAt) {
+		return token.creds, nil
+	}
+
+	providersMu.RLock()
+	provider, ok := providers[conf.Type]
+	providersMu.RUnlock()
+	if !ok {
+		return Security{}, fmt.Errorf("unknown token provider type %q", conf.Type)
+	}
+
+	creds, expiry, err := provider.Credentials(registry, conf, c.Secret)
+	if err != nil {
+		if now.Before(token.expiry) {
+			log.Warnf("refresh %s token of %s error, use the token expiring at %s: %v",
+				conf.Type, registry, token.expiry.Format(time.RFC3339), err)
+			token.refreshAt = now.Add(refreshRetryInterval)
+			return token.creds, nil
+		}
+		return Security{}, fmt.Errorf("get %s token of %s error: %v", conf.Type, registry, err)
+	}
+
+	margin := expiry.Sub(now) / 2
+	if margin > maxRefreshMargin {
+		margin = maxRefreshMargin
+	}
+	token.creds, token.expiry, token.refreshAt = creds, expiry, expiry.Add(-margin)
+	log.Infof("Get %s token of %s, expires at %s", conf.Type, registry, expiry.Format(time.RFC3339))
+	return creds, nil
+}
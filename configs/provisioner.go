@@ -0,0 +1,49 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+// NamespaceProvisioner describes how to create the missing namespaces of a target registry.
+// Token, SecretID and SecretKey may be secret references like "${ENV_NAME}" or "file:/path/to/secret"
+type NamespaceProvisioner struct {
+	// Type is the provisioner name: tcr, harbor, quay or gitlab, the type of security is used if empty
+	Type string `json:"type" yaml:"type"`
+	// APIURL is the address of the management api like https://gitlab.example.com, the registry if empty
+	APIURL string `json:"apiURL" yaml:"apiURL"`
+	// Token authenticates quay and gitlab api, harbor api uses username and password of security
+	Token string `json:"token" yaml:"token"`
+	// Public is the visibility of created namespaces
+	Public bool `json:"public" yaml:"public"`
+	// Region, SecretID, SecretKey and InstanceID of tcr, the same as TokenProvider
+	Region     string `json:"region" yaml:"region"`
+	SecretID   string `json:"secretId" yaml:"secretId"`
+	SecretKey  string `json:"secretKey" yaml:"secretKey"`
+	InstanceID string `json:"instanceId" yaml:"instanceId"`
+}
+
+// resolve returns a copy of p with secret references replaced by their values
+func (p NamespaceProvisioner) resolve() (NamespaceProvisioner, error) {
+	for _, field := range []*string{&p.Token, &p.SecretID, &p.SecretKey} {
+		value, err := resolveSecretRef(*field)
+		if err != nil {
+			return p, err
+		}
+		*field = value
+	}
+	return p, nil
+}
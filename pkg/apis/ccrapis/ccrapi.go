@@ -20,16 +20,15 @@ package ccrapis
 
 import (
 	"net/http"
-	"strings"
-	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
 	tcr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/tcr/v20190924"
 	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis"
 	"tkestack.io/image-transfer/pkg/log"
-	"tkestack.io/image-transfer/pkg/utils"
+	"tkestack.io/image-transfer/pkg/network"
 )
 
 // CCRAPIClient wrap http client
@@ -66,172 +65,29 @@ var RegionPrefix = map[string]string{
 
 // NewCCRAPIClient is new return *CCRAPIClient
 func NewCCRAPIClient() *CCRAPIClient {
-	httpclient := http.Client{}
+	httpclient := http.Client{Transport: network.Transport()}
 	ai := CCRAPIClient{httpClient: &httpclient}
 
 	return &ai
 }
 
-// GetAllNamespaceByName get all ns from ccr name
-func (ai *CCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret, region string) ([]string, error) {
-
-	var nsList []string
-
-	secretID, secretKey, err := GetCcrSecret(secret)
-
-	if err != nil {
-		log.Errorf("GetCcrSecret error: ", err)
-		return nsList, err
-	}
-
-	offset := int64(0)
-	count := 0
-	limit := int64(100)
-
-	for {
-		resp, err := ai.DescribeNamespacePersonal(secretID, secretKey, region, offset, limit)
-		if err != nil {
-			log.Errorf("GetAllNamespaceByName error, ", err)
-			return nsList, err
-		}
-		namespaceCount := *resp.Response.Data.NamespaceCount
-		count += len(resp.Response.Data.NamespaceInfo)
-
-		for _, ns := range resp.Response.Data.NamespaceInfo {
-			nsList = append(nsList, *ns.Namespace)
-		}
-		log.Debugf("ccr namespace offset %d limit %d resp is %s", offset, limit, resp.ToJsonString())
-
-		if int64(count) >= namespaceCount {
-			break
-		} else {
-			offset += limit
-		}
-
-	}
-
-	return nsList, nil
-
-}
-
-//GetAllCcrRepo get all ccr repo send to repoChan
-func (ai *CCRAPIClient) GetAllCcrRepo(secret map[string]configs.Secret, ccrRegion string,
-	failedNsList []string, tcrRegion string, tcrName string, repoChan chan string, toltalCount int64) error {
-	secretID, secretKey, err := GetCcrSecret(secret)
-	if err != nil {
-		log.Errorf("GetCcrSecret error: %s", err)
-		return err
-	}
-
-	offset := int64(0)
-	limit := int64(100)
-	maxGorutineNum := 5
-	page := toltalCount / limit
-	if toltalCount%limit > 0 {
-		page++
-	}
-	wg := sync.WaitGroup{}
-	defer close(repoChan)
-	leakCh := make(chan struct{}, maxGorutineNum)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for i := 0; i < maxGorutineNum; i++ {
-			leakCh <- struct{}{}
-		}
-	}()
-
-	for j := int64(0); j < page; j++ {
-		wg.Add(1)
-		<-leakCh
-		go func(n int64) {
-			defer wg.Done()
-			offset = n * limit
-			resp, err := ai.DescribeRepositoryOwnerPersonal(secretID, secretKey, ccrRegion, offset, limit)
-			if err != nil {
-				log.Errorf("get ccr repo offset %d limit %d error, %s", offset, limit, err)
-				return
-			}
-			for _, repo := range resp.Response.Data.RepoInfo {
-				ns := strings.Split(*repo.RepoName, "/")[0]
-				if len(failedNsList) == 0 || !utils.IsContain(failedNsList, ns) {
-					repoChan <- *repo.RepoName
-				}
-			}
-			leakCh <- struct{}{}
-		}(j)
-	}
-	wg.Wait()
-	return nil
-}
-
-// GetRepoTags get ccr repo tags
-func (ai *CCRAPIClient) GetRepoTags(secretID, secretKey, ccrRegion, repoName string, ccrTagNum int64) ([]string, error) {
-
-	if ccrTagNum < 0 {
-		return nil, errors.Errorf("Invalid value ccrTagNum %v", ccrTagNum)
-	}
-
-	offset := int64(0)
-	count := int64(0)
-	limit := int64(100)
-
-	var result []string
-
-	for {
-		resp, err := ai.DescribeImagePersonal(secretID, secretKey, ccrRegion, repoName, offset, limit)
-		if err != nil {
-			return nil, err
-		}
-		var tagCount int64
-
-		if resp.Response != nil && resp.Response.Data != nil {
-			tagCount = *resp.Response.Data.TagCount
-		} else {
-			return nil, errors.New("DescribeImagePersonal resp is nil")
-		}
-		if tagCount == 0 {
-			return nil, nil
-		}
-		if ccrTagNum >= tagCount {
-			ccrTagNum = tagCount
-		}
-
-		count += int64(len(resp.Response.Data.TagInfo))
-		for _, tagInfo := range resp.Response.Data.TagInfo {
-			result = append(result, *tagInfo.TagName)
-		}
-
-		if count >= ccrTagNum {
-			break
-		}
-
-		if count >= tagCount {
-			break
-		} else {
-			offset += limit
-		}
-
-	}
-	// in case index out of range
-	if ccrTagNum > int64(len(result)) {
-		ccrTagNum = int64(len(result))
-	}
-
-	return result[:ccrTagNum], nil
-}
-
-func (ai *CCRAPIClient) DescribeImagePersonal(secretID, secretKey,
-	region, repoName string, offset, limit int64) (*tcr.DescribeImagePersonalResponse, error) {
-
+func (ai *CCRAPIClient) newClient(secretID, secretKey, region string) *tcr.Client {
 	credential := common.NewCredential(
 		secretID,
 		secretKey,
 	)
 	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
+	cpf.HttpProfile.Scheme, cpf.HttpProfile.Endpoint = apis.Endpoint()
 	client, _ := tcr.NewClient(credential, region, cpf)
+	client.WithHttpTransport(ai.httpClient.Transport)
+	return client
+}
+
+// DescribeImagePersonal is ccr api DescribeImagePersonal
+func (ai *CCRAPIClient) DescribeImagePersonal(secretID, secretKey,
+	region, repoName string, offset, limit int64) (*tcr.DescribeImagePersonalResponse, error) {
 
+	client := ai.newClient(secretID, secretKey, region)
 	request := tcr.NewDescribeImagePersonalRequest()
 
 	request.Limit = common.Int64Ptr(limit)
@@ -252,14 +108,7 @@ func (ai *CCRAPIClient) DescribeImagePersonal(secretID, secretKey,
 func (ai *CCRAPIClient) DescribeNamespacePersonal(secretID, secretKey,
 	region string, offset, limit int64) (*tcr.DescribeNamespacePersonalResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
-	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
-
+	client := ai.newClient(secretID, secretKey, region)
 	request := tcr.NewDescribeNamespacePersonalRequest()
 
 	request.Namespace = common.StringPtr("")
@@ -281,14 +130,7 @@ func (ai *CCRAPIClient) DescribeNamespacePersonal(secretID, secretKey,
 func (ai *CCRAPIClient) DescribeRepositoryOwnerPersonal(secretID, secretKey,
 	region string, offset, limit int64) (*tcr.DescribeRepositoryOwnerPersonalResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
-	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
-
+	client := ai.newClient(secretID, secretKey, region)
 	request := tcr.NewDescribeRepositoryOwnerPersonalRequest()
 
 	request.Limit = common.Int64Ptr(limit)
@@ -305,6 +147,88 @@ func (ai *CCRAPIClient) DescribeRepositoryOwnerPersonal(secretID, secretKey,
 
 }
 
+// CreateNamespacePersonal is ccr api CreateNamespacePersonal
+func (ai *CCRAPIClient) CreateNamespacePersonal(secretID, secretKey,
+	region string, namespace string) (*tcr.CreateNamespacePersonalResponse, error) {
+
+	client := ai.newClient(secretID, secretKey, region)
+	request := tcr.NewCreateNamespacePersonalRequest()
+
+	request.Namespace = common.StringPtr(namespace)
+
+	response, err := client.CreateNamespacePersonal(request)
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
+// DescribeUserQuotaPersonal is ccr api DescribeUserQuotaPersonal
+func (ai *CCRAPIClient) DescribeUserQuotaPersonal(secretID, secretKey,
+	region string) (*tcr.DescribeUserQuotaPersonalResponse, error) {
+
+	client := ai.newClient(secretID, secretKey, region)
+	request := tcr.NewDescribeUserQuotaPersonalRequest()
+
+	response, err := client.DescribeUserQuotaPersonal(request)
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
+// GetAllCcrRepoInfo get all ccr repos with their visibility and description
+func (ai *CCRAPIClient) GetAllCcrRepoInfo(secret map[string]configs.Secret, ccrRegion string) ([]*tcr.RepoInfo, error) {
+	secretID, secretKey, err := GetCcrSecret(secret)
+	if err != nil {
+		log.Errorf("GetCcrSecret error: %s", err)
+		return nil, err
+	}
+
+	var repos []*tcr.RepoInfo
+	offset := int64(0)
+	limit := int64(100)
+	for {
+		resp, err := ai.DescribeRepositoryOwnerPersonal(secretID, secretKey, ccrRegion, offset, limit)
+		if err != nil {
+			log.Errorf("get ccr repo offset %d limit %d error, %s", offset, limit, err)
+			return nil, err
+		}
+		repos = append(repos, resp.Response.Data.RepoInfo...)
+		if len(resp.Response.Data.RepoInfo) == 0 || int64(len(repos)) >= *resp.Response.Data.TotalCount {
+			break
+		}
+		offset += limit
+	}
+	return repos, nil
+}
+
+// DescribeImageLifecycleGlobalPersonal is ccr api DescribeImageLifecycleGlobalPersonal
+func (ai *CCRAPIClient) DescribeImageLifecycleGlobalPersonal(secretID, secretKey,
+	region string) (*tcr.DescribeImageLifecycleGlobalPersonalResponse, error) {
+
+	client := ai.newClient(secretID, secretKey, region)
+	request := tcr.NewDescribeImageLifecycleGlobalPersonalRequest()
+
+	response, err := client.DescribeImageLifecycleGlobalPersonal(request)
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
 // GetCcrSecret get ccr secret from configs
 func GetCcrSecret(secret map[string]configs.Secret) (string, string, error) {
 	var secretID string
@@ -0,0 +1,67 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+// Package apis holds the settings shared by the tencent cloud api clients of ccr and tcr
+package apis
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// DefaultEndpoint is the endpoint of tencent cloud tcr api, it serves both ccr and tcr
+const DefaultEndpoint = "tcr.tencentcloudapi.com"
+
+var (
+	mutex    sync.RWMutex
+	scheme   = "HTTPS"
+	endpoint = DefaultEndpoint
+)
+
+// SetEndpoint sets the endpoint of tencent cloud api, like tcr.internal.tencentcloudapi.com or
+// http://127.0.0.1:8080 for a local fake. The default endpoint is used if it is empty
+func SetEndpoint(value string) error {
+	newScheme, newEndpoint := "HTTPS", DefaultEndpoint
+	if value != "" {
+		if !strings.Contains(value, "://") {
+			value = "https://" + value
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid tencent cloud api endpoint %s: %v", value, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("invalid tencent cloud api endpoint %s, should be host[:port] or http(s)://host[:port]", value)
+		}
+		newScheme, newEndpoint = strings.ToUpper(u.Scheme), u.Host
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	scheme, endpoint = newScheme, newEndpoint
+	return nil
+}
+
+// Endpoint returns the scheme, HTTPS or HTTP, and the host of tencent cloud api
+func Endpoint() (string, string) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return scheme, endpoint
+}
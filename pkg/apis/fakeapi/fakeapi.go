@@ -0,0 +1,644 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+// Package fakeapi is an offline fake of the tencent cloud tcr api for tests, it serves the ccr
+// personal edition and tcr enterprise instances used by ccrToTcr and tcrToTcr mode
+package fakeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	tcr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/tcr/v20190924"
+)
+
+// Tag is an image tag of a ccr or tcr repo
+type Tag struct {
+	Name     string
+	Digest   string
+	PushTime time.Time
+}
+
+// CcrRepo is a repo of ccr personal edition
+type CcrRepo struct {
+	// Name is namespace/repo
+	Name        string
+	Public      bool
+	Description string
+	Tags        []Tag
+}
+
+// Namespace is a namespace of a tcr instance
+type Namespace struct {
+	ID     int64
+	Name   string
+	Public bool
+}
+
+// Repo is a repo of a tcr instance
+type Repo struct {
+	Namespace        string
+	Name             string
+	BriefDescription string
+	Description      string
+	Tags             []Tag
+}
+
+// instance is a tcr instance
+type instance struct {
+	id         string
+	name       string
+	region     string
+	namespaces []*Namespace
+	repos      []*Repo
+}
+
+// apiError is the error of an action returned in the response
+type apiError struct {
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Server serves the tcr api on a local http address, all secrets are accepted
+type Server struct {
+	*httptest.Server
+
+	// CcrNamespaceQuota and CcrRepoQuota are returned by DescribeUserQuotaPersonal
+	CcrNamespaceQuota int64
+	CcrRepoQuota      int64
+
+	mutex         sync.Mutex
+	ccrNamespaces []string
+	ccrRepos      []*CcrRepo
+	instances     []*instance
+	nextID        int64
+	// calls counts the requests of each action
+	calls map[string]int
+}
+
+// NewServer starts a fake tcr api server, it should be closed after use
+func NewServer() *Server {
+	s := &Server{
+		CcrNamespaceQuota: 10,
+		CcrRepoQuota:      500,
+		calls:             make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Endpoint returns the endpoint of the server for apis.SetEndpoint
+func (s *Server) Endpoint() string {
+	return s.URL
+}
+
+// Calls returns the number of requests of action
+func (s *Server) Calls(action string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[action]
+}
+
+// AddCcrNamespace adds a ccr namespace
+func (s *Server) AddCcrNamespace(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addCcrNamespace(name)
+}
+
+func (s *Server) addCcrNamespace(name string) {
+	for _, ns := range s.ccrNamespaces {
+		if ns == name {
+			return
+		}
+	}
+	s.ccrNamespaces = append(s.ccrNamespaces, name)
+}
+
+// AddCcrRepo adds a ccr repo and its namespace
+func (s *Server) AddCcrRepo(repo CcrRepo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.addCcrNamespace(strings.SplitN(repo.Name, "/", 2)[0])
+	s.ccrRepos = append(s.ccrRepos, &repo)
+}
+
+// CcrNamespaces returns the ccr namespaces
+func (s *Server) CcrNamespaces() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.ccrNamespaces...)
+}
+
+// AddInstance adds a tcr instance named name in region
+func (s *Server) AddInstance(id, name, region string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.instances = append(s.instances, &instance{id: id, name: name, region: region})
+}
+
+// AddNamespace adds a namespace to tcr instance id
+func (s *Server) AddNamespace(id, name string, public bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.createNamespace(id, name, public)
+	return err
+}
+
+// AddRepo adds a repo namespace/repo to tcr instance id, the namespace should exist
+func (s *Server) AddRepo(id, repo string, tags ...Tag) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	inst, err := s.instance(id)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("repo %s should be namespace/repo", repo)
+	}
+	if inst.namespace(parts[0]) == nil {
+		return fmt.Errorf("namespace %s of instance %s not found", parts[0], id)
+	}
+	inst.repos = append(inst.repos, &Repo{Namespace: parts[0], Name: parts[1], Tags: tags})
+	return nil
+}
+
+// Namespaces returns the namespaces of tcr instance id
+func (s *Server) Namespaces(id string) []Namespace {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	inst, err := s.instance(id)
+	if err != nil {
+		return nil
+	}
+	namespaces := make([]Namespace, 0, len(inst.namespaces))
+	for _, ns := range inst.namespaces {
+		namespaces = append(namespaces, *ns)
+	}
+	return namespaces
+}
+
+// Repo returns the repo namespace/repo of tcr instance id, nil if it does not exist
+func (s *Server) Repo(id, repo string) *Repo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	inst, err := s.instance(id)
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	if r := inst.repo(parts[0], parts[1]); r != nil {
+		copied := *r
+		return &copied
+	}
+	return nil
+}
+
+func (s *Server) instance(id string) (*instance, error) {
+	for _, inst := range s.instances {
+		if inst.id == id {
+			return inst, nil
+		}
+	}
+	return nil, &apiError{Code: "ResourceNotFound", Message: fmt.Sprintf("instance %s not found", id)}
+}
+
+func (s *Server) createNamespace(id, name string, public bool) (*Namespace, error) {
+	inst, err := s.instance(id)
+	if err != nil {
+		return nil, err
+	}
+	if inst.namespace(name) != nil {
+		return nil, &apiError{Code: "ResourceInUse", Message: fmt.Sprintf("namespace %s already exists", name)}
+	}
+	s.nextID++
+	ns := &Namespace{ID: s.nextID, Name: name, Public: public}
+	inst.namespaces = append(inst.namespaces, ns)
+	return ns, nil
+}
+
+func (inst *instance) namespace(name string) *Namespace {
+	for _, ns := range inst.namespaces {
+		if ns.Name == name {
+			return ns
+		}
+	}
+	return nil
+}
+
+func (inst *instance) repo(ns, name string) *Repo {
+	for _, repo := range inst.repos {
+		if repo.Namespace == ns && repo.Name == name {
+			return repo
+		}
+	}
+	return nil
+}
+
+// serveHTTP dispatches a request by its X-TC-Action header, signatures are not verified
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	action := r.Header.Get("X-TC-Action")
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	s.calls[action]++
+	var result map[string]interface{}
+	if handler, ok := s.handlers()[action]; ok {
+		result, err = handler(r.Header.Get("X-TC-Region"), body)
+	} else {
+		err = &apiError{Code: "InvalidAction", Message: fmt.Sprintf("action %s is not supported by the fake api", action)}
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		e, ok := err.(*apiError)
+		if !ok {
+			e = &apiError{Code: "InvalidParameter", Message: err.Error()}
+		}
+		result = map[string]interface{}{"Error": map[string]string{"Code": e.Code, "Message": e.Message}}
+	}
+	result["RequestId"] = fmt.Sprintf("fake-%s-%d", action, time.Now().UnixNano())
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Response": result})
+}
+
+type handler func(region string, body []byte) (map[string]interface{}, error)
+
+func (s *Server) handlers() map[string]handler {
+	return map[string]handler{
+		"DescribeNamespacePersonal":            s.describeNamespacePersonal,
+		"DescribeRepositoryOwnerPersonal":      s.describeRepositoryOwnerPersonal,
+		"DescribeImagePersonal":                s.describeImagePersonal,
+		"DescribeUserQuotaPersonal":            s.describeUserQuotaPersonal,
+		"DescribeImageLifecycleGlobalPersonal": s.describeImageLifecycleGlobalPersonal,
+		"DescribeInstances":                    s.describeInstances,
+		"DescribeNamespaces":                   s.describeNamespaces,
+		"CreateNamespace":                      s.createNamespaceAction,
+		"DescribeRepositories":                 s.describeRepositories,
+		"CreateRepository":                     s.createRepository,
+		"ModifyRepository":                     s.modifyRepository,
+		"DescribeImages":                       s.describeImages,
+	}
+}
+
+// offsetPage returns the range of a page of ccr api, offset is the index of the first item
+func offsetPage(total int, offset, limit *int64) (int, int) {
+	start, size := 0, 20
+	if offset != nil {
+		start = int(*offset)
+	}
+	if limit != nil {
+		size = int(*limit)
+	}
+	return clamp(start, total), clamp(start+size, total)
+}
+
+// numberPage returns the range of a page of tcr api, offset is the page number from 1
+func numberPage(total int, offset, limit *int64) (int, int) {
+	page, size := 1, 20
+	if offset != nil && *offset > 0 {
+		page = int(*offset)
+	}
+	if limit != nil {
+		size = int(*limit)
+	}
+	return clamp((page-1)*size, total), clamp(page*size, total)
+}
+
+func clamp(i, total int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > total {
+		return total
+	}
+	return i
+}
+
+func formatTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	return common.StringPtr(t.Format(time.RFC3339))
+}
+
+func (s *Server) describeNamespacePersonal(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewDescribeNamespacePersonalRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, ns := range s.ccrNamespaces {
+		if req.Namespace == nil || strings.Contains(ns, *req.Namespace) {
+			names = append(names, ns)
+		}
+	}
+	start, end := offsetPage(len(names), req.Offset, req.Limit)
+	data := &tcr.NamespaceInfoResp{NamespaceCount: common.Int64Ptr(int64(len(names)))}
+	for _, ns := range names[start:end] {
+		count := int64(0)
+		for _, repo := range s.ccrRepos {
+			if strings.HasPrefix(repo.Name, ns+"/") {
+				count++
+			}
+		}
+		data.NamespaceInfo = append(data.NamespaceInfo, &tcr.NamespaceInfo{
+			Namespace: common.StringPtr(ns),
+			RepoCount: common.Int64Ptr(count),
+		})
+	}
+	return map[string]interface{}{"Data": data}, nil
+}
+
+func (s *Server) describeRepositoryOwnerPersonal(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewDescribeRepositoryOwnerPersonalRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	start, end := offsetPage(len(s.ccrRepos), req.Offset, req.Limit)
+	data := &tcr.RepoInfoResp{TotalCount: common.Int64Ptr(int64(len(s.ccrRepos)))}
+	for _, repo := range s.ccrRepos[start:end] {
+		public := int64(0)
+		if repo.Public {
+			public = 1
+		}
+		data.RepoInfo = append(data.RepoInfo, &tcr.RepoInfo{
+			RepoName:    common.StringPtr(repo.Name),
+			TagCount:    common.Int64Ptr(int64(len(repo.Tags))),
+			Public:      common.Int64Ptr(public),
+			Description: common.StringPtr(repo.Description),
+		})
+	}
+	return map[string]interface{}{"Data": data}, nil
+}
+
+func (s *Server) describeImagePersonal(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewDescribeImagePersonalRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	var repo *CcrRepo
+	for _, r := range s.ccrRepos {
+		if req.RepoName != nil && r.Name == *req.RepoName {
+			repo = r
+		}
+	}
+	if repo == nil {
+		return nil, &apiError{Code: "ResourceNotFound", Message: "repo not found"}
+	}
+	start, end := offsetPage(len(repo.Tags), req.Offset, req.Limit)
+	data := &tcr.TagInfoResp{TagCount: common.Int64Ptr(int64(len(repo.Tags))), RepoName: common.StringPtr(repo.Name)}
+	for _, tag := range repo.Tags[start:end] {
+		data.TagInfo = append(data.TagInfo, &tcr.TagInfo{
+			TagName:  common.StringPtr(tag.Name),
+			ImageId:  common.StringPtr(tag.Digest),
+			PushTime: formatTime(tag.PushTime),
+		})
+	}
+	return map[string]interface{}{"Data": data}, nil
+}
+
+func (s *Server) describeUserQuotaPersonal(region string, body []byte) (map[string]interface{}, error) {
+	return map[string]interface{}{"Data": &tcr.RespLimit{LimitInfo: []*tcr.Limit{
+		{Type: common.StringPtr("namespace"), Value: common.Int64Ptr(s.CcrNamespaceQuota)},
+		{Type: common.StringPtr("repo"), Value: common.Int64Ptr(s.CcrRepoQuota)},
+	}}}, nil
+}
+
+func (s *Server) describeImageLifecycleGlobalPersonal(region string, body []byte) (map[string]interface{}, error) {
+	return map[string]interface{}{"Data": &tcr.AutoDelStrategyInfoResp{}}, nil
+}
+
+func (s *Server) describeInstances(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewDescribeInstancesRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	var registries []*tcr.Registry
+	for _, inst := range s.instances {
+		if inst.region != "" && region != "" && inst.region != region {
+			continue
+		}
+		if !matchFilters(req.Filters, map[string]string{"RegistryName": inst.name, "RegistryId": inst.id}) {
+			continue
+		}
+		registries = append(registries, &tcr.Registry{
+			RegistryId:   common.StringPtr(inst.id),
+			RegistryName: common.StringPtr(inst.name),
+			RegistryType: common.StringPtr("standard"),
+			Status:       common.StringPtr("Running"),
+			PublicDomain: common.StringPtr(inst.name + ".tencentcloudcr.com"),
+			RegionName:   common.StringPtr(inst.region),
+		})
+	}
+	return map[string]interface{}{"Registries": registries, "TotalCount": len(registries)}, nil
+}
+
+// matchFilters reports whether fields match all filters, a filter matches any of its values
+func matchFilters(filters []*tcr.Filter, fields map[string]string) bool {
+	for _, filter := range filters {
+		if filter == nil || filter.Name == nil || len(filter.Values) == 0 {
+			continue
+		}
+		matched := false
+		for _, value := range filter.Values {
+			if value != nil && *value == fields[*filter.Name] {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) describeNamespaces(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewDescribeNamespacesRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(stringValue(req.RegistryId))
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []*Namespace
+	for _, ns := range inst.namespaces {
+		if req.NamespaceName == nil || *req.NamespaceName == "" || ns.Name == *req.NamespaceName {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	start, end := numberPage(len(namespaces), req.Offset, req.Limit)
+	list := []*tcr.TcrNamespaceInfo{}
+	for _, ns := range namespaces[start:end] {
+		list = append(list, &tcr.TcrNamespaceInfo{
+			Name:        common.StringPtr(ns.Name),
+			Public:      common.BoolPtr(ns.Public),
+			NamespaceId: common.Int64Ptr(ns.ID),
+		})
+	}
+	return map[string]interface{}{"NamespaceList": list, "TotalCount": len(namespaces)}, nil
+}
+
+func (s *Server) createNamespaceAction(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewCreateNamespaceRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	if stringValue(req.NamespaceName) == "" {
+		return nil, &apiError{Code: "InvalidParameter", Message: "NamespaceName is required"}
+	}
+	_, err := s.createNamespace(stringValue(req.RegistryId), *req.NamespaceName,
+		req.IsPublic != nil && *req.IsPublic)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) describeRepositories(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewDescribeRepositoriesRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(stringValue(req.RegistryId))
+	if err != nil {
+		return nil, err
+	}
+	var repos []*Repo
+	for _, repo := range inst.repos {
+		if req.NamespaceName != nil && *req.NamespaceName != "" && repo.Namespace != *req.NamespaceName {
+			continue
+		}
+		if req.RepositoryName != nil && *req.RepositoryName != "" && repo.Name != *req.RepositoryName {
+			continue
+		}
+		repos = append(repos, repo)
+	}
+	sort.SliceStable(repos, func(i, j int) bool {
+		return repos[i].Namespace+"/"+repos[i].Name < repos[j].Namespace+"/"+repos[j].Name
+	})
+	start, end := numberPage(len(repos), req.Offset, req.Limit)
+	list := []*tcr.TcrRepositoryInfo{}
+	for _, repo := range repos[start:end] {
+		ns := inst.namespace(repo.Namespace)
+		list = append(list, &tcr.TcrRepositoryInfo{
+			Name:             common.StringPtr(repo.Namespace + "/" + repo.Name),
+			Namespace:        common.StringPtr(repo.Namespace),
+			Public:           common.BoolPtr(ns != nil && ns.Public),
+			Description:      common.StringPtr(repo.Description),
+			BriefDescription: common.StringPtr(repo.BriefDescription),
+		})
+	}
+	return map[string]interface{}{"RepositoryList": list, "TotalCount": len(repos)}, nil
+}
+
+func (s *Server) createRepository(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewCreateRepositoryRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(stringValue(req.RegistryId))
+	if err != nil {
+		return nil, err
+	}
+	ns, name := stringValue(req.NamespaceName), stringValue(req.RepositoryName)
+	if inst.namespace(ns) == nil {
+		return nil, &apiError{Code: "ResourceNotFound", Message: fmt.Sprintf("namespace %s not found", ns)}
+	}
+	if inst.repo(ns, name) != nil {
+		return nil, &apiError{Code: "ResourceInUse", Message: fmt.Sprintf("repo %s/%s already exists", ns, name)}
+	}
+	inst.repos = append(inst.repos, &Repo{
+		Namespace:        ns,
+		Name:             name,
+		BriefDescription: stringValue(req.BriefDescription),
+		Description:      stringValue(req.Description),
+	})
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) modifyRepository(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewModifyRepositoryRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(stringValue(req.RegistryId))
+	if err != nil {
+		return nil, err
+	}
+	repo := inst.repo(stringValue(req.NamespaceName), stringValue(req.RepositoryName))
+	if repo == nil {
+		return nil, &apiError{Code: "ResourceNotFound", Message: "repo not found"}
+	}
+	repo.BriefDescription = stringValue(req.BriefDescription)
+	repo.Description = stringValue(req.Description)
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) describeImages(region string, body []byte) (map[string]interface{}, error) {
+	req := tcr.NewDescribeImagesRequest()
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	inst, err := s.instance(stringValue(req.RegistryId))
+	if err != nil {
+		return nil, err
+	}
+	repo := inst.repo(stringValue(req.NamespaceName), stringValue(req.RepositoryName))
+	if repo == nil {
+		return nil, &apiError{Code: "ResourceNotFound", Message: "repo not found"}
+	}
+	start, end := numberPage(len(repo.Tags), req.Offset, req.Limit)
+	list := []*tcr.TcrImageInfo{}
+	for _, tag := range repo.Tags[start:end] {
+		list = append(list, &tcr.TcrImageInfo{
+			ImageVersion: common.StringPtr(tag.Name),
+			Digest:       common.StringPtr(tag.Digest),
+			UpdateTime:   formatTime(tag.PushTime),
+		})
+	}
+	return map[string]interface{}{"ImageInfoList": list, "TotalCount": len(repo.Tags)}, nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
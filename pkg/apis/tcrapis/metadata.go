@@ -0,0 +1,181 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tcrapis
+
+import (
+	"fmt"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	tchttp "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/http"
+	tcr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/tcr/v20190924"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// RetentionRule is the rule of a tag retention policy, key is latestPushedK or nDaysSinceLastPush
+type RetentionRule struct {
+	Key   *string `json:"Key,omitempty" name:"Key"`
+	Value *int64  `json:"Value,omitempty" name:"Value"`
+}
+
+// CreateTagRetentionRuleRequest is the request of tcr api CreateTagRetentionRule,
+// the api is not provided by the sdk version in use
+type CreateTagRetentionRuleRequest struct {
+	*tchttp.BaseRequest
+
+	RegistryId    *string        `json:"RegistryId,omitempty" name:"RegistryId"`
+	NamespaceId   *int64         `json:"NamespaceId,omitempty" name:"NamespaceId"`
+	RetentionRule *RetentionRule `json:"RetentionRule,omitempty" name:"RetentionRule"`
+	CronSetting   *string        `json:"CronSetting,omitempty" name:"CronSetting"`
+	Disabled      *bool          `json:"Disabled,omitempty" name:"Disabled"`
+}
+
+// CreateTagRetentionRuleResponse is the response of tcr api CreateTagRetentionRule
+type CreateTagRetentionRuleResponse struct {
+	*tchttp.BaseResponse
+	Response *struct {
+		RequestId *string `json:"RequestId,omitempty" name:"RequestId"`
+	} `json:"Response"`
+}
+
+// ModifyNamespace is tcr api ModifyNamespace
+func (ai *TCRAPIClient) ModifyNamespace(secretID, secretKey, region string,
+	registryID string, nsName string, isPublic bool) (*tcr.ModifyNamespaceResponse, error) {
+
+	request := tcr.NewModifyNamespaceRequest()
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.IsPublic = common.BoolPtr(isPublic)
+
+	response, err := ai.newClient(secretID, secretKey, region).ModifyNamespace(request)
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+	return response, nil
+}
+
+// GetNamespaceID get the id of a tcr namespace by name
+func (ai *TCRAPIClient) GetNamespaceID(secretID, secretKey, region string,
+	registryID string, nsName string) (int64, error) {
+
+	request := tcr.NewDescribeNamespacesRequest()
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.Limit = common.Int64Ptr(100)
+	request.Offset = common.Int64Ptr(1)
+
+	response, err := ai.newClient(secretID, secretKey, region).DescribeNamespaces(request)
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return 0, err
+	}
+	// the name filter is a fuzzy match
+	for _, ns := range response.Response.NamespaceList {
+		if ns.Name != nil && *ns.Name == nsName && ns.NamespaceId != nil {
+			return *ns.NamespaceId, nil
+		}
+	}
+	return 0, fmt.Errorf("namespace %s not found in tcr %s", nsName, registryID)
+}
+
+// GetRepository get a tcr repository by name, nil is returned if it does not exist
+func (ai *TCRAPIClient) GetRepository(secretID, secretKey, region string,
+	registryID, nsName, repositoryName string) (*tcr.TcrRepositoryInfo, error) {
+
+	request := tcr.NewDescribeRepositoriesRequest()
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.RepositoryName = common.StringPtr(repositoryName)
+	request.Limit = common.Int64Ptr(100)
+	request.Offset = common.Int64Ptr(1)
+
+	response, err := ai.newClient(secretID, secretKey, region).DescribeRepositories(request)
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+	for _, repo := range response.Response.RepositoryList {
+		if repo.Name == nil {
+			continue
+		}
+		// name of the repository may be returned with its namespace
+		if *repo.Name == repositoryName || *repo.Name == nsName+"/"+repositoryName {
+			return repo, nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateRepository is tcr api CreateRepository
+func (ai *TCRAPIClient) CreateRepository(secretID, secretKey, region string,
+	registryID, nsName, repositoryName, briefDescription, description string) (*tcr.CreateRepositoryResponse, error) {
+
+	request := tcr.NewCreateRepositoryRequest()
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.RepositoryName = common.StringPtr(repositoryName)
+	request.BriefDescription = common.StringPtr(briefDescription)
+	request.Description = common.StringPtr(description)
+
+	response, err := ai.newClient(secretID, secretKey, region).CreateRepository(request)
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+	return response, nil
+}
+
+// ModifyRepository is tcr api ModifyRepository
+func (ai *TCRAPIClient) ModifyRepository(secretID, secretKey, region string,
+	registryID, nsName, repositoryName, briefDescription, description string) (*tcr.ModifyRepositoryResponse, error) {
+
+	request := tcr.NewModifyRepositoryRequest()
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.RepositoryName = common.StringPtr(repositoryName)
+	request.BriefDescription = common.StringPtr(briefDescription)
+	request.Description = common.StringPtr(description)
+
+	response, err := ai.newClient(secretID, secretKey, region).ModifyRepository(request)
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+	return response, nil
+}
+
+// CreateTagRetentionRule is tcr api CreateTagRetentionRule, the rule is run daily
+func (ai *TCRAPIClient) CreateTagRetentionRule(secretID, secretKey, region string,
+	registryID string, namespaceID int64, key string, value int64) (*CreateTagRetentionRuleResponse, error) {
+
+	request := &CreateTagRetentionRuleRequest{BaseRequest: &tchttp.BaseRequest{}}
+	request.Init().WithApiInfo("tcr", tcr.APIVersion, "CreateTagRetentionRule")
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceId = common.Int64Ptr(namespaceID)
+	request.RetentionRule = &RetentionRule{Key: common.StringPtr(key), Value: common.Int64Ptr(value)}
+	request.CronSetting = common.StringPtr("daily")
+	request.Disabled = common.BoolPtr(false)
+
+	response := &CreateTagRetentionRuleResponse{BaseResponse: &tchttp.BaseResponse{}}
+	if err := ai.newClient(secretID, secretKey, region).Send(request, response); err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+	return response, nil
+}
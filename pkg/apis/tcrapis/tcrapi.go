@@ -20,13 +20,17 @@ package tcrapis
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
 	tcr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/tcr/v20190924"
 	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/network"
 )
 
 // TCRAPIClient wrap http client
@@ -37,77 +41,29 @@ type TCRAPIClient struct {
 
 // NewTCRAPIClient is new return *CCRAPIClient
 func NewTCRAPIClient() *TCRAPIClient {
-	httpclient := http.Client{}
+	httpclient := http.Client{Transport: network.Transport()}
 	ai := TCRAPIClient{httpClient: &httpclient}
 
 	return &ai
 }
 
-// GetAllNamespaceByName get all ns from tcr name
-func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
-	region string, tcrName string) ([]string, string, error) {
-
-	var nsList []string
-	var tcrID string
-	secretID, secretKey, err := GetTcrSecret(secret)
-
-	if err != nil {
-		log.Errorf("GetTcrSecret error: ", err)
-		return nsList, tcrID, err
-	}
-
-	//get tcrId by tcr name
-	filterValues := []string{tcrName}
-	resp, err := ai.DescribeInstances(secretID, secretKey, region, 0, 100, "RegistryName", filterValues)
-	if err != nil {
-		log.Errorf("DescribeInstances error, ", err)
-		return nsList, tcrID, err
-	}
-
-	tcrID = *resp.Response.Registries[0].RegistryId
-
-	// tcr offset means page number, currently :(
-	offset := int64(1)
-	count := 0
-	limit := int64(100)
-
-	for {
-		resp, err := ai.DescribeNamespaces(secretID, secretKey, region, offset, limit, tcrID)
-		if err != nil {
-			log.Errorf("DescribeNamespaces error, ", err)
-			return nsList, tcrID, err
-		}
-		log.Debugf("tcr namespace offset %d limit %d resp is %s", offset, limit, resp.ToJsonString())
-		namespaceCount := *resp.Response.TotalCount
-		count += len(resp.Response.NamespaceList)
-		for _, ns := range resp.Response.NamespaceList {
-			nsList = append(nsList, *ns.Name)
-		}
-
-		if int64(count) >= namespaceCount {
-			break
-		} else {
-			offset += 1
-		}
-
-	}
-
-	return nsList, tcrID, nil
-
-}
-
-// DescribeInstances is tcr api DescribeInstances
-func (ai *TCRAPIClient) DescribeInstances(secretID, secretKey, region string, offset,
-	limit int64, filterName string, filterValues []string) (*tcr.DescribeInstancesResponse, error) {
-
+func (ai *TCRAPIClient) newClient(secretID, secretKey, region string) *tcr.Client {
 	credential := common.NewCredential(
 		secretID,
 		secretKey,
 	)
 	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
+	cpf.HttpProfile.Scheme, cpf.HttpProfile.Endpoint = apis.Endpoint()
 	client, _ := tcr.NewClient(credential, region, cpf)
+	client.WithHttpTransport(ai.httpClient.Transport)
+	return client
+}
+
+// DescribeInstances is tcr api DescribeInstances
+func (ai *TCRAPIClient) DescribeInstances(secretID, secretKey, region string, offset,
+	limit int64, filterName string, filterValues []string) (*tcr.DescribeInstancesResponse, error) {
 
+	client := ai.newClient(secretID, secretKey, region)
 	request := tcr.NewDescribeInstancesRequest()
 
 	request.Filters = []*tcr.Filter{
@@ -132,14 +88,7 @@ func (ai *TCRAPIClient) DescribeInstances(secretID, secretKey, region string, of
 func (ai *TCRAPIClient) DescribeNamespaces(secretID, secretKey, region string, offset,
 	limit int64, registryID string) (*tcr.DescribeNamespacesResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
-	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
-
+	client := ai.newClient(secretID, secretKey, region)
 	request := tcr.NewDescribeNamespacesRequest()
 
 	request.RegistryId = common.StringPtr(registryID)
@@ -159,21 +108,14 @@ func (ai *TCRAPIClient) DescribeNamespaces(secretID, secretKey, region string, o
 
 // CreateNamespace is tcr api CreateNamespace
 func (ai *TCRAPIClient) CreateNamespace(secretID, secretKey, region string,
-	registryID string, nsName string) (*tcr.CreateNamespaceResponse, error) {
-
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
-	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
+	registryID string, nsName string, isPublic bool) (*tcr.CreateNamespaceResponse, error) {
 
+	client := ai.newClient(secretID, secretKey, region)
 	request := tcr.NewCreateNamespaceRequest()
 
 	request.RegistryId = common.StringPtr(registryID)
 	request.NamespaceName = common.StringPtr(nsName)
-	request.IsPublic = common.BoolPtr(false)
+	request.IsPublic = common.BoolPtr(isPublic)
 
 	response, err := client.CreateNamespace(request)
 
@@ -186,6 +128,27 @@ func (ai *TCRAPIClient) CreateNamespace(secretID, secretKey, region string,
 
 }
 
+// CreateInstanceToken is tcr api CreateInstanceToken, it creates a temporary token of the instance
+func (ai *TCRAPIClient) CreateInstanceToken(secretID, secretKey, region string,
+	registryID string) (*tcr.CreateInstanceTokenResponse, error) {
+
+	client := ai.newClient(secretID, secretKey, region)
+	request := tcr.NewCreateInstanceTokenRequest()
+
+	request.RegistryId = common.StringPtr(registryID)
+	request.TokenType = common.StringPtr("temp")
+
+	response, err := client.CreateInstanceToken(request)
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
 // GetTcrSecret get tcr secret from config
 func GetTcrSecret(secret map[string]configs.Secret) (string, string, error) {
 	var secretID string
@@ -206,72 +169,104 @@ func GetTcrSecret(secret map[string]configs.Secret) (string, string, error) {
 	return secretID, secretKey, nil
 }
 
-// DescribeImages get the images list of tcr repo
-func (ai *TCRAPIClient) DescribeImages(secretID, secretKey, region, registryID, nsName, repositoryName string, offset, limit int64) (*tcr.DescribeImagesResponse, error) {
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
-	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
-
-	request := tcr.NewDescribeImagesRequest()
-	request.RegistryId = common.StringPtr(registryID)
-	request.NamespaceName = common.StringPtr(nsName)
-	request.RepositoryName = common.StringPtr(repositoryName)
-	request.Limit = common.Int64Ptr(limit)
-	request.Offset = common.Int64Ptr(offset)
-	
-	response, err := client.DescribeImages(request)
+// GetSourceTcrSecret get the secret of the source tcr instance in tcrToTcr mode,
+// the tcr secret is used if sourceTcr is not provided
+func GetSourceTcrSecret(secret map[string]configs.Secret) (string, string, error) {
+	if source, ok := secret["sourceTcr"]; ok {
+		return source.SecretID, source.SecretKey, nil
+	}
+	return GetTcrSecret(secret)
+}
 
+// GetInstanceID get tcr instance id by name
+func (ai *TCRAPIClient) GetInstanceID(secretID, secretKey, region, tcrName string) (string, error) {
+	resp, err := ai.DescribeInstances(secretID, secretKey, region, 0, 100, "RegistryName", []string{tcrName})
 	if err != nil {
-		log.Errorf("An error has returned: %s", err)
-		return nil, err
+		log.Errorf("DescribeInstances error, %s", err)
+		return "", err
 	}
-	return response, nil
+	for _, registry := range resp.Response.Registries {
+		if registry.RegistryName != nil && *registry.RegistryName == tcrName && registry.RegistryId != nil {
+			return *registry.RegistryId, nil
+		}
+	}
+	return "", fmt.Errorf("tcr instance %s not found in region %s", tcrName, region)
 }
 
-// GetRepoTags get tcr repo tag list
-func (ai *TCRAPIClient) GetRepoTags(secretID, secretKey, region, tcrName, nsName, repositoryName, instanceName string) ([]string, error) {
-	var tags []string
+// GetAllNamespaces get all namespaces of a tcr instance with their visibility
+func (ai *TCRAPIClient) GetAllNamespaces(secretID, secretKey, region,
+	registryID string) ([]*tcr.TcrNamespaceInfo, error) {
 
-	tcrID := instanceName
-	if tcrID == "" { 
-		//get tcrId by tcr name
-		filterValues := []string{tcrName}
-		resp, err := ai.DescribeInstances(secretID, secretKey, region, 0, 100, "RegistryName", filterValues)
+	var nsList []*tcr.TcrNamespaceInfo
+	// tcr offset means page number
+	offset := int64(1)
+	limit := int64(100)
+	for {
+		resp, err := ai.DescribeNamespaces(secretID, secretKey, region, offset, limit, registryID)
 		if err != nil {
-			log.Errorf("DescribeInstances error, %s", err)
-			return tags, err
+			log.Errorf("DescribeNamespaces error, %s", err)
+			return nil, err
 		}
-
-		tcrID = *resp.Response.Registries[0].RegistryId
+		nsList = append(nsList, resp.Response.NamespaceList...)
+		if len(resp.Response.NamespaceList) == 0 || int64(len(nsList)) >= *resp.Response.TotalCount {
+			break
+		}
+		offset++
 	}
+	return nsList, nil
+}
 
-	// tcr offset means page number, currently :(
-	offset := int64(1)
+// GetAllRepositories get all repository names of a namespace of a tcr instance, names do not contain the namespace
+func (ai *TCRAPIClient) GetAllRepositories(secretID, secretKey, region,
+	registryID, nsName string) ([]string, error) {
+
+	var repos []string
 	count := 0
+	// tcr offset means page number
+	offset := int64(1)
 	limit := int64(100)
-
 	for {
-		resp, err := ai.DescribeImages(secretID, secretKey, region, tcrID, nsName, repositoryName, offset, limit)
+		request := tcr.NewDescribeRepositoriesRequest()
+		request.RegistryId = common.StringPtr(registryID)
+		request.NamespaceName = common.StringPtr(nsName)
+		request.Limit = common.Int64Ptr(limit)
+		request.Offset = common.Int64Ptr(offset)
+
+		resp, err := ai.newClient(secretID, secretKey, region).DescribeRepositories(request)
 		if err != nil {
-			log.Errorf("DescribeImages error, %s", err)
-			return tags, err
+			log.Errorf("DescribeRepositories error, %s", err)
+			return nil, err
 		}
-		tagsCount := *resp.Response.TotalCount
-		count += len(resp.Response.ImageInfoList)
-		for _, tagInfo := range resp.Response.ImageInfoList {
-			tags = append(tags, *tagInfo.ImageVersion)
+		count += len(resp.Response.RepositoryList)
+		for _, repo := range resp.Response.RepositoryList {
+			if repo.Name == nil {
+				continue
+			}
+			repos = append(repos, strings.TrimPrefix(*repo.Name, nsName+"/"))
 		}
-
-		log.Debugf("tcr get tag repo %s/%s offset %d, limit %d, total count %d, current count %d, resp %v", nsName, repositoryName, offset, limit, tagsCount, count, resp.ToJsonString())
-		if int64(count) >= tagsCount {
+		if len(resp.Response.RepositoryList) == 0 || int64(count) >= *resp.Response.TotalCount {
 			break
-		} else {
-			offset++
 		}
+		offset++
 	}
-	return tags, nil
+	return repos, nil
+}
+
+// DescribeImages get the images list of tcr repo
+func (ai *TCRAPIClient) DescribeImages(secretID, secretKey, region, registryID, nsName, repositoryName string, offset, limit int64) (*tcr.DescribeImagesResponse, error) {
+	client := ai.newClient(secretID, secretKey, region)
+	request := tcr.NewDescribeImagesRequest()
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.RepositoryName = common.StringPtr(repositoryName)
+	request.Limit = common.Int64Ptr(limit)
+	request.Offset = common.Int64Ptr(offset)
+
+	response, err := client.DescribeImages(request)
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+	return response, nil
 }
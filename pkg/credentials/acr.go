@@ -0,0 +1,106 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+)
+
+const (
+	azureAuthorityHost = "https://login.microsoftonline.com"
+	azureScope         = "https://management.azure.com/.default"
+	// acrUsername is the username of acr to login with a refresh token
+	acrUsername = "00000000-0000-0000-0000-000000000000"
+	// acrTokenLifetime is used if the expiry of a refresh token can not be parsed
+	acrTokenLifetime = time.Hour
+)
+
+// acrProvider exchanges an azure ad token of a service principal for an acr refresh token,
+// the service principal defaults to the standard azure environment variables
+type acrProvider struct{}
+
+// Credentials implements configs.CredentialProvider
+func (acrProvider) Credentials(registry string, conf configs.TokenProvider,
+	_ map[string]configs.Secret) (configs.Security, time.Time, error) {
+	tenantID := valueOrEnv(conf.TenantID, "AZURE_TENANT_ID")
+	clientID := valueOrEnv(conf.ClientID, "AZURE_CLIENT_ID")
+	clientSecret := valueOrEnv(conf.ClientSecret, "AZURE_CLIENT_SECRET")
+	if tenantID == "" || clientID == "" || clientSecret == "" {
+		return configs.Security{}, time.Time{}, fmt.Errorf("azure service principal is not provided")
+	}
+
+	var aadToken struct {
+		AccessToken string `json:"access_token"`
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"scope":         {azureScope},
+	}
+	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/token", azureAuthorityHost, tenantID)
+	if err := postForm(endpoint, form, &aadToken); err != nil {
+		return configs.Security{}, time.Time{}, fmt.Errorf("get azure ad token error: %v", err)
+	}
+
+	var acrToken struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	form = url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"tenant":       {tenantID},
+		"access_token": {aadToken.AccessToken},
+	}
+	if err := postForm("https://"+registry+"/oauth2/exchange", form, &acrToken); err != nil {
+		return configs.Security{}, time.Time{}, fmt.Errorf("exchange acr refresh token error: %v", err)
+	}
+
+	expiry, ok := jwtExpiry(acrToken.RefreshToken)
+	if !ok {
+		expiry = time.Now().Add(acrTokenLifetime)
+	}
+	return configs.Security{Username: acrUsername, Password: acrToken.RefreshToken}, expiry, nil
+}
+
+// jwtExpiry returns the exp claim of a jwt, the signature is not verified
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,173 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package credentials
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+)
+
+const ecrTarget = "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"
+
+// ecrProvider gets registry credentials with the ecr api GetAuthorizationToken,
+// aws credentials and region default to the standard aws environment variables
+type ecrProvider struct{}
+
+type ecrAuthorizationData struct {
+	AuthorizationToken string  `json:"authorizationToken"`
+	ExpiresAt          float64 `json:"expiresAt"`
+}
+
+// Credentials implements configs.CredentialProvider
+func (ecrProvider) Credentials(registry string, conf configs.TokenProvider,
+	_ map[string]configs.Secret) (configs.Security, time.Time, error) {
+	accessKeyID := valueOrEnv(conf.AccessKeyID, "AWS_ACCESS_KEY_ID")
+	secretAccessKey := valueOrEnv(conf.SecretAccessKey, "AWS_SECRET_ACCESS_KEY")
+	sessionToken := valueOrEnv(conf.SessionToken, "AWS_SESSION_TOKEN")
+	if accessKeyID == "" || secretAccessKey == "" {
+		return configs.Security{}, time.Time{}, fmt.Errorf("aws access key is not provided")
+	}
+
+	// registry host is <account>.dkr.ecr.<region>.amazonaws.com
+	account, region, domain := parseECRHost(registry)
+	if conf.Region != "" {
+		region = conf.Region
+	}
+	region = valueOrEnv(region, "AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		return configs.Security{}, time.Time{}, fmt.Errorf("region of %s is not provided", registry)
+	}
+
+	body := []byte("{}")
+	if account != "" {
+		body, _ = json.Marshal(map[string][]string{"registryIds": {account}})
+	}
+	endpoint := fmt.Sprintf("api.ecr.%s.%s", region, domain)
+	req, err := http.NewRequest(http.MethodPost, "https://"+endpoint+"/", strings.NewReader(string(body)))
+	if err != nil {
+		return configs.Security{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", ecrTarget)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+	signV4(req, body, accessKeyID, secretAccessKey, region, "ecr", time.Now().UTC())
+
+	var resp struct {
+		AuthorizationData []ecrAuthorizationData `json:"authorizationData"`
+	}
+	if err := doJSON(req, &resp); err != nil {
+		return configs.Security{}, time.Time{}, err
+	}
+	if len(resp.AuthorizationData) == 0 {
+		return configs.Security{}, time.Time{}, fmt.Errorf("no authorization data in response of %s", endpoint)
+	}
+
+	data := resp.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return configs.Security{}, time.Time{}, fmt.Errorf("decode ecr authorization token error: %v", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return configs.Security{}, time.Time{}, fmt.Errorf("invalid ecr authorization token")
+	}
+	sec, frac := math.Modf(data.ExpiresAt)
+	expiry := time.Unix(int64(sec), int64(frac*1e9))
+	return configs.Security{Username: parts[0], Password: parts[1]}, expiry, nil
+}
+
+// parseECRHost returns the account, region and domain of an ecr registry host,
+// account and region are empty if host is not an ecr host
+func parseECRHost(host string) (string, string, string) {
+	labels := strings.Split(host, ".")
+	if len(labels) >= 6 && labels[1] == "dkr" && labels[2] == "ecr" {
+		return labels[0], labels[3], strings.Join(labels[4:], ".")
+	}
+	return "", "", "amazonaws.com"
+}
+
+// signV4 signs req with aws signature version 4
+func signV4(req *http.Request, body []byte, accessKeyID, secretAccessKey, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		"/",
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
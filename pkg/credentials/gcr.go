@@ -0,0 +1,197 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package credentials
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+)
+
+const (
+	gcpScope       = "https://www.googleapis.com/auth/cloud-platform"
+	gcpTokenURL    = "https://oauth2.googleapis.com/token"
+	gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	// gcrUsername is the username of gcr and artifact registry to login with an access token
+	gcrUsername = "oauth2accesstoken"
+)
+
+// gcrProvider gets an access token of gcp for gcr and artifact registry from a service account key,
+// gcloud application default credentials or the metadata server of gce and gke
+type gcrProvider struct{}
+
+// gcpKeyFile is a service account key file or an authorized user file of gcloud
+type gcpKeyFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type gcpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Credentials implements configs.CredentialProvider
+func (gcrProvider) Credentials(registry string, conf configs.TokenProvider,
+	_ map[string]configs.Secret) (configs.Security, time.Time, error) {
+	var token gcpToken
+	var err error
+	now := time.Now()
+	if path := gcpKeyFilePath(conf.KeyFile); path != "" {
+		token, err = gcpKeyFileToken(path, now)
+	} else {
+		token, err = gcpMetadataToken()
+	}
+	if err != nil {
+		return configs.Security{}, time.Time{}, err
+	}
+
+	expiry := now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return configs.Security{Username: gcrUsername, Password: token.AccessToken}, expiry, nil
+}
+
+// gcpKeyFilePath returns keyFile, GOOGLE_APPLICATION_CREDENTIALS or the application default
+// credentials of gcloud, it is empty if none of them exists
+func gcpKeyFilePath(keyFile string) string {
+	path := valueOrEnv(keyFile, "GOOGLE_APPLICATION_CREDENTIALS")
+	if path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	path = filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+func gcpKeyFileToken(path string, now time.Time) (gcpToken, error) {
+	var token gcpToken
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return token, fmt.Errorf("read gcp key file %s error: %v", path, err)
+	}
+	var key gcpKeyFile
+	if err := json.Unmarshal(content, &key); err != nil {
+		return token, fmt.Errorf("decode gcp key file %s error: %v", path, err)
+	}
+
+	switch key.Type {
+	case "service_account":
+		assertion, err := gcpAssertion(key, now)
+		if err != nil {
+			return token, fmt.Errorf("sign assertion of %s error: %v", key.ClientEmail, err)
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		err = postForm(gcpTokenEndpoint(key), form, &token)
+		return token, err
+	case "authorized_user":
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {key.ClientID},
+			"client_secret": {key.ClientSecret},
+			"refresh_token": {key.RefreshToken},
+		}
+		err = postForm(gcpTokenEndpoint(key), form, &token)
+		return token, err
+	default:
+		return token, fmt.Errorf("unsupported type %q of gcp key file %s", key.Type, path)
+	}
+}
+
+func gcpTokenEndpoint(key gcpKeyFile) string {
+	if key.TokenURI != "" {
+		return key.TokenURI
+	}
+	return gcpTokenURL
+}
+
+// gcpAssertion returns a jwt signed by the service account key to request an access token
+func gcpAssertion(key gcpKeyFile, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("invalid private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", err
+		}
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("private key is not a rsa key")
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": gcpScope,
+		"aud":   gcpTokenEndpoint(key),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// gcpMetadataToken gets the access token of the default service account from the metadata server
+func gcpMetadataToken() (gcpToken, error) {
+	var token gcpToken
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataURL, nil)
+	if err != nil {
+		return token, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	if err := doJSON(req, &token); err != nil {
+		return token, fmt.Errorf("no gcp key file is provided and get token from metadata server error: %v", err)
+	}
+	return token, nil
+}
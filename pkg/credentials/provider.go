@@ -0,0 +1,87 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+// Package credentials provides temporary credentials of cloud registries,
+// providers are registered to configs by name and selected in security file
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/network"
+)
+
+// requestTimeout is the timeout of a request to cloud token apis
+const requestTimeout = 30 * time.Second
+
+func init() {
+	configs.RegisterCredentialProvider("ecr", ecrProvider{})
+	configs.RegisterCredentialProvider("gcr", gcrProvider{})
+	configs.RegisterCredentialProvider("acr", acrProvider{})
+	configs.RegisterCredentialProvider("tcr", tcrProvider{})
+}
+
+// valueOrEnv returns value, or the first environment variable of names which is set if value is empty
+func valueOrEnv(value string, names ...string) string {
+	for _, name := range names {
+		if value != "" {
+			break
+		}
+		value = os.Getenv(name)
+	}
+	return value
+}
+
+// postForm posts form to endpoint and decodes the json response into target
+func postForm(endpoint string, form url.Values, target interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doJSON(req, target)
+}
+
+// doJSON sends req and decodes the json response into target
+func doJSON(req *http.Request, target interface{}) error {
+	client := &http.Client{Timeout: requestTimeout, Transport: network.Transport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d from %s: %s",
+			resp.StatusCode, req.URL.Host, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return fmt.Errorf("decode response of %s error: %v", req.URL.Host, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package credentials
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/tcrapis"
+)
+
+// tcrProvider creates a temporary token of a tcr instance with the tcr api CreateInstanceToken,
+// tencent cloud credentials default to the secret file and environment variables
+type tcrProvider struct{}
+
+// Credentials implements configs.CredentialProvider
+func (tcrProvider) Credentials(registry string, conf configs.TokenProvider,
+	secret map[string]configs.Secret) (configs.Security, time.Time, error) {
+	secretID, secretKey := conf.SecretID, conf.SecretKey
+	if secretID == "" || secretKey == "" {
+		var err error
+		secretID, secretKey, err = tcrapis.GetTcrSecret(secret)
+		if err != nil {
+			secretID = valueOrEnv("", "TENCENTCLOUD_SECRET_ID")
+			secretKey = valueOrEnv("", "TENCENTCLOUD_SECRET_KEY")
+		}
+	}
+	if secretID == "" || secretKey == "" {
+		return configs.Security{}, time.Time{}, fmt.Errorf("tencent cloud secret is not provided")
+	}
+	region := valueOrEnv(conf.Region, "TENCENTCLOUD_REGION")
+	if region == "" {
+		return configs.Security{}, time.Time{}, fmt.Errorf("region of %s is not provided", registry)
+	}
+
+	client := tcrapis.NewTCRAPIClient()
+	registryID := conf.InstanceID
+	if registryID == "" {
+		// registry host is <instance name>.tencentcloudcr.com
+		name := strings.SplitN(registry, ".", 2)[0]
+		resp, err := client.DescribeInstances(secretID, secretKey, region, 0, 100, "RegistryName", []string{name})
+		if err != nil {
+			return configs.Security{}, time.Time{}, err
+		}
+		if len(resp.Response.Registries) == 0 {
+			return configs.Security{}, time.Time{}, fmt.Errorf("tcr instance %s is not found in %s", name, region)
+		}
+		registryID = *resp.Response.Registries[0].RegistryId
+	}
+
+	resp, err := client.CreateInstanceToken(secretID, secretKey, region, registryID)
+	if err != nil {
+		return configs.Security{}, time.Time{}, err
+	}
+	if resp.Response.Token == nil || resp.Response.ExpTime == nil {
+		return configs.Security{}, time.Time{}, fmt.Errorf("no token in response of CreateInstanceToken")
+	}
+
+	username := ""
+	if resp.Response.Username != nil {
+		username = *resp.Response.Username
+	}
+	// ExpTime is a timestamp in milliseconds, it is in seconds in some api versions
+	expTime := *resp.Response.ExpTime
+	if expTime < 1e12 {
+		expTime *= 1000
+	}
+	expiry := time.Unix(0, expTime*int64(time.Millisecond))
+	return configs.Security{Username: username, Password: *resp.Response.Token}, expiry, nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/progress"
+)
+
+// SubmitTaskRequest is the body of a task submission, rules has the same format as the rule file
+type SubmitTaskRequest struct {
+	Rules map[string]string `json:"rules"`
+}
+
+// APIServer exposes a REST API to submit and inspect transfer tasks
+type APIServer struct {
+	ctx     context.Context
+	manager *TaskManager
+	// token expected in the Authorization header of every request
+	token string
+}
+
+// NewAPIServer creates an APIServer, the security file is loaded once and shared by all tasks.
+// When ctx is done the server is shut down and the running tasks are cancelled.
+// A token is required unless the server listens on a loopback address
+func NewAPIServer(ctx context.Context, opts *options.ClientOptions) (*APIServer, error) {
+	if opts.Config.CCRToTCR || opts.Config.TCRToTCR {
+		return nil, fmt.Errorf("api server does not support ccrToTcr and tcrToTcr mode")
+	}
+	if opts.Config.APIToken == "" && !isLoopbackAddr(opts.Config.APIAddr) {
+		return nil, fmt.Errorf("--api-token is required if api server listens on a non-loopback address %s",
+			opts.Config.APIAddr)
+	}
+	// several tasks may run at the same time, a live view of each would overwrite each other.
+	// The options are copied, they are shared with the webhook server and the watcher
+	if opts.Config.Progress == progress.ModeAuto || opts.Config.Progress == progress.ModeTTY {
+		configOptions := *opts.Config
+		configOptions.Progress = progress.ModePlain
+		opts = &options.ClientOptions{Config: &configOptions}
+	}
+
+	config := &configs.Configs{FlagConf: opts}
+	security, err := config.GetSecurity()
+	if err != nil {
+		return nil, err
+	}
+	config.Security = security
+	mirrors, err := config.GetMirrors()
+	if err != nil {
+		return nil, err
+	}
+	config.Mirrors = mirrors
+	if opts.Config.SecretFile != "" {
+		secret, err := config.GetSecret()
+		if err != nil {
+			return nil, err
+		}
+		config.Secret = secret
+	}
+
+	return &APIServer{ctx: ctx, manager: NewTaskManager(ctx, config), token: opts.Config.APIToken}, nil
+}
+
+// Run listens on addr and serves the API until the listener fails or the server is shut down
+func (s *APIServer) Run(addr string) error {
+	ws := new(restful.WebService)
+	ws.Path("/api/v1/tasks").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Filter(s.authenticate)
+
+	ws.Route(ws.POST("").To(s.submitTask).
+		Doc("submit a rule set as a transfer task").
+		Reads(SubmitTaskRequest{}))
+	ws.Route(ws.GET("").To(s.listTasks).
+		Doc("list transfer tasks"))
+	ws.Route(ws.GET("/{id}").To(s.getTask).
+		Doc("get a transfer task with its progress"))
+	ws.Route(ws.GET("/{id}/pairs").To(s.getTaskPairs).
+		Doc("get status and progress of each image of a task"))
+	ws.Route(ws.POST("/{id}/cancel").To(s.cancelTask).
+		Doc("cancel a running task"))
+	ws.Route(ws.POST("/{id}/retry").To(s.retryTask).
+		Doc("submit a new task transferring the failures of a finished task"))
+
+	container := restful.NewContainer()
+	container.Add(ws)
+
+	log.Infof("API server listening on %s", addr)
+	server := &http.Server{Addr: addr, Handler: container}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-s.ctx.Done():
+	}
+
+	log.Infof("Shutting down API server, wait for the running tasks")
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.Errorf("shutdown api server error: %v", err)
+	}
+	// tasks are cancelled by ctx too, each of them aborts its jobs after the grace period
+	s.manager.Wait()
+	return nil
+}
+
+// authenticate rejects requests without the token if it is set
+func (s *APIServer) authenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if s.token != "" && !checkBearerToken(req.Request, s.token) {
+		writeError(resp, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+func (s *APIServer) submitTask(req *restful.Request, resp *restful.Response) {
+	var body SubmitTaskRequest
+	if err := req.ReadEntity(&body); err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+
+	task, err := s.manager.Submit(body.Rules)
+	if err != nil {
+		writeError(resp, http.StatusBadRequest, err)
+		return
+	}
+	created, _ := s.manager.Get(task.ID)
+	writeEntity(resp, http.StatusCreated, created)
+}
+
+func (s *APIServer) listTasks(req *restful.Request, resp *restful.Response) {
+	writeEntity(resp, http.StatusOK, s.manager.List())
+}
+
+func (s *APIServer) getTask(req *restful.Request, resp *restful.Response) {
+	task, ok := s.manager.Get(req.PathParameter("id"))
+	if !ok {
+		writeError(resp, http.StatusNotFound, fmt.Errorf("task %s not found", req.PathParameter("id")))
+		return
+	}
+	writeEntity(resp, http.StatusOK, task)
+}
+
+func (s *APIServer) getTaskPairs(req *restful.Request, resp *restful.Response) {
+	pairs, ok := s.manager.Pairs(req.PathParameter("id"))
+	if !ok {
+		writeError(resp, http.StatusNotFound, fmt.Errorf("task %s not found", req.PathParameter("id")))
+		return
+	}
+	writeEntity(resp, http.StatusOK, pairs)
+}
+
+func (s *APIServer) cancelTask(req *restful.Request, resp *restful.Response) {
+	if err := s.manager.Cancel(req.PathParameter("id")); err != nil {
+		writeError(resp, http.StatusConflict, err)
+		return
+	}
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func (s *APIServer) retryTask(req *restful.Request, resp *restful.Response) {
+	task, err := s.manager.Retry(req.PathParameter("id"))
+	if err != nil {
+		writeError(resp, http.StatusConflict, err)
+		return
+	}
+	created, _ := s.manager.Get(task.ID)
+	writeEntity(resp, http.StatusCreated, created)
+}
+
+func writeEntity(resp *restful.Response, status int, entity interface{}) {
+	if err := resp.WriteHeaderAndEntity(status, entity); err != nil {
+		log.Errorf("write response error: %v", err)
+	}
+}
+
+func writeError(resp *restful.Response, status int, err error) {
+	writeEntity(resp, status, map[string]string{"error": err.Error()})
+}
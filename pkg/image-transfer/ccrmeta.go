@@ -0,0 +1,195 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	tcr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/tcr/v20190924"
+	"tkestack.io/image-transfer/pkg/apis/ccrapis"
+	"tkestack.io/image-transfer/pkg/apis/tcrapis"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/provider"
+)
+
+// max length of the brief description of a tcr repository
+const maxBriefDescriptionLength = 100
+
+// ccrMetadata is the ccr metadata carried over to tcr in ccrToTcr mode
+type ccrMetadata struct {
+	tcrClient *tcrapis.TCRAPIClient
+	tcrID     string
+	// secret and region of the tcr api
+	secretID  string
+	secretKey string
+	region    string
+	// ccr repos by name namespace/repo
+	repos map[string]*tcr.RepoInfo
+	// tcr retention rule converted from the global ccr image lifecycle, key is empty if not set
+	retentionKey   string
+	retentionValue int64
+}
+
+// loadCcrMetadata gets visibility and description of ccr repos and the global image lifecycle,
+// the target should be a tcr instance since the metadata apis are specific to tcr
+func (c *Client) loadCcrMetadata() (*ccrMetadata, error) {
+	target, ok := c.targetProvider.(*provider.TCR)
+	if !ok {
+		return nil, fmt.Errorf("target %s is not a tcr instance", c.targetProvider.Registry())
+	}
+	tcrID, err := target.ID()
+	if err != nil {
+		return nil, err
+	}
+	tcrSecretID, tcrSecretKey, err := tcrapis.GetTcrSecret(c.config.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	ccrClient := ccrapis.NewCCRAPIClient()
+	repos, err := ccrClient.GetAllCcrRepoInfo(c.config.Secret, c.config.FlagConf.Config.CCRRegion)
+	if err != nil {
+		return nil, err
+	}
+	meta := &ccrMetadata{
+		tcrClient: tcrapis.NewTCRAPIClient(),
+		tcrID:     tcrID,
+		secretID:  tcrSecretID,
+		secretKey: tcrSecretKey,
+		region:    c.config.FlagConf.Config.TCRRegion,
+		repos:     make(map[string]*tcr.RepoInfo, len(repos)),
+	}
+	for _, repo := range repos {
+		if repo.RepoName != nil {
+			meta.repos[*repo.RepoName] = repo
+		}
+	}
+
+	secretID, secretKey, err := ccrapis.GetCcrSecret(c.config.Secret)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ccrClient.DescribeImageLifecycleGlobalPersonal(secretID, secretKey, c.config.FlagConf.Config.CCRRegion)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response.Data != nil {
+		for _, strategy := range resp.Response.Data.StrategyInfo {
+			if strategy.Type == nil || strategy.Value == nil || (strategy.Valid != nil && *strategy.Valid == 0) {
+				continue
+			}
+			// types are keep_last_nums and keep_last_days, global ones are prefixed by global_
+			switch {
+			case strings.HasSuffix(*strategy.Type, "keep_last_nums"):
+				meta.retentionKey = "latestPushedK"
+			case strings.HasSuffix(*strategy.Type, "keep_last_days"):
+				meta.retentionKey = "nDaysSinceLastPush"
+			default:
+				log.Warnf("unknown ccr image lifecycle type %s, it is not carried over", *strategy.Type)
+				continue
+			}
+			meta.retentionValue = *strategy.Value
+			break
+		}
+	}
+	return meta, nil
+}
+
+// isNamespacePublic reports whether a ccr namespace is public, ccr sets visibility by repo
+// so the namespace is public only if all of its repos are public
+func (m *ccrMetadata) isNamespacePublic(ns string) bool {
+	found := false
+	for name, repo := range m.repos {
+		if strings.Split(name, "/")[0] != ns {
+			continue
+		}
+		if repo.Public == nil || *repo.Public != 1 {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// applyTcrNamespaceMetadata creates the retention rule of a namespace just created in tcr
+func (c *Client) applyTcrNamespaceMetadata(tcrNs string) {
+	meta := c.ccrMetadata
+	if meta == nil || meta.retentionKey == "" {
+		return
+	}
+	nsID, err := meta.tcrClient.GetNamespaceID(meta.secretID, meta.secretKey, meta.region, meta.tcrID, tcrNs)
+	if err != nil {
+		log.Warnf("get id of tcr namespace %s error, retention rule is not created: %s", tcrNs, err)
+		return
+	}
+	_, err = meta.tcrClient.CreateTagRetentionRule(meta.secretID, meta.secretKey, meta.region, meta.tcrID, nsID,
+		meta.retentionKey, meta.retentionValue)
+	if err != nil {
+		log.Warnf("create retention rule %s=%d of tcr namespace %s error: %s", meta.retentionKey,
+			meta.retentionValue, tcrNs, err)
+		return
+	}
+	log.Infof("create retention rule %s=%d of tcr namespace %s", meta.retentionKey, meta.retentionValue, tcrNs)
+}
+
+// migrateCcrRepoMetadata copies the description of a ccr repo to its tcr repo,
+// the tcr repo is created before its images are pushed if it does not exist
+func (c *Client) migrateCcrRepoMetadata(ccrRepo string) {
+	meta := c.ccrMetadata
+	if meta == nil {
+		return
+	}
+	repo, ok := meta.repos[ccrRepo]
+	if !ok || repo.Description == nil || *repo.Description == "" {
+		return
+	}
+
+	parts := strings.SplitN(c.tcrRepo(ccrRepo), "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+	ns, name := parts[0], parts[1]
+	description := *repo.Description
+	brief := briefDescription(description)
+
+	existing, err := meta.tcrClient.GetRepository(meta.secretID, meta.secretKey, meta.region, meta.tcrID, ns, name)
+	if err != nil {
+		log.Warnf("get tcr repo %s/%s error, description is not carried over: %s", ns, name, err)
+		return
+	}
+	if existing == nil {
+		_, err = meta.tcrClient.CreateRepository(meta.secretID, meta.secretKey, meta.region, meta.tcrID, ns, name, brief, description)
+	} else if existing.Description == nil || *existing.Description != description {
+		_, err = meta.tcrClient.ModifyRepository(meta.secretID, meta.secretKey, meta.region, meta.tcrID, ns, name, brief, description)
+	}
+	if err != nil {
+		log.Warnf("set description of tcr repo %s/%s error: %s", ns, name, err)
+	}
+}
+
+// briefDescription returns the first line of description, truncated to the max length of tcr
+func briefDescription(description string) string {
+	brief := strings.TrimSpace(strings.SplitN(description, "\n", 2)[0])
+	if utf8.RuneCountInString(brief) > maxBriefDescriptionLength {
+		brief = string([]rune(brief)[:maxBriefDescriptionLength])
+	}
+	return brief
+}
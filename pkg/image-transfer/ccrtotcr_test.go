@@ -0,0 +1,115 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis"
+	"tkestack.io/image-transfer/pkg/apis/fakeapi"
+)
+
+// TestCCRToTCRTransfer runs ccrToTcr mode against the fake tencent cloud api, ccr and tcr domains are
+// mirrored to in-process registries
+func TestCCRToTCRTransfer(t *testing.T) {
+	api := fakeapi.NewServer()
+	defer api.Close()
+	if err := apis.SetEndpoint(api.Endpoint()); err != nil {
+		t.Fatalf("set endpoint error: %v", err)
+	}
+	defer apis.SetEndpoint("")
+
+	ccr, tcr := newTestRegistry(t), newTestRegistry(t)
+
+	// more tags and namespaces than a page of the apis
+	var appTags []fakeapi.Tag
+	digests := make(map[string]string)
+	pushTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 105; i++ {
+		tag := fmt.Sprintf("v%d", i)
+		digests["team-a/app:"+tag] = ccr.pushImage("team-a/app", tag, "app "+tag).String()
+		appTags = append(appTags, fakeapi.Tag{Name: tag, Digest: digests["team-a/app:"+tag], PushTime: pushTime})
+	}
+	api.AddCcrRepo(fakeapi.CcrRepo{Name: "team-a/app", Public: true, Description: "app of team a", Tags: appTags})
+	digests["team-b/tool:latest"] = ccr.pushImage("team-b/tool", "latest", "tool").String()
+	api.AddCcrRepo(fakeapi.CcrRepo{Name: "team-b/tool", Tags: []fakeapi.Tag{{Name: "latest", Digest: digests["team-b/tool:latest"]}}})
+	for i := 0; i < 110; i++ {
+		api.AddCcrNamespace(fmt.Sprintf("empty-%03d", i))
+	}
+
+	api.AddInstance("tcr-test", "test", "ap-guangzhou")
+	if err := api.AddNamespace("tcr-test", "team-b", false); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := testDir(t)
+	opts := testOptions(t,
+		"--ccrToTcr",
+		"--ccrRegion", "ap-guangzhou",
+		"--tcrRegion", "ap-guangzhou",
+		"--tcrName", "test",
+		"--ccrTagNums", "200",
+		"--retry", "0",
+		"--secretFile", writeYaml(t, dir, "secret.yaml", map[string]configs.Secret{
+			"ccr": {SecretID: "id", SecretKey: "key"},
+			"tcr": {SecretID: "id", SecretKey: "key"},
+		}),
+		"--securityFile", writeYaml(t, dir, "security.yaml", registrySecurity(ccr, tcr)),
+		"--mirrors-file", writeYaml(t, dir, "mirrors.yaml", map[string]configs.Mirror{
+			"ccr.ccs.tencentyun.com":  {Endpoints: []string{ccr.Host()}, MirrorsOnly: true},
+			"test.tencentcloudcr.com": {Endpoints: []string{tcr.Host()}, MirrorsOnly: true},
+		}),
+	)
+
+	client := newClient(context.Background(), testConfigs(t, opts))
+	if err := client.CCRToTCRTransfer(); err != nil {
+		t.Fatalf("ccrToTcr transfer error: %v", err)
+	}
+	if failed := client.FailedURLPairs(); len(failed) != 0 {
+		t.Fatalf("failed pairs: %v", failed)
+	}
+
+	namespaces := make(map[string]fakeapi.Namespace)
+	for _, ns := range api.Namespaces("tcr-test") {
+		namespaces[ns.Name] = ns
+	}
+	if len(namespaces) != 112 {
+		t.Errorf("expected 112 tcr namespaces, got %d", len(namespaces))
+	}
+	if ns, ok := namespaces["team-a"]; !ok || !ns.Public {
+		t.Errorf("tcr namespace team-a should be created as public, got %+v", ns)
+	}
+	if _, ok := namespaces["empty-109"]; !ok {
+		t.Errorf("tcr namespace empty-109 of the last ccr page is not created")
+	}
+	if repo := api.Repo("tcr-test", "team-a/app"); repo == nil || repo.Description != "app of team a" {
+		t.Errorf("description of team-a/app is not carried over, got %+v", repo)
+	}
+
+	for image, expected := range digests {
+		repo, tag := splitImage(image)
+		if actual := tcr.manifestDigest(repo, tag).String(); actual != expected {
+			t.Errorf("digest of %s in tcr is %q, expected %s", image, actual, expected)
+		}
+	}
+}
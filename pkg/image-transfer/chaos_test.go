@@ -0,0 +1,175 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/network"
+	"tkestack.io/image-transfer/pkg/progress"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// registries are accessed by these names in chaos tests, requests to loopback addresses bypass proxies,
+// so names routed to the registries are needed for containers/image requests to pass the fault injection
+const (
+	chaosSource = "source.chaos.test"
+	chaosTarget = "target.chaos.test"
+)
+
+func TestMain(m *testing.M) {
+	err := network.Configure(network.Config{Hosts: map[string]string{
+		chaosSource: "127.0.0.1",
+		chaosTarget: "127.0.0.1",
+	}})
+	if err != nil {
+		log.Errorf("configure network error: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// chaosHost returns the host of r by name
+func chaosHost(r *testRegistry, name string) string {
+	return name + r.Host()[strings.LastIndex(r.Host(), ":"):]
+}
+
+// TestNormalTransferFaults checks images are transferred in spite of the faults injected into registry
+// requests if there are enough retries
+func TestNormalTransferFaults(t *testing.T) {
+	src, dst := newTestRegistry(t), newTestRegistry(t)
+	source, target := chaosHost(src, chaosSource), chaosHost(dst, chaosTarget)
+	security := map[string]interface{}{
+		source: src.security(),
+		target: dst.security(),
+	}
+
+	for _, tc := range []struct {
+		name  string
+		fault network.Fault
+		args  []string
+		// request timeout of registry operations, none if zero
+		timeout time.Duration
+		failed  bool
+	}{
+		{
+			name:  "drop blob",
+			fault: network.Fault{Host: source, Method: http.MethodGet, Path: "/blobs/", Drop: true, AfterBytes: 10, Times: 1},
+		},
+		{
+			name:  "truncate blob",
+			fault: network.Fault{Host: source, Method: http.MethodGet, Path: "/blobs/", Truncate: true, AfterBytes: 10, Times: 1},
+		},
+		{
+			name:  "server error",
+			fault: network.Fault{Host: target, Method: http.MethodPut, Path: "/manifests/", Status: 500, Times: 1},
+		},
+		{
+			name:  "unauthorized",
+			fault: network.Fault{Host: source, Method: http.MethodGet, Path: "/blobs/", Status: 401, Times: 1},
+		},
+		{
+			name:    "latency",
+			fault:   network.Fault{Host: target, Method: http.MethodPut, Path: "/manifests/", Latency: time.Second, Times: 1},
+			timeout: 200 * time.Millisecond,
+		},
+		{
+			name:   "retries run out",
+			fault:  network.Fault{Host: source, Method: http.MethodGet, Path: "/blobs/", Drop: true},
+			args:   []string{"--retry", "1"},
+			failed: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := "chaos/" + strings.Replace(tc.name, " ", "-", -1)
+			expected := src.pushImage(repo, "v1", tc.name)
+			if err := network.SetFaults([]network.Fault{tc.fault}); err != nil {
+				t.Fatalf("set faults error: %v", err)
+			}
+			defer network.SetFaults(nil)
+			if tc.timeout > 0 {
+				transfer.SetTimeouts(transfer.Timeouts{Request: tc.timeout})
+				defer transfer.SetTimeouts(transfer.Timeouts{})
+			}
+
+			dir := testDir(t)
+			args := append([]string{
+				"--retry", "2",
+				"--ruleFile", writeYaml(t, dir, "rules.yaml", map[string]string{
+					source + "/" + repo + ":v1": target + "/" + repo + ":v1",
+				}),
+				"--securityFile", writeYaml(t, dir, "security.yaml", security),
+			}, tc.args...)
+			cfg := testConfigs(t, testOptions(t, args...))
+			client := newClient(context.Background(), cfg)
+			events := &eventCounter{}
+			client.reporter = events
+			if err := client.NormalTransfer(cfg.ImageList, nil); err != nil {
+				t.Fatalf("transfer error: %v", err)
+			}
+
+			failed := client.FailedURLPairs()
+			actual := dst.manifestDigest(repo, "v1")
+			if tc.failed {
+				if len(failed) != 1 || actual != "" {
+					t.Errorf("transfer should fail, failed pairs: %v, digest in target: %q", failed, actual)
+				}
+				return
+			}
+			if len(failed) != 0 {
+				t.Fatalf("failed pairs: %v", failed)
+			}
+			if actual != expected {
+				t.Errorf("digest in target is %q, expected %s", actual, expected)
+			}
+			if events.count(progress.JobFailed) != 1 || events.count(progress.JobRetried) != 1 {
+				t.Errorf("job should fail once and be retried, failed %d times, retried %d times",
+					events.count(progress.JobFailed), events.count(progress.JobRetried))
+			}
+		})
+	}
+}
+
+// eventCounter counts progress events by type
+type eventCounter struct {
+	mutex  sync.Mutex
+	counts map[progress.EventType]int
+}
+
+func (e *eventCounter) Emit(ev progress.Event) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.counts == nil {
+		e.counts = make(map[progress.EventType]int)
+	}
+	e.counts[ev.Type]++
+}
+
+func (e *eventCounter) count(t progress.EventType) int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.counts[t]
+}
@@ -21,11 +21,20 @@ package imagetransfer
 
 import (
 	"fmt"
+	"tkestack.io/image-transfer/pkg/apis"
 	"tkestack.io/image-transfer/pkg/log"
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/metrics"
+	"tkestack.io/image-transfer/pkg/network"
+	"tkestack.io/image-transfer/pkg/transfer"
 	"github.com/spf13/cobra"
 	flagUtil "tkestack.io/image-transfer/pkg/flag"
 	"os"
+	"strings"
+	"sync"
+
+	// register token providers of cloud registries
+	_ "tkestack.io/image-transfer/pkg/credentials"
 )
 
 
@@ -52,11 +61,106 @@ func run(opts *options.ClientOptions) RunFunc {
 	return func(cmd *cobra.Command, args []string) {
 		log.InitLogger()
 		defer log.FlushLogger()
+		defer transfer.RemoveCertDirs()
 
 		flagUtil.PrintFlags(cmd.Flags())
 
+		if err := configureNetwork(opts.Config); err != nil {
+			log.Errorf("configure network error: %v", err)
+			os.Exit(1)
+		}
+
+		if err := apis.SetEndpoint(opts.Config.TencentCloudAPIEndpoint); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+
+		if opts.Config.MetricsAddr != "" {
+			metrics.Serve(opts.Config.MetricsAddr)
+		}
+
+		transfer.SetTimeouts(transfer.Timeouts{
+			Request:  opts.Config.RequestTimeout,
+			Job:      opts.Config.JobTimeout,
+			BlobIdle: opts.Config.BlobIdleTimeout,
+		})
+
+		transfer.SetChunkSize(opts.Config.BlobChunkSize << 20)
+
+		if opts.Config.SpoolDir != "" {
+			if err := transfer.UseSpool(opts.Config.SpoolDir, opts.Config.SpoolSize<<20); err != nil {
+				log.Errorf("init spool error: %v", err)
+				os.Exit(1)
+			}
+		}
+
+		if opts.Config.BlobCacheFile != "" {
+			transfer.UsePersistentCache(opts.Config.BlobCacheFile)
+		}
+
+		// the first SIGINT or SIGTERM stops the transfer gracefully
+		ctx := signalContext()
+
+		// servers run in background, the command exits when all of them are shut down
+		var servers []func() error
+		var webhookServer *WebhookServer
+		if opts.Config.WebhookAddr != "" {
+			server, err := NewWebhookServer(ctx, opts)
+			if err != nil {
+				log.Errorf("init webhook server error: %v", err)
+				os.Exit(1)
+			}
+			webhookServer = server
+			servers = append(servers, func() error { return server.Run(opts.Config.WebhookAddr) })
+		}
+		if opts.Config.APIAddr != "" {
+			server, err := NewAPIServer(ctx, opts)
+			if err != nil {
+				log.Errorf("init api server error: %v", err)
+				os.Exit(1)
+			}
+			servers = append(servers, func() error { return server.Run(opts.Config.APIAddr) })
+		}
+
+		wg := sync.WaitGroup{}
+		for _, serve := range servers {
+			wg.Add(1)
+			go func(serve func() error) {
+				defer wg.Done()
+				if err := serve(); err != nil {
+					log.Errorf("server exit: %v", err)
+					transfer.RemoveCertDirs()
+					log.FlushLogger()
+					os.Exit(1)
+				}
+			}(serve)
+		}
+
+		if IsWatchMode(opts) {
+			watcher, err := NewWatcher(opts)
+			if err != nil {
+				log.Errorf("init watcher error: %v", err)
+				os.Exit(1)
+			}
+			// the webhook server uses the rules reloaded by each cycle
+			if webhookServer != nil {
+				watcher.OnReload(webhookServer.Reload)
+			}
+			if err := watcher.Run(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				transfer.RemoveCertDirs()
+				os.Exit(1)
+			}
+			wg.Wait()
+			return
+		}
+
+		if len(servers) != 0 {
+			wg.Wait()
+			return
+		}
 
-		client, err := NewTransferClient(opts)
+		client, err := NewTransferClient(ctx, opts)
 		if err != nil {
 			log.Errorf("init Transfer Client error: %v", err)
 			os.Exit(1)
@@ -64,8 +168,42 @@ func run(opts *options.ClientOptions) RunFunc {
 
 		if err := client.Run(); err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
+			transfer.RemoveCertDirs()
 			os.Exit(1)
 		}
 
 	}
 }
+
+// configureNetwork applies the proxy, host, dns and fault flags to registry and api traffic
+func configureNetwork(conf *options.ConfigOptions) error {
+	hosts := map[string]string{}
+	for _, mapping := range conf.Hosts {
+		parts := strings.SplitN(mapping, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid host mapping %s, should be host:ip", mapping)
+		}
+		hosts[parts[0]] = parts[1]
+	}
+	// long running modes reload the security file, routing is enabled before the first request
+	// so that the proxies added to it later apply to image copies too
+	if err := network.Configure(network.Config{
+		Proxy:   conf.Proxy,
+		NoProxy: conf.NoProxy,
+		Hosts:   hosts,
+		DNS:     conf.DNS,
+		Enable:  conf.SyncInterval > 0 || conf.SyncCron != "" || conf.WebhookAddr != "" || conf.APIAddr != "",
+	}); err != nil {
+		return err
+	}
+
+	if conf.FaultFile == "" {
+		return nil
+	}
+	faults, err := network.LoadFaults(conf.FaultFile)
+	if err != nil {
+		return err
+	}
+	log.Warnf("Inject %d faults of %s into registry requests, it is for chaos testing only", len(faults), conf.FaultFile)
+	return network.SetFaults(faults)
+}
@@ -0,0 +1,222 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// runNormalTransfer transfers the rules by a client with args and returns the client
+func runNormalTransfer(t *testing.T, rules map[string]string, registries []*testRegistry, args ...string) *Client {
+	t.Helper()
+	dir := testDir(t)
+	args = append(args,
+		"--ruleFile", writeYaml(t, dir, "rules.yaml", rules),
+		"--securityFile", writeYaml(t, dir, "security.yaml", registrySecurity(registries...)),
+	)
+	cfg := testConfigs(t, testOptions(t, args...))
+	client := newClient(context.Background(), cfg)
+	if err := client.NormalTransfer(cfg.ImageList, nil); err != nil {
+		t.Fatalf("transfer error: %v", err)
+	}
+	return client
+}
+
+// TestNormalTransfer transfers images of all manifest types between registries with auth and tls
+func TestNormalTransfer(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config registryConfig
+	}{
+		{name: "plain http", config: registryConfig{}},
+		{name: "basic auth", config: registryConfig{username: "admin", password: "secret"}},
+		{name: "tls", config: registryConfig{tls: true}},
+		{name: "tls and basic auth", config: registryConfig{username: "admin", password: "secret", tls: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, dst := startTestRegistry(t, tc.config), startTestRegistry(t, tc.config)
+
+			images := map[string]digest.Digest{
+				"library/app:v1":    src.pushImage("library/app", "v1", "app v1"),
+				"library/multi:v1":  src.pushManifestList("library/multi", "v1", "multi v1", false, "amd64", "arm64"),
+				"library/oci:v1":    src.pushOCIImage("library/oci", "v1", "oci v1"),
+				"library/index:v1":  src.pushManifestList("library/index", "v1", "index v1", true, "amd64", "arm64"),
+				"library/legacy:v1": src.pushSchema1Image("library/legacy", "v1", "legacy v1"),
+				// transferred by the rule of the repo without tag
+				"library/all:v1": src.pushImage("library/all", "v1", "all v1"),
+				"library/all:v2": src.pushManifestList("library/all", "v2", "all v2", false, "amd64", "arm64"),
+				// nested repository path
+				"team/sub/app:v1": src.pushImage("team/sub/app", "v1", "nested v1"),
+			}
+			// images referenced by digest, the target reference is the same digest
+			for repo, d := range map[string]digest.Digest{
+				"library/pinned":       src.pushImage("library/pinned", "v1", "pinned v1"),
+				"library/pinned-list":  src.pushManifestList("library/pinned-list", "v1", "pinned list", false, "amd64", "arm64"),
+				"library/pinned-index": src.pushManifestList("library/pinned-index", "v1", "pinned index", true, "amd64", "arm64"),
+				"team/sub/pinned":      src.pushManifestList("team/sub/pinned", "v1", "nested pinned", false, "amd64", "arm64"),
+			} {
+				images[repo+"@"+d.String()] = d
+			}
+			rules := map[string]string{
+				src.Host() + "/library/all": dst.Host() + "/library/all",
+			}
+			for image := range images {
+				if !strings.HasPrefix(image, "library/all:") {
+					rules[src.Host()+"/"+image] = dst.Host() + "/" + image
+				}
+			}
+
+			client := runNormalTransfer(t, rules, []*testRegistry{src, dst})
+			if failed := client.FailedURLPairs(); len(failed) != 0 {
+				t.Fatalf("failed pairs: %v", failed)
+			}
+			for image, expected := range images {
+				repo, tag := splitImage(image)
+				if actual := dst.manifestDigest(repo, tag); actual != expected {
+					t.Errorf("digest of %s in target is %q, expected %s", image, actual, expected)
+				}
+			}
+		})
+	}
+}
+
+// TestNormalTransferTagExist checks tags existing in target are skipped unless TagExistOverridden is set,
+// and tags of the same digest are always skipped
+func TestNormalTransferTagExist(t *testing.T) {
+	src, dst := newTestRegistry(t), newTestRegistry(t)
+	v1 := src.pushImage("library/app", "v1", "app v1")
+	v2 := src.pushImage("library/app", "v2", "app v2")
+	old := dst.pushImage("library/app", "v1", "old app v1")
+	dst.pushImage("library/app", "v2", "app v2")
+	rules := map[string]string{src.Host() + "/library/app": dst.Host() + "/library/app"}
+
+	runNormalTransfer(t, rules, []*testRegistry{src, dst}, "--tag-exist-overridden=false")
+	if actual := dst.manifestDigest("library/app", "v1"); actual != old {
+		t.Errorf("existing tag v1 should be skipped, digest is %s, expected %s", actual, old)
+	}
+	if count := dst.countRequests(http.MethodPut, "/manifests/"); count != 0 {
+		t.Errorf("no manifest should be pushed, %d pushed", count)
+	}
+
+	runNormalTransfer(t, rules, []*testRegistry{src, dst}, "--tag-exist-overridden=true")
+	if actual := dst.manifestDigest("library/app", "v1"); actual != v1 {
+		t.Errorf("existing tag v1 should be overridden, digest is %s, expected %s", actual, v1)
+	}
+	if actual := dst.manifestDigest("library/app", "v2"); actual != v2 {
+		t.Errorf("digest of v2 is %s, expected %s", actual, v2)
+	}
+	if count := dst.countRequests(http.MethodPut, "/manifests/v2"); count != 0 {
+		t.Errorf("tag v2 of the same digest should be skipped, pushed %d times", count)
+	}
+}
+
+// TestNormalTransferTagSelector checks tags of a repository without tags in rules are selected by
+// the created time of their image configs, tags without created time are kept by the time filters
+func TestNormalTransferTagSelector(t *testing.T) {
+	src := newTestRegistry(t)
+	now := time.Now()
+	digests := map[string]digest.Digest{
+		"old":     src.pushCreatedImage("library/app", "old", "app old", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		"mid":     src.pushCreatedImage("library/app", "mid", "app mid", now.AddDate(0, 0, -60)),
+		"new":     src.pushCreatedImage("library/app", "new", "app new", now.AddDate(0, 0, -1)),
+		"unknown": src.pushImage("library/app", "unknown", "app unknown"),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		selected []string
+	}{
+		{name: "no selector", selected: []string{"old", "mid", "new", "unknown"}},
+		{name: "pushed within days", args: []string{"--tags-pushed-within-days", "30"}, selected: []string{"new", "unknown"}},
+		{name: "pushed after date", args: []string{"--tags-pushed-after", "2021-01-01"}, selected: []string{"mid", "new", "unknown"}},
+		{name: "keep latest", args: []string{"--tags-keep-latest", "2"}, selected: []string{"mid", "new"}},
+		{
+			name:     "pushed after date and keep latest",
+			args:     []string{"--tags-pushed-after", "2021-01-01", "--tags-keep-latest", "1"},
+			selected: []string{"new"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := newTestRegistry(t)
+			rules := map[string]string{src.Host() + "/library/app": dst.Host() + "/library/app"}
+			runNormalTransfer(t, rules, []*testRegistry{src, dst}, tc.args...)
+
+			selected := make(map[string]bool)
+			for _, tag := range tc.selected {
+				selected[tag] = true
+			}
+			for tag, expected := range digests {
+				actual := dst.manifestDigest("library/app", tag)
+				if selected[tag] && actual != expected {
+					t.Errorf("tag %s should be transferred, digest is %q, expected %s", tag, actual, expected)
+				}
+				if !selected[tag] && actual != "" {
+					t.Errorf("tag %s should not be transferred", tag)
+				}
+			}
+		})
+	}
+}
+
+// TestNormalTransferRetry checks failed jobs are retried, and kept in the failed list if retries run out
+func TestNormalTransferRetry(t *testing.T) {
+	src, dst := newTestRegistry(t), newTestRegistry(t)
+	expected := src.pushImage("library/app", "v1", "app v1")
+	rules := map[string]string{src.Host() + "/library/app:v1": dst.Host() + "/library/app:v1"}
+
+	src.injectFault(http.MethodGet, "/library/app/blobs/", http.StatusInternalServerError, 1)
+	dst.injectFault(http.MethodPut, "/library/app/manifests/", http.StatusServiceUnavailable, 1)
+	client := runNormalTransfer(t, rules, []*testRegistry{src, dst}, "--retry", "2")
+	if failed := client.FailedURLPairs(); len(failed) != 0 {
+		t.Fatalf("failed pairs: %v", failed)
+	}
+	if src.pendingFaults() != 0 || dst.pendingFaults() != 0 {
+		t.Errorf("injected faults should all happen")
+	}
+	if actual := dst.manifestDigest("library/app", "v1"); actual != expected {
+		t.Errorf("digest in target is %q, expected %s", actual, expected)
+	}
+
+	src.pushImage("library/app", "v2", "app v2")
+	rules = map[string]string{src.Host() + "/library/app:v2": dst.Host() + "/library/app:v2"}
+	src.injectFault(http.MethodGet, "/library/app/blobs/", http.StatusInternalServerError, 3)
+	client = runNormalTransfer(t, rules, []*testRegistry{src, dst}, "--retry", "2")
+	if failed := client.FailedURLPairs(); len(failed) != 1 {
+		t.Errorf("job should fail after 2 retries, failed pairs: %v", failed)
+	}
+	if actual := dst.manifestDigest("library/app", "v2"); actual != "" {
+		t.Errorf("failed image should not be in target, digest is %s", actual)
+	}
+}
+
+// splitImage splits repo:tag or repo@digest
+func splitImage(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[:i], image[i+1:]
+	}
+	i := strings.LastIndex(image, ":")
+	return image[:i], image[i+1:]
+}
@@ -19,6 +19,8 @@
 package options
 
 import (
+	"time"
+
 	"github.com/spf13/pflag"
 )
 
@@ -37,8 +39,65 @@ type ConfigOptions struct {
 	TCRRegion        string
 	TCRName          string
 	SecretFile       string
+	// namespaces and repositories selected in ccrToTcr mode, and ccr to tcr namespace renames
+	CCRNamespaces        []string
+	CCRExcludeNamespaces []string
+	CCRRepos             []string
+	CCRExcludeRepos      []string
+	CCRNamespaceMap      map[string]string
+	// carry over namespace visibility, repo descriptions and tag retention in ccrToTcr mode
+	CCRMetadata bool
+	// tcrToTcr mode: transfer source tcr instance to the tcr instance of TCRName
+	TCRToTCR        bool
+	SourceTCRName   string
+	SourceTCRRegion string
 	// if target tag is exist override it
 	TagExistOverridden bool
+	// select source tags of repositories without tags in rules by push time, all tags if zero
+	TagsPushedWithinDays int
+	TagsPushedAfter      string
+	TagsKeepLatest       int
+	// progress output mode: auto, tty, plain or none
+	Progress         string
+	ProgressInterval time.Duration
+	// listen address of prometheus metrics server, disabled if empty
+	MetricsAddr string
+	// watch mode: rerun transfer on an interval or a cron schedule
+	SyncInterval time.Duration
+	SyncCron     string
+	// bolt db file to persist blob info cache between runs
+	BlobCacheFile string
+	// listen address of webhook server for registry push events, disabled if empty
+	WebhookAddr  string
+	WebhookToken string
+	// listen address of the task api server, disabled if empty, and the token required by it
+	APIAddr  string
+	APIToken string
+	// time to wait for jobs in flight after the transfer is cancelled
+	GracePeriod time.Duration
+	// timeouts of registry api calls, a whole job and a stalled blob copy, zero means no limit
+	RequestTimeout  time.Duration
+	JobTimeout      time.Duration
+	BlobIdleTimeout time.Duration
+	// blobs larger than it are uploaded in resumable chunks, in MiB
+	BlobChunkSize int64
+	// local directory to download blobs into before uploading, blobs are streamed if empty
+	SpoolDir string
+	// max total size of blobs in spool dir, in MiB
+	SpoolSize int64
+	// docker config.json or containers auth.json to look up credentials not in security file
+	AuthFile string
+	// default proxy of registries and tencent cloud api, hosts excluded from it, host overrides and dns server
+	Proxy   string
+	NoProxy string
+	Hosts   []string
+	DNS     string
+	// yaml file mapping logical registry names to mirror endpoints
+	MirrorsFile string
+	// endpoint of tencent cloud tcr api, the official one if empty
+	TencentCloudAPIEndpoint string
+	// yaml file of faults injected into registry requests for chaos testing, hidden from help
+	FaultFile string
 }
 
 // NewConfigOptions creates a NewConfigOptions object with default
@@ -73,7 +132,7 @@ func (o *ConfigOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.IntVar(&o.RetryNums, "retry", 2,
 		"number of retries, default value is 2")
 	fs.IntVar(&o.CCRTagNums, "ccrTagNums", 100,
-		"number of ccr recent tags for every repo, default value is 100, set 0 to sync all tag")
+		"number of ccr most recently pushed tags for every repo, default value is 100, set 0 to sync all tag")
 	fs.IntVar(&o.QPS, "qps", 100,
 		"QPS of request, default value is 100, max is 30000")
 	fs.BoolVar(&o.CCRToTCR, "ccrToTcr", false,
@@ -86,5 +145,99 @@ func (o *ConfigOptions) AddFlags(fs *pflag.FlagSet) {
 		"tcr name. this flag is used when flag ccrToTcr=true")
 	fs.StringVar(&o.SecretFile, "secretFile", o.SecretFile,
 		"Tencent Cloud secretId 、secretKey for access ccr and tcr. this flag is used when flag ccrToTcr=true")
+	fs.StringSliceVar(&o.CCRNamespaces, "ccrNamespaces", o.CCRNamespaces,
+		"ccr namespaces or glob patterns to transfer in ccrToTcr mode, e.g. team-*. all namespaces if empty")
+	fs.StringSliceVar(&o.CCRExcludeNamespaces, "ccrExcludeNamespaces", o.CCRExcludeNamespaces,
+		"ccr namespaces or glob patterns not to transfer in ccrToTcr mode")
+	fs.StringSliceVar(&o.CCRRepos, "ccrRepos", o.CCRRepos,
+		"ccr repositories or glob patterns like namespace/repo to transfer in ccrToTcr mode, "+
+			"e.g. team-a/*. all repositories of the selected namespaces if empty")
+	fs.StringSliceVar(&o.CCRExcludeRepos, "ccrExcludeRepos", o.CCRExcludeRepos,
+		"ccr repositories or glob patterns like namespace/repo not to transfer in ccrToTcr mode")
+	fs.StringToStringVar(&o.CCRNamespaceMap, "ccrNamespaceMap", o.CCRNamespaceMap,
+		"rename ccr namespaces in tcr in ccrToTcr mode, e.g. team-a=prod-team-a,team-b=prod-team-b")
+	fs.BoolVar(&o.TCRToTCR, "tcrToTcr", false,
+		"mode: transfer all namespaces, repositories and tags of the tcr instance --sourceTcrName "+
+			"to the tcr instance --tcrName, default value is false")
+	fs.StringVar(&o.SourceTCRName, "sourceTcrName", o.SourceTCRName,
+		"source tcr name. this flag is used when flag tcrToTcr=true")
+	fs.StringVar(&o.SourceTCRRegion, "sourceTcrRegion", o.SourceTCRRegion,
+		"source tcr region, the same as --tcrRegion if empty. this flag is used when flag tcrToTcr=true")
+	fs.BoolVar(&o.CCRMetadata, "ccrMetadata", true,
+		"carry over namespace visibility, repository descriptions and the global tag retention policy "+
+			"from ccr to tcr in ccrToTcr mode, only images are transferred if false")
 	fs.BoolVar(&o.TagExistOverridden, "tag-exist-overridden", true, "if target tag is exist, override it")
+	fs.IntVar(&o.TagsPushedWithinDays, "tags-pushed-within-days", 0,
+		"only transfer tags pushed within the last days for repositories without tags in rules, 0 means no limit. "+
+			"push time of generic registries is the created time of image config")
+	fs.StringVar(&o.TagsPushedAfter, "tags-pushed-after", o.TagsPushedAfter,
+		"only transfer tags pushed after the date like 2006-01-02 or 2006-01-02T15:04:05+08:00 "+
+			"for repositories without tags in rules")
+	fs.IntVar(&o.TagsKeepLatest, "tags-keep-latest", 0,
+		"only transfer the most recently pushed tags for repositories without tags in rules, 0 means no limit")
+	fs.StringVar(&o.Progress, "progress", "auto",
+		"progress output mode: auto, tty, plain or none. auto renders a live view if stderr is a terminal, "+
+			"otherwise logs summary lines")
+	fs.DurationVar(&o.ProgressInterval, "progress-interval", 10*time.Second,
+		"interval of progress summary lines when progress mode is plain")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", o.MetricsAddr,
+		"listen address of the prometheus metrics endpoint, e.g. :9090, metrics server is disabled if empty")
+	fs.DurationVar(&o.SyncInterval, "sync-interval", 0,
+		"watch mode: rerun the transfer every interval, e.g. 30m. rule and security files are reloaded on change")
+	fs.StringVar(&o.SyncCron, "sync-cron", o.SyncCron,
+		"watch mode: rerun the transfer on a cron schedule, e.g. \"0 */2 * * *\". should not be set with --sync-interval")
+	fs.StringVar(&o.BlobCacheFile, "blob-cache-file", o.BlobCacheFile,
+		"bolt db file to persist known blob locations between runs, blob info is cached in memory if empty")
+	fs.StringVar(&o.WebhookAddr, "webhook-addr", o.WebhookAddr,
+		"listen address of the webhook server receiving push events from harbor, tcr and docker registry, e.g. :8080")
+	fs.StringVar(&o.WebhookToken, "webhook-token", o.WebhookToken,
+		"token expected in the Authorization: Bearer header of webhook requests, "+
+			"required unless --webhook-addr is a loopback address like 127.0.0.1:8080")
+	fs.StringVar(&o.APIAddr, "api-addr", o.APIAddr,
+		"listen address of the REST API server to submit and inspect transfer tasks, e.g. :8081. "+
+			"rule file is not required in this mode, rules are submitted by API")
+	fs.StringVar(&o.APIToken, "api-token", o.APIToken,
+		"token expected in the Authorization: Bearer header of API requests, "+
+			"required unless --api-addr is a loopback address like 127.0.0.1:8081")
+	fs.DurationVar(&o.GracePeriod, "grace-period", 30*time.Second,
+		"time to wait for the jobs in flight after SIGINT or SIGTERM, the jobs are aborted after it. "+
+			"a second signal exits immediately")
+	fs.DurationVar(&o.RequestTimeout, "request-timeout", time.Minute,
+		"timeout of a manifest, tag or blob existence request to registry, 0 means no limit")
+	fs.DurationVar(&o.JobTimeout, "job-timeout", 0,
+		"timeout of transferring an image tag including all its blobs, 0 means no limit. "+
+			"a timed out job is retried like other failures")
+	fs.DurationVar(&o.BlobIdleTimeout, "blob-idle-timeout", 2*time.Minute,
+		"abort a blob copy if no data flows for this long and retry it later, 0 disables the watchdog")
+	fs.Int64Var(&o.BlobChunkSize, "blob-chunk-size", 0,
+		"size in MiB of upload chunks, blobs larger than it are uploaded in chunks and resumed from the last "+
+			"acknowledged chunk on failure. 0 uploads every blob in one stream")
+	fs.StringVar(&o.SpoolDir, "spool-dir", o.SpoolDir,
+		"local directory to download and verify blobs into before uploading them, for unreliable source connections. "+
+			"blobs are streamed from source to target if empty")
+	fs.Int64Var(&o.SpoolSize, "spool-size", 10240,
+		"max total size in MiB of blobs kept in spool dir, the least recently used blobs are evicted first")
+	fs.StringVar(&o.AuthFile, "auth-file", o.AuthFile,
+		"docker config.json or auth.json to look up credentials of registries not in security file, "+
+			"credHelpers and credsStore are supported. default locations of docker and podman are used if empty")
+	fs.StringVar(&o.Proxy, "proxy", o.Proxy,
+		"default http, https or socks5 proxy url of registries and tencent cloud api, e.g. socks5://10.0.0.2:1080. "+
+			"HTTPS_PROXY and HTTP_PROXY environment values are used if empty. "+
+			"proxy of a registry can be set in security file")
+	fs.StringVar(&o.NoProxy, "no-proxy", o.NoProxy,
+		"comma separated hosts, domains and cidrs not using the default proxy, NO_PROXY environment value is used if empty")
+	fs.StringSliceVar(&o.Hosts, "add-host", o.Hosts,
+		"custom host to ip mapping like host:ip, can be repeated")
+	fs.StringVar(&o.DNS, "dns", o.DNS,
+		"dns server to resolve registry and api hosts, e.g. 10.0.0.53, the system resolver is used if empty")
+	fs.StringVar(&o.MirrorsFile, "mirrors-file", o.MirrorsFile,
+		"yaml file mapping registry names in rules to mirror endpoints which are tried in order, "+
+			"for both source and target registries")
+	fs.StringVar(&o.TencentCloudAPIEndpoint, "tencentcloud-api-endpoint", o.TencentCloudAPIEndpoint,
+		"endpoint of tencent cloud tcr api used by ccrToTcr and tcrToTcr mode, like tcr.internal.tencentcloudapi.com "+
+			"or http://127.0.0.1:8080, default value is tcr.tencentcloudapi.com")
+	fs.StringVar(&o.FaultFile, "fault-file", o.FaultFile,
+		"yaml file of faults injected into plain http registry requests, for chaos testing only")
+	// nolint: errcheck
+	fs.MarkHidden("fault-file")
 }
@@ -0,0 +1,109 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/apis/ccrapis"
+	"tkestack.io/image-transfer/pkg/apis/tcrapis"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/provider"
+)
+
+// initCloudProviders creates the source and target providers of ccrToTcr and tcrToTcr mode
+// by the secret file, providers set before are kept
+func (c *Client) initCloudProviders() error {
+	conf := c.config.FlagConf.Config
+	if c.targetProvider == nil {
+		secretID, secretKey, err := tcrapis.GetTcrSecret(c.config.Secret)
+		if err != nil {
+			log.Errorf("GetTcrSecret error: %s", err)
+			return err
+		}
+		c.targetProvider = provider.NewTCR(conf.TCRName, "", conf.TCRRegion, secretID, secretKey)
+	}
+	if c.sourceProvider != nil {
+		return nil
+	}
+
+	if conf.TCRToTCR {
+		secretID, secretKey, err := tcrapis.GetSourceTcrSecret(c.config.Secret)
+		if err != nil {
+			log.Errorf("GetSourceTcrSecret error: %s", err)
+			return err
+		}
+		c.sourceProvider = provider.NewTCR(conf.SourceTCRName, "", c.sourceTcrRegion(), secretID, secretKey)
+		return nil
+	}
+	secretID, secretKey, err := ccrapis.GetCcrSecret(c.config.Secret)
+	if err != nil {
+		log.Errorf("GetCcrSecret error: %s", err)
+		return err
+	}
+	c.sourceProvider = provider.NewCCR(secretID, secretKey, conf.CCRRegion)
+	return nil
+}
+
+// checkNamespaceQuota warns if count namespaces to be created exceed the namespace quota of the target
+func (c *Client) checkNamespaceQuota(count int) {
+	if count == 0 {
+		return
+	}
+	quota, err := c.targetProvider.GetQuota(c.ctx)
+	if err != nil {
+		log.Warnf("get quota of %s error: %s", c.targetProvider.Registry(), err)
+		return
+	}
+	if quota.NamespaceLimit == provider.Unknown || quota.NamespaceCount == provider.Unknown {
+		return
+	}
+	if left := quota.NamespaceLimit - quota.NamespaceCount; int64(count) > left {
+		log.Warnf("%d namespaces are to be created in %s but only %d are left in quota %d",
+			count, c.targetProvider.Registry(), left, quota.NamespaceLimit)
+	}
+}
+
+// listRepositories lists the repositories under namespace of a logical registry on the first endpoint
+// which answers, all repositories are listed if namespace is empty. Names contain their namespace
+func (c *Client) listRepositories(registry, namespace string) ([]string, error) {
+	endpoints := c.config.GetEndpoints(registry, strings.Split(namespace, "/")[0])
+	var lastErr error
+	for _, endpoint := range endpoints {
+		p, err := c.newProvider(c.ctx, endpoint.Registry, endpoint.Security)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		repos, err := p.ListRepositories(c.ctx, namespace)
+		if err != nil {
+			if len(endpoints) > 1 {
+				log.Warnf("List repositories of %s on endpoint %s error: %v", registry, endpoint.Registry, err)
+			}
+			lastErr = err
+			continue
+		}
+		return repos, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no endpoints of %s", registry)
+	}
+	return nil, lastErr
+}
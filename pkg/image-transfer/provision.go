@@ -0,0 +1,76 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"sync"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/provisioner"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// provisionedNamespace serializes the creation of a namespace
+type provisionedNamespace struct {
+	mutex sync.Mutex
+	// exist is set once the namespace is created or found
+	exist bool
+}
+
+// ensureTargetNamespace creates the namespace of a target url by the namespace provisioner of its registry,
+// a namespace is provisioned once by a client. Nothing is done if no provisioner is configured
+func (c *Client) ensureTargetNamespace(url *utils.RepoURL, security configs.Security) error {
+	if security.NamespaceProvisioner == nil || url.GetNamespace() == "" {
+		return nil
+	}
+
+	key := url.GetRegistry() + "/" + url.GetNamespace()
+	c.provisionedMutex.Lock()
+	ns, ok := c.provisioned[key]
+	if !ok {
+		ns = &provisionedNamespace{}
+		c.provisioned[key] = ns
+	}
+	c.provisionedMutex.Unlock()
+
+	// serialized, so a namespace is not created by several jobs at the same time,
+	// jobs of other namespaces are not blocked
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if ns.exist {
+		return nil
+	}
+
+	p, err := provisioner.New(url.GetRegistry(), security, c.config.Secret)
+	if err != nil {
+		return err
+	}
+	ctx := c.ctx
+	if timeout := c.config.FlagConf.Config.RequestTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(c.ctx, timeout)
+		defer cancel()
+	}
+	if err := p.EnsureNamespace(ctx, url.GetNamespace()); err != nil {
+		return err
+	}
+	ns.exist = true
+	return nil
+}
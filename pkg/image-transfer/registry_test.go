@@ -0,0 +1,512 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/manifest/schema1"
+	// registers the htpasswd access controller
+	_ "github.com/docker/distribution/registry/auth/htpasswd"
+	"github.com/docker/distribution/registry/handlers"
+	// registers the inmemory storage driver
+	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/libtrust"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+)
+
+const (
+	schema2MediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	schema2ListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	schema1MediaType     = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+)
+
+// harnessHeader marks the requests of the test harness itself
+const harnessHeader = "X-Test-Harness"
+
+// registryConfig configures a test registry
+type registryConfig struct {
+	// username and password enable htpasswd basic auth
+	username string
+	password string
+	// tls serves https with the certificate of httptest
+	tls bool
+}
+
+// fault makes the next times requests whose method and path match fail with status
+type fault struct {
+	method string
+	path   string
+	status int
+	times  int
+}
+
+// testRegistry is an in-process docker distribution registry with in memory storage, it records
+// requests and injects faults
+type testRegistry struct {
+	*httptest.Server
+	t      *testing.T
+	config registryConfig
+	caFile string
+
+	mutex    sync.Mutex
+	requests []string
+	faults   []*fault
+}
+
+// newTestRegistry starts a plain http registry without auth, it is closed when the test finishes
+func newTestRegistry(t *testing.T) *testRegistry {
+	return startTestRegistry(t, registryConfig{})
+}
+
+// startTestRegistry starts a registry of config, it is closed when the test finishes
+func startTestRegistry(t *testing.T, config registryConfig) *testRegistry {
+	t.Helper()
+	conf := &configuration.Configuration{}
+	conf.Storage = configuration.Storage{"inmemory": configuration.Parameters{}}
+	conf.Log.AccessLog.Disabled = true
+	// the registry logs every request by logrus, failed ones are logged by image-transfer anyway
+	logrus.SetOutput(ioutil.Discard)
+	conf.Compatibility.Schema1.Enabled = true
+	if config.username != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(config.password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("hash password error: %v", err)
+		}
+		path := filepath.Join(testDir(t), "htpasswd")
+		if err := ioutil.WriteFile(path, []byte(config.username+":"+string(hash)+"\n"), 0600); err != nil {
+			t.Fatalf("write htpasswd error: %v", err)
+		}
+		conf.Auth = configuration.Auth{"htpasswd": configuration.Parameters{"realm": "test", "path": path}}
+	}
+	app := handlers.NewApp(context.Background(), conf)
+
+	r := &testRegistry{t: t, config: config}
+	if config.tls {
+		r.Server = httptest.NewTLSServer(r.handler(app))
+		r.caFile = filepath.Join(testDir(t), "ca.crt")
+		cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.Certificate().Raw})
+		if err := ioutil.WriteFile(r.caFile, cert, 0600); err != nil {
+			t.Fatalf("write ca file error: %v", err)
+		}
+	} else {
+		r.Server = httptest.NewServer(r.handler(app))
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+// handler records requests and fails them by the injected faults before they are served by app
+func (r *testRegistry) handler(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(harnessHeader) != "" {
+			app.ServeHTTP(w, req)
+			return
+		}
+		r.mutex.Lock()
+		r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+		status := 0
+		for _, f := range r.faults {
+			if f.times > 0 && f.method == req.Method && strings.Contains(req.URL.Path, f.path) {
+				f.times--
+				status = f.status
+				break
+			}
+		}
+		r.mutex.Unlock()
+
+		if status != 0 {
+			http.Error(w, "injected fault", status)
+			return
+		}
+		app.ServeHTTP(w, req)
+	})
+}
+
+// injectFault makes the next times requests of method whose path contains path fail with status
+func (r *testRegistry) injectFault(method, path string, status, times int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.faults = append(r.faults, &fault{method: method, path: path, status: status, times: times})
+}
+
+// pendingFaults returns the number of injected faults not happened yet
+func (r *testRegistry) pendingFaults() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	pending := 0
+	for _, f := range r.faults {
+		pending += f.times
+	}
+	return pending
+}
+
+// countRequests returns the number of requests of method whose path contains path
+func (r *testRegistry) countRequests(method, path string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	count := 0
+	for _, request := range r.requests {
+		if strings.HasPrefix(request, method+" ") && strings.Contains(request, path) {
+			count++
+		}
+	}
+	return count
+}
+
+// Host returns host:port of the registry
+func (r *testRegistry) Host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.URL, "http://"), "https://")
+}
+
+// security returns the security settings of the registry used by image-transfer
+func (r *testRegistry) security() configs.Security {
+	return configs.Security{
+		Username:  r.config.username,
+		Password:  r.config.password,
+		PlainHTTP: !r.config.tls,
+		CAFile:    r.caFile,
+	}
+}
+
+// pushBlob uploads content as a blob of repo and returns its digest
+func (r *testRegistry) pushBlob(repo string, content []byte) digest.Digest {
+	r.t.Helper()
+	resp := r.do(http.MethodPost, r.URL+"/v2/"+repo+"/blobs/uploads/", "", nil, http.StatusAccepted)
+
+	dgst := digest.FromBytes(content)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		r.t.Fatalf("upload location of %s error: %v", repo, err)
+	}
+	query := location.Query()
+	query.Set("digest", dgst.String())
+	location.RawQuery = query.Encode()
+	r.do(http.MethodPut, r.URL+location.RequestURI(), "application/octet-stream", content, http.StatusCreated)
+	return dgst
+}
+
+// pushManifest puts manifest to repo with reference and returns its digest
+func (r *testRegistry) pushManifest(repo, reference, mediaType string, manifest []byte) digest.Digest {
+	r.t.Helper()
+	resp := r.do(http.MethodPut, r.URL+"/v2/"+repo+"/manifests/"+reference, mediaType, manifest, http.StatusCreated)
+	return digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+}
+
+// pushImage pushes a single layer linux/amd64 schema2 image whose layer contains content, it returns
+// the manifest digest
+func (r *testRegistry) pushImage(repo, tag, content string) digest.Digest {
+	r.t.Helper()
+	return r.pushCreatedImage(repo, tag, content, time.Time{})
+}
+
+// pushCreatedImage pushes a single layer linux/amd64 schema2 image created at created, the config
+// has no created time if it is zero
+func (r *testRegistry) pushCreatedImage(repo, tag, content string, created time.Time) digest.Digest {
+	r.t.Helper()
+	manifest := r.pushImageBlobs(repo, content, "amd64", false, created)
+	return r.pushManifest(repo, tag, schema2MediaType, manifest)
+}
+
+// pushOCIImage pushes a single layer linux/amd64 oci image
+func (r *testRegistry) pushOCIImage(repo, tag, content string) digest.Digest {
+	r.t.Helper()
+	manifest := r.pushImageBlobs(repo, content, "amd64", true, time.Time{})
+	return r.pushManifest(repo, tag, ociManifestMediaType, manifest)
+}
+
+// pushManifestList pushes a schema2 image of each architecture and a manifest list of them, it returns the
+// digest of the manifest list. An oci image index of oci images is pushed instead if oci is set
+func (r *testRegistry) pushManifestList(repo, tag, content string, oci bool, archs ...string) digest.Digest {
+	r.t.Helper()
+	listType, manifestType := schema2ListMediaType, schema2MediaType
+	if oci {
+		listType, manifestType = ociIndexMediaType, ociManifestMediaType
+	}
+
+	var manifests []map[string]interface{}
+	for _, arch := range archs {
+		manifest := r.pushImageBlobs(repo, content+" "+arch, arch, oci, time.Time{})
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType": manifestType,
+			"size":      len(manifest),
+			"digest":    r.pushManifest(repo, digest.FromBytes(manifest).String(), manifestType, manifest),
+			"platform":  map[string]string{"architecture": arch, "os": "linux"},
+		})
+	}
+	list, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     listType,
+		"manifests":     manifests,
+	})
+	if err != nil {
+		r.t.Fatalf("marshal manifest list error: %v", err)
+	}
+	return r.pushManifest(repo, tag, listType, list)
+}
+
+// pushSchema1Image pushes a signed schema1 image, its digest is the digest of the manifest without signatures
+func (r *testRegistry) pushSchema1Image(repo, tag, content string) digest.Digest {
+	r.t.Helper()
+	layer, _ := testLayer(r.t, content)
+	id := digest.FromString(content).Hex()
+	m := schema1.Manifest{
+		Versioned:    schema1.SchemaVersion,
+		Name:         repo,
+		Tag:          tag,
+		Architecture: "amd64",
+		FSLayers:     []schema1.FSLayer{{BlobSum: r.pushBlob(repo, layer)}},
+		History: []schema1.History{{
+			V1Compatibility: `{"id":"` + id + `","architecture":"amd64","os":"linux","config":{}}`,
+		}},
+	}
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		r.t.Fatalf("generate signing key error: %v", err)
+	}
+	signed, err := schema1.Sign(&m, key)
+	if err != nil {
+		r.t.Fatalf("sign schema1 manifest error: %v", err)
+	}
+	manifest, err := signed.MarshalJSON()
+	if err != nil {
+		r.t.Fatalf("marshal schema1 manifest error: %v", err)
+	}
+	return r.pushManifest(repo, tag, schema1MediaType, manifest)
+}
+
+// pushImageBlobs pushes the layer and config of an image and returns its schema2 or oci manifest,
+// the config has no created time if created is zero
+func (r *testRegistry) pushImageBlobs(repo, content, arch string, oci bool, created time.Time) []byte {
+	r.t.Helper()
+	manifestType := schema2MediaType
+	configType := "application/vnd.docker.container.image.v1+json"
+	layerType := "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	if oci {
+		manifestType = ociManifestMediaType
+		configType = "application/vnd.oci.image.config.v1+json"
+		layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	}
+
+	layer, diffID := testLayer(r.t, content)
+	image := map[string]interface{}{
+		"architecture": arch,
+		"os":           "linux",
+		"config":       map[string]interface{}{},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{diffID.String()}},
+	}
+	if !created.IsZero() {
+		image["created"] = created
+	}
+	config, err := json.Marshal(image)
+	if err != nil {
+		r.t.Fatalf("marshal image config error: %v", err)
+	}
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestType,
+		"config": map[string]interface{}{
+			"mediaType": configType,
+			"size":      len(config),
+			"digest":    r.pushBlob(repo, config),
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType": layerType,
+			"size":      len(layer),
+			"digest":    r.pushBlob(repo, layer),
+		}},
+	})
+	if err != nil {
+		r.t.Fatalf("marshal manifest error: %v", err)
+	}
+	return manifest
+}
+
+// manifestDigest returns the digest of the manifest of repo:reference, empty if it does not exist
+func (r *testRegistry) manifestDigest(repo, reference string) digest.Digest {
+	r.t.Helper()
+	req, err := http.NewRequest(http.MethodHead, r.URL+"/v2/"+repo+"/manifests/"+reference, nil)
+	if err != nil {
+		r.t.Fatalf("new request error: %v", err)
+	}
+	req.Header.Set("Accept", strings.Join([]string{schema2MediaType, schema2ListMediaType,
+		ociManifestMediaType, ociIndexMediaType, schema1MediaType}, ", "))
+	resp := r.send(req)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ""
+	}
+	if resp.StatusCode != http.StatusOK {
+		r.t.Fatalf("head manifest %s:%s: unexpected status %d", repo, reference, resp.StatusCode)
+	}
+	return digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+}
+
+func (r *testRegistry) do(method, url, contentType string, body []byte, expected int) *http.Response {
+	r.t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		r.t.Fatalf("new request error: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp := r.send(req)
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		r.t.Fatalf("%s %s: unexpected status %d: %s", method, url, resp.StatusCode, msg)
+	}
+	return resp
+}
+
+// send sends req with the credentials of the registry, it is neither recorded nor failed by faults
+func (r *testRegistry) send(req *http.Request) *http.Response {
+	r.t.Helper()
+	if r.config.username != "" {
+		req.SetBasicAuth(r.config.username, r.config.password)
+	}
+	req.Header.Set(harnessHeader, "true")
+	resp, err := r.Client().Do(req)
+	if err != nil {
+		r.t.Fatalf("%s %s error: %v", req.Method, req.URL, err)
+	}
+	return resp
+}
+
+// testLayer returns a gzipped tar layer with a file of content and the digest of the uncompressed tar
+func testLayer(t *testing.T, content string) ([]byte, digest.Digest) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "content", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatalf("write tar error: %v", err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatalf("write tar error: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("write tar error: %v", err)
+	}
+	diffID := digest.FromBytes(buf.Bytes())
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(buf.Bytes()); err != nil {
+		t.Fatalf("gzip layer error: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip layer error: %v", err)
+	}
+	return gz.Bytes(), diffID
+}
+
+// testOptions parses args like the command line, defaults of options are set by their flags
+func testOptions(t *testing.T, args ...string) *options.ClientOptions {
+	t.Helper()
+	opts := options.NewClientOptions()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	opts.AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("parse flags %v error: %v", args, err)
+	}
+	return opts
+}
+
+// testDir creates a temporary directory removed when the test finishes
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "image-transfer-test")
+	if err != nil {
+		t.Fatalf("create temporary directory error: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeYaml writes value to a yaml file in dir and returns its path
+func writeYaml(t *testing.T, dir, name string, value interface{}) string {
+	t.Helper()
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		t.Fatalf("marshal %s error: %v", name, err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write %s error: %v", name, err)
+	}
+	return path
+}
+
+// testConfigs builds the configs of a client like InitConfigs without checking the flags of modes
+func testConfigs(t *testing.T, opts *options.ClientOptions) *configs.Configs {
+	t.Helper()
+	c := &configs.Configs{FlagConf: opts}
+	var err error
+	if opts.Config.SecretFile != "" {
+		if c.Secret, err = c.GetSecret(); err != nil {
+			t.Fatalf("get secret error: %v", err)
+		}
+	}
+	if c.Security, err = c.GetSecurity(); err != nil {
+		t.Fatalf("get security error: %v", err)
+	}
+	if opts.Config.RuleFile != "" {
+		c.ImageList = c.GetImageList()
+	}
+	if c.Mirrors, err = c.GetMirrors(); err != nil {
+		t.Fatalf("get mirrors error: %v", err)
+	}
+	return c
+}
+
+// registrySecurity returns the security file content of registries
+func registrySecurity(registries ...*testRegistry) map[string]configs.Security {
+	security := make(map[string]configs.Security)
+	for _, r := range registries {
+		security[r.Host()] = r.security()
+	}
+	return security
+}
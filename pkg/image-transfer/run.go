@@ -20,16 +20,18 @@ package imagetransfer
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
 	"tkestack.io/image-transfer/configs"
-	"tkestack.io/image-transfer/pkg/apis/ccrapis"
-	"tkestack.io/image-transfer/pkg/apis/tcrapis"
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/metrics"
+	"tkestack.io/image-transfer/pkg/progress"
+	"tkestack.io/image-transfer/pkg/provider"
 	"tkestack.io/image-transfer/pkg/transfer"
 	"tkestack.io/image-transfer/pkg/utils"
 )
@@ -51,8 +53,28 @@ type Client struct {
 
 	config *configs.Configs
 
+	// progress counts events of pipeline stages and jobs
+	progress *progress.Tracker
+	// reporter receives the same events as progress, may be nil
+	reporter progress.Reporter
+	// ctx is cancelled to stop handling the remaining pairs and jobs, it is used by
+	// the discovery of namespaces, repositories and tags and other cloud api calls
+	ctx    context.Context
+	cancel context.CancelFunc
+	// jobCtx is used by the image copies of jobs, it is cancelled after the grace
+	// period of ctx cancellation to abort the jobs in flight
+	jobCtx context.Context
+	abort  context.CancelFunc
+
 	//finished generate ccrToTcr urlPair
 	urlPairFinished bool
+	// ccr metadata carried over to tcr in ccrToTcr mode, nil if disabled
+	ccrMetadata *ccrMetadata
+	// source and target registries of ccrToTcr and tcrToTcr mode, created from the secret file if not set
+	sourceProvider provider.RegistryProvider
+	targetProvider provider.RegistryProvider
+	// newProvider creates the provider of a registry to discover the repositories of wildcard rules
+	newProvider func(ctx context.Context, registry string, security configs.Security) (provider.RegistryProvider, error)
 	// mutex
 	jobListMutex                    sync.Mutex
 	urlPairListMutex                sync.Mutex
@@ -61,6 +83,10 @@ type Client struct {
 	failedJobGenerateListMutex      sync.Mutex
 	failedGenNormalURLPairListMutex sync.Mutex
 	urlPairFinishedMutex            sync.Mutex
+
+	// namespaces of target registries provisioned, by registry/namespace
+	provisioned      map[string]*provisionedNamespace
+	provisionedMutex sync.Mutex
 }
 
 // URLPair is a pair of source and target url
@@ -72,36 +98,60 @@ type URLPair struct {
 // Run is main function of a transfer client
 func (c *Client) Run() error {
 
+	if _, err := c.tagSelector(); err != nil {
+		return fmt.Errorf("tag selector error: %v", err)
+	}
+
 	if c.config.FlagConf.Config.CCRToTCR {
 		return c.CCRToTCRTransfer()
 	}
 
-	return c.NormalTransfer(c.config.ImageList, nil, nil, nil)
+	if c.config.FlagConf.Config.TCRToTCR {
+		return c.TCRToTCRTransfer()
+	}
+
+	return c.NormalTransfer(c.config.ImageList, nil)
 
 }
 
 //CCRToTCRTransfer transfer ccr to tcr
 func (c *Client) CCRToTCRTransfer() error {
 
-	ccrClient := ccrapis.NewCCRAPIClient()
-	ccrNs, err := ccrClient.GetAllNamespaceByName(c.config.Secret, c.config.FlagConf.Config.CCRRegion)
-	log.Debugf("ccr namespaces is %s", ccrNs)
+	if err := c.ccrNamespaceFilter().Validate(); err != nil {
+		return fmt.Errorf("ccr namespace filter error: %v", err)
+	}
+	if err := c.ccrRepoFilter().Validate(); err != nil {
+		return fmt.Errorf("ccr repo filter error: %v", err)
+	}
+
+	if err := c.initCloudProviders(); err != nil {
+		return err
+	}
+
+	ccrNs, err := c.sourceProvider.ListNamespaces(c.ctx)
 	if err != nil {
 		log.Errorf("Get ccr ns returned error: %s", err)
 		return err
 	}
+	log.Debugf("ccr namespaces is %s", provider.NamespaceNames(ccrNs))
+	selectedNs := c.selectCcrNamespaces(provider.NamespaceNames(ccrNs))
 
-	tcrClient := tcrapis.NewTCRAPIClient()
-	tcrNs, tcrID, err := tcrClient.GetAllNamespaceByName(c.config.Secret,
-		c.config.FlagConf.Config.TCRRegion, c.config.FlagConf.Config.TCRName)
-	log.Debugf("tcr namespaces is %s", tcrNs)
+	tcrNs, err := c.targetProvider.ListNamespaces(c.ctx)
 	if err != nil {
 		log.Errorf("Get tcr ns returned error: %s", err)
 		return err
 	}
+	log.Debugf("tcr namespaces is %s", provider.NamespaceNames(tcrNs))
+
+	if c.config.FlagConf.Config.CCRMetadata {
+		c.ccrMetadata, err = c.loadCcrMetadata()
+		if err != nil {
+			log.Warnf("Get ccr metadata error, only images are transferred: %s", err)
+		}
+	}
 
 	//create ccr ns in tcr
-	failedNsList, err := c.CreateTcrNs(tcrClient, ccrNs, tcrNs, c.config.Secret, c.config.FlagConf.Config.TCRRegion, tcrID)
+	failedNsList, err := c.CreateTcrNs(selectedNs, provider.NamespaceNames(tcrNs))
 	if err != nil {
 		log.Errorf("CreateTcrNs error: %s", err)
 		return err
@@ -111,8 +161,7 @@ func (c *Client) CCRToTCRTransfer() error {
 	if len(failedNsList) != 0 {
 		log.Infof("some ccr namespace create failed in tcr, retry Create Tcr Ns.")
 		for times := 0; times < c.config.FlagConf.Config.RetryNums && len(failedNsList) != 0; times++ {
-			tmpFailedNsList, err := c.RetryCreateTcrNs(tcrClient, failedNsList,
-				c.config.Secret, c.config.FlagConf.Config.TCRRegion)
+			tmpFailedNsList, err := c.RetryCreateTcrNs(failedNsList)
 			if err != nil {
 				continue
 			} else {
@@ -126,68 +175,114 @@ func (c *Client) CCRToTCRTransfer() error {
 	}
 
 	//generate transfer rules
-	repoChan, err := c.GenerateCcrToTcrRules(failedNsList, ccrClient, c.config.Secret, c.config.FlagConf.Config.CCRRegion,
-		c.config.FlagConf.Config.TCRRegion, c.config.FlagConf.Config.TCRName)
+	repoChan, err := c.GenerateRepoRules(failedNsList)
 	if err != nil {
 		return err
 	}
 
-	return c.NormalTransfer(nil, ccrClient, tcrClient, repoChan)
+	return c.NormalTransfer(nil, repoChan)
 
 }
 
-//GenerateCcrToTcrRules generate rules of ccr transfer to tcr
-func (c *Client) GenerateCcrToTcrRules(failedNsList []string, ccrClient *ccrapis.CCRAPIClient,
-	secret map[string]configs.Secret, ccrRegion string, tcrRegion string, tcrName string) (chan string, error) {
-
-	secretID, secretKey, err := ccrapis.GetCcrSecret(secret)
-	if err != nil {
-		log.Errorf("GetCcrSecret error: %s", err)
-		return nil, err
+// ccrNamespaceFilter returns the filter of ccr namespaces to transfer
+func (c *Client) ccrNamespaceFilter() utils.NameFilter {
+	return utils.NameFilter{
+		Include: c.config.FlagConf.Config.CCRNamespaces,
+		Exclude: c.config.FlagConf.Config.CCRExcludeNamespaces,
 	}
-	resp, err := ccrClient.DescribeRepositoryOwnerPersonal(secretID, secretKey, ccrRegion, 0, 1)
-	if err != nil {
-		log.Errorf("get ccr repo count error, %s", err)
-		return nil, fmt.Errorf("get ccr repo count error %s", err)
+}
+
+// ccrRepoFilter returns the filter of ccr repositories to transfer, repositories are named namespace/repo
+func (c *Client) ccrRepoFilter() utils.NameFilter {
+	return utils.NameFilter{
+		Include: c.config.FlagConf.Config.CCRRepos,
+		Exclude: c.config.FlagConf.Config.CCRExcludeRepos,
 	}
-	totalRepo := *resp.Response.Data.TotalCount
-	log.Debugf("total repo is %d", totalRepo)
-	repoChan := make(chan string, totalRepo)
-	err = ccrClient.GetAllCcrRepo(secret, ccrRegion, failedNsList, tcrRegion, tcrName, repoChan, totalRepo)
-	if err != nil {
-		log.Errorf("get ccr repo to tcr rules failed: %s", err)
-		return nil, err
+}
+
+// tagSelector returns the selector of source tags of repositories without tags in rules
+func (c *Client) tagSelector() (provider.TagSelector, error) {
+	conf := c.config.FlagConf.Config
+	return provider.NewTagSelector(conf.TagsPushedWithinDays, conf.TagsPushedAfter, conf.TagsKeepLatest)
+}
+
+// selectCcrNamespaces returns the namespaces selected by the ccr namespace filter
+func (c *Client) selectCcrNamespaces(ccrNs []string) []string {
+	filter := c.ccrNamespaceFilter()
+	var selected []string
+	for _, ns := range ccrNs {
+		if filter.Match(ns) {
+			selected = append(selected, ns)
+		} else {
+			log.Infof("skip ccr namespace %s", ns)
+		}
 	}
+	return selected
+}
 
-	return repoChan, nil
+// isCcrRepoSelected checks a ccr repo namespace/repo by both the namespace and the repo filters
+func (c *Client) isCcrRepoSelected(ccrRepo string) bool {
+	ns := strings.Split(ccrRepo, "/")[0]
+	return c.ccrNamespaceFilter().Match(ns) && c.ccrRepoFilter().Match(ccrRepo)
+}
 
+// tcrNamespace returns the tcr namespace a ccr namespace is transferred to
+func (c *Client) tcrNamespace(ccrNs string) string {
+	if ns, ok := c.config.FlagConf.Config.CCRNamespaceMap[ccrNs]; ok && ns != "" {
+		return ns
+	}
+	return ccrNs
 }
 
-//RetryCreateTcrNs retry to create tcr namespaces
-func (c *Client) RetryCreateTcrNs(tcrClient *tcrapis.TCRAPIClient, retryList []string,
-	secret map[string]configs.Secret, region string) ([]string, error) {
-	var failedList []string
+// tcrRepo returns the tcr repo namespace/repo a ccr repo is transferred to
+func (c *Client) tcrRepo(ccrRepo string) string {
+	parts := strings.SplitN(ccrRepo, "/", 2)
+	if len(parts) != 2 {
+		return ccrRepo
+	}
+	return c.tcrNamespace(parts[0]) + "/" + parts[1]
+}
 
-	secretID, secretKey, err := tcrapis.GetTcrSecret(secret)
+// GenerateRepoRules lists the repos namespace/repo of the source registry of ccrToTcr and tcrToTcr mode,
+// the repos of failed namespaces are skipped
+func (c *Client) GenerateRepoRules(failedNsList []string) (chan string, error) {
+	repos, err := c.sourceProvider.ListRepositories(c.ctx, "")
 	if err != nil {
-		log.Errorf("GetTcrSecret error: %s", err)
-		return failedList, err
+		log.Errorf("get repos of %s error: %s", c.sourceProvider.Registry(), err)
+		return nil, err
 	}
+	log.Debugf("total repo is %d", len(repos))
 
-	tcrNs, tcrID, err := tcrClient.GetAllNamespaceByName(c.config.Secret,
-		c.config.FlagConf.Config.TCRRegion, c.config.FlagConf.Config.TCRName)
-	log.Debugf("tcr namespaces is %s", tcrNs)
+	repoChan := make(chan string, len(repos))
+	for _, repo := range repos {
+		ns := strings.Split(repo, "/")[0]
+		if !utils.IsContain(failedNsList, ns) {
+			repoChan <- repo
+		}
+	}
+	close(repoChan)
+	return repoChan, nil
+}
+
+//RetryCreateTcrNs retry to create tcr namespaces
+func (c *Client) RetryCreateTcrNs(retryList []string) ([]string, error) {
+	tcrNs, err := c.targetProvider.ListNamespaces(c.ctx)
 	if err != nil {
-		log.Errorf("retry create tcr ns, get tcr ns error: ", err)
+		log.Errorf("retry create tcr ns, get tcr ns error: %s", err)
 		return nil, err
 	}
+	log.Debugf("tcr namespaces is %s", provider.NamespaceNames(tcrNs))
 
+	var failedList []string
 	for _, ns := range retryList {
-		if !utils.IsContain(tcrNs, ns) {
-			_, err := tcrClient.CreateNamespace(secretID, secretKey, region, tcrID, ns)
+		if !utils.IsContain(provider.NamespaceNames(tcrNs), c.tcrNamespace(ns)) {
+			err := c.targetProvider.CreateNamespace(c.ctx, c.tcrNamespace(ns),
+				c.ccrMetadata != nil && c.ccrMetadata.isNamespacePublic(ns))
 			if err != nil {
-				log.Errorf("tcr CreateNamespace %s error: %s", ns, err)
+				log.Errorf("tcr CreateNamespace %s error: %s", c.tcrNamespace(ns), err)
 				failedList = append(failedList, ns)
+			} else {
+				c.applyTcrNamespaceMetadata(c.tcrNamespace(ns))
 			}
 		}
 	}
@@ -197,26 +292,27 @@ func (c *Client) RetryCreateTcrNs(tcrClient *tcrapis.TCRAPIClient, retryList []s
 }
 
 //CreateTcrNs create tcr namespaces
-func (c *Client) CreateTcrNs(tcrClient *tcrapis.TCRAPIClient, ccrNs, tcrNs []string,
-	secret map[string]configs.Secret, region string, tcrID string) ([]string, error) {
-
-	var failedList []string
-
-	secretID, secretKey, err := tcrapis.GetTcrSecret(secret)
-
-	if err != nil {
-		log.Errorf("GetTcrSecret error: %s", err)
-		return failedList, err
+func (c *Client) CreateTcrNs(ccrNs, tcrNs []string) ([]string, error) {
+	var missing []string
+	for _, ns := range ccrNs {
+		if !utils.IsContain(tcrNs, c.tcrNamespace(ns)) {
+			missing = append(missing, ns)
+		}
 	}
+	c.checkNamespaceQuota(len(missing))
 
-	for _, ns := range ccrNs {
-		if !utils.IsContain(tcrNs, ns) {
-			log.Infof("create namespace %s", ns)
-			_, err := tcrClient.CreateNamespace(secretID, secretKey, region, tcrID, ns)
-			if err != nil {
-				log.Errorf("tcr CreateNamespace %s error:  %s", ns, err)
-				failedList = append(failedList, ns)
-			}
+	var failedList []string
+	// failed namespaces are kept by ccr name, they are renamed again when retried
+	for _, ns := range missing {
+		target := c.tcrNamespace(ns)
+		log.Infof("create namespace %s for ccr namespace %s", target, ns)
+		err := c.targetProvider.CreateNamespace(c.ctx, target,
+			c.ccrMetadata != nil && c.ccrMetadata.isNamespacePublic(ns))
+		if err != nil {
+			log.Errorf("tcr CreateNamespace %s error:  %s", target, err)
+			failedList = append(failedList, ns)
+		} else {
+			c.applyTcrNamespaceMetadata(target)
 		}
 	}
 
@@ -225,11 +321,27 @@ func (c *Client) CreateTcrNs(tcrClient *tcrapis.TCRAPIClient, ccrNs, tcrNs []str
 }
 
 //NormalTransfer is the normal mode of transfer
-func (c *Client) NormalTransfer(imageList map[string]string, ccrClient *ccrapis.CCRAPIClient, tcrClient *tcrapis.TCRAPIClient, repoChan chan string) error {
+func (c *Client) NormalTransfer(imageList map[string]string, repoChan chan string) error {
 	jobListChan := make(chan *transfer.Job, c.config.FlagConf.Config.RoutineNums)
 	fmt.Println("Start to handle transfer jobs, please wait ...")
 	wg := sync.WaitGroup{}
 
+	printer, err := progress.NewPrinter(c.progress, c.config.FlagConf.Config.Progress,
+		c.config.FlagConf.Config.ProgressInterval)
+	if err != nil {
+		return err
+	}
+	if printer != nil {
+		printer.Start()
+	}
+
+	stopQueueMetrics := make(chan struct{})
+	defer close(stopQueueMetrics)
+	go c.reportQueueLength(jobListChan, stopQueueMetrics)
+
+	transferDone := make(chan struct{})
+	go c.abortAfterGracePeriod(transferDone)
+
 	// generate goroutines to handle transfer jobs
 	wg.Add(1)
 	go func() {
@@ -245,10 +357,27 @@ func (c *Client) NormalTransfer(imageList map[string]string, ccrClient *ccrapis.
 			c.HandleCcrToTCrTags(repoChan)
 			c.SetURLPairFinished()
 		}()
+	} else if c.config.FlagConf.Config.TCRToTCR {
+		// tcrToTcr progress is (source tcr api)repo --> repochan --> NormalPairList --> jobListChan
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.HandleTcrToTcrTags(repoChan)
+			c.SetURLPairFinished()
+		}()
 	} else {
 		// Normal progress is urlPairList --> NormalPairList --> jobListChan
 		for source, target := range imageList {
-			c.urlPairList.PushBack(&URLPair{
+			if utils.IsWildcardURL(source) {
+				// repositories are listed here before url pairs are handled, it blocks until the
+				// listing is finished, a failed rule is expanded again by the retries
+				if err := c.expandWildcardRule(source, target); err != nil {
+					log.Errorf("Expand rule %s to %s error: %v", source, target, err)
+					c.PutAFailedGenNormalURLPair(&URLPair{source: source, target: target})
+				}
+				continue
+			}
+			c.PutURLPair(&URLPair{
 				source: source,
 				target: target,
 			})
@@ -270,10 +399,23 @@ func (c *Client) NormalTransfer(imageList map[string]string, ccrClient *ccrapis.
 
 	log.Infof("Start to retry failed jobs...")
 
-	for times := 0; times < c.config.FlagConf.Config.RetryNums; times++ {
+	for times := 0; times < c.config.FlagConf.Config.RetryNums && !c.IsCancelled(); times++ {
 		log.Debugf("failedjobList len %d, failedGenNormalURLPairList len %d, failedJobGenerateList len %d", c.failedJobList.Len(), c.failedGenNormalURLPairList.Len(), c.failedJobGenerateList.Len())
 		c.Retry()
 	}
+	// jobs in flight of the retries are aborted after the grace period too
+	close(transferDone)
+
+	// the failed jobs are not run again
+	c.failedJobListMutex.Lock()
+	for e := c.failedJobList.Front(); e != nil; e = e.Next() {
+		e.Value.(*transfer.Job).Close()
+	}
+	c.failedJobListMutex.Unlock()
+
+	if printer != nil {
+		printer.Stop()
+	}
 
 	if c.failedJobList.Len() != 0 {
 		log.Infof("################# %v failed transfer jobs: #################", c.failedJobList.Len())
@@ -303,6 +445,9 @@ func (c *Client) NormalTransfer(imageList map[string]string, ccrClient *ccrapis.
 	log.Infof("################# Finished, %v transfer jobs failed, %v normal urlPair generate failed, %v jobs generate failed #################",
 		c.failedJobList.Len(), c.failedGenNormalURLPairList.Len(), c.failedJobGenerateList.Len())
 
+	if c.IsCancelled() {
+		return fmt.Errorf("transfer is cancelled: %v", c.ctx.Err())
+	}
 	return nil
 
 }
@@ -320,16 +465,20 @@ func (c *Client) Retry() {
 		c.jobsHandler(retryJobListChan)
 	}()
 
-	if c.failedJobList.Len() != 0 {
-		failedJobListChan := make(chan *transfer.Job, c.failedJobList.Len())
-		for {
-			failedJob := c.failedJobList.Front()
-			if failedJob == nil {
-				break
-			}
-			log.Infof("put failed job to failedJobListChan %s/%s:%s %s/%s:%s", failedJob.Value.(*transfer.Job).Source.GetRegistry(), failedJob.Value.(*transfer.Job).Source.GetRepository(), failedJob.Value.(*transfer.Job).Source.GetTag(), failedJob.Value.(*transfer.Job).Target.GetRegistry(), failedJob.Value.(*transfer.Job).Target.GetRepository(), failedJob.Value.(*transfer.Job).Target.GetTag())
-			failedJobListChan <- failedJob.Value.(*transfer.Job)
-			c.failedJobList.Remove(failedJob)
+	c.failedJobListMutex.Lock()
+	var failedJobs []*transfer.Job
+	for e := c.failedJobList.Front(); e != nil; e = e.Next() {
+		failedJobs = append(failedJobs, e.Value.(*transfer.Job))
+	}
+	c.failedJobList.Init()
+	c.failedJobListMutex.Unlock()
+
+	if len(failedJobs) != 0 {
+		failedJobListChan := make(chan *transfer.Job, len(failedJobs))
+		for _, failedJob := range failedJobs {
+			log.Infof("put failed job to failedJobListChan %s/%s:%s %s/%s:%s", failedJob.Source.GetRegistry(), failedJob.Source.GetRepository(), failedJob.Source.GetTag(), failedJob.Target.GetRegistry(), failedJob.Target.GetRepository(), failedJob.Target.GetTag())
+			failedJob.Emit(progress.JobRetried)
+			failedJobListChan <- failedJob
 		}
 		close(failedJobListChan)
 		wg1.Add(1)
@@ -339,20 +488,34 @@ func (c *Client) Retry() {
 		}()
 	}
 
-	if c.failedGenNormalURLPairList.Len() != 0 || c.failedJobGenerateList.Len() != 0 {
-		if c.failedGenNormalURLPairList.Len() != 0 {
-			c.urlPairList.PushBackList(c.failedGenNormalURLPairList)
-			c.failedGenNormalURLPairList.Init()
-			if !c.config.FlagConf.Config.CCRToTCR {
+	// failed lists are moved under the locks of both lists, they are read by FailedURLPairs concurrently
+	c.urlPairListMutex.Lock()
+	c.failedGenNormalURLPairListMutex.Lock()
+	failedURLPairs := c.failedGenNormalURLPairList.Len()
+	c.urlPairList.PushBackList(c.failedGenNormalURLPairList)
+	c.failedGenNormalURLPairList.Init()
+	c.failedGenNormalURLPairListMutex.Unlock()
+	c.urlPairListMutex.Unlock()
+
+	c.normalURLPairListMutex.Lock()
+	c.failedJobGenerateListMutex.Lock()
+	failedJobGenerates := c.failedJobGenerateList.Len()
+	c.normalURLPairList.PushBackList(c.failedJobGenerateList)
+	c.failedJobGenerateList.Init()
+	c.failedJobGenerateListMutex.Unlock()
+	c.normalURLPairListMutex.Unlock()
+
+	if failedURLPairs != 0 || failedJobGenerates != 0 {
+		if failedURLPairs != 0 {
+			metrics.RetriesTotal.WithLabelValues("url_pair").Add(float64(failedURLPairs))
+			if !c.config.FlagConf.Config.CCRToTCR && !c.config.FlagConf.Config.TCRToTCR {
 				c.HandleURLPair()
 			} else {
 				c.CcrtoTcrGenTagRetry()
 			}
 		}
-
-		if c.failedJobGenerateList.Len() != 0 {
-			c.normalURLPairList.PushBackList(c.failedJobGenerateList)
-			c.failedJobGenerateList.Init()
+		if failedJobGenerates != 0 {
+			metrics.RetriesTotal.WithLabelValues("generate_job").Add(float64(failedJobGenerates))
 		}
 		c.rulesHandler(retryJobListChan)
 	} else {
@@ -362,8 +525,8 @@ func (c *Client) Retry() {
 	wg1.Wait()
 }
 
-// NewTransferClient creates a transfer client
-func NewTransferClient(opts *options.ClientOptions) (*Client, error) {
+// NewTransferClient creates a transfer client, the transfer is cancelled when ctx is done
+func NewTransferClient(ctx context.Context, opts *options.ClientOptions) (*Client, error) {
 
 	clientConfig, err := configs.InitConfigs(opts)
 
@@ -371,7 +534,11 @@ func NewTransferClient(opts *options.ClientOptions) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{
+	return newClient(ctx, clientConfig), nil
+}
+
+func newClient(ctx context.Context, clientConfig *configs.Configs) *Client {
+	c := &Client{
 		jobList:                         list.New(),
 		urlPairList:                     list.New(),
 		failedJobList:                   list.New(),
@@ -379,13 +546,86 @@ func NewTransferClient(opts *options.ClientOptions) (*Client, error) {
 		normalURLPairList:               list.New(),
 		failedGenNormalURLPairList:      list.New(),
 		config:                          clientConfig,
+		progress:                        progress.NewTracker(),
 		jobListMutex:                    sync.Mutex{},
 		urlPairListMutex:                sync.Mutex{},
 		failedJobListMutex:              sync.Mutex{},
 		failedJobGenerateListMutex:      sync.Mutex{},
 		urlPairFinishedMutex:            sync.Mutex{},
 		failedGenNormalURLPairListMutex: sync.Mutex{},
-	}, nil
+		provisioned:                     make(map[string]*provisionedNamespace),
+		newProvider:                     provider.New,
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	// jobCtx is not derived from ctx, jobs in flight may finish in the grace period
+	c.jobCtx, c.abort = context.WithCancel(context.Background())
+	return c
+}
+
+// withConfig returns a client of config sharing the contexts and progress of c,
+// its jobs are cancelled and aborted with the jobs of c
+func (c *Client) withConfig(config *configs.Configs) *Client {
+	client := newClient(c.ctx, config)
+	client.jobCtx, client.abort = c.jobCtx, c.abort
+	client.progress, client.reporter = c.progress, c.reporter
+	return client
+}
+
+// Cancel stops generating new jobs, jobs not started yet are put to failed list
+func (c *Client) Cancel() {
+	c.cancel()
+}
+
+// IsCancelled returns true if Cancel is called or the context of the client is done
+func (c *Client) IsCancelled() bool {
+	return c.ctx.Err() != nil
+}
+
+// abortAfterGracePeriod aborts the jobs in flight if they are not finished in the grace
+// period after the client is cancelled, it returns when done is closed
+func (c *Client) abortAfterGracePeriod(done chan struct{}) {
+	select {
+	case <-c.ctx.Done():
+	case <-done:
+		return
+	}
+
+	grace := c.config.FlagConf.Config.GracePeriod
+	log.Warnf("Transfer is cancelled, wait at most %s for the jobs in flight", grace)
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		log.Warnf("Grace period is over, abort the jobs in flight")
+		c.abort()
+	case <-done:
+	}
+}
+
+// FailedURLPairs returns source and target urls of the failed jobs and pairs
+func (c *Client) FailedURLPairs() map[string]string {
+	pairs := make(map[string]string)
+
+	c.failedJobListMutex.Lock()
+	for e := c.failedJobList.Front(); e != nil; e = e.Next() {
+		job := e.Value.(*transfer.Job)
+		pairs[job.String()] = utils.JoinReference(job.Target.GetRegistry()+"/"+job.Target.GetRepository(), job.Target.GetTag())
+	}
+	c.failedJobListMutex.Unlock()
+
+	c.failedGenNormalURLPairListMutex.Lock()
+	for e := c.failedGenNormalURLPairList.Front(); e != nil; e = e.Next() {
+		pairs[e.Value.(*URLPair).source] = e.Value.(*URLPair).target
+	}
+	c.failedGenNormalURLPairListMutex.Unlock()
+
+	c.failedJobGenerateListMutex.Lock()
+	for e := c.failedJobGenerateList.Front(); e != nil; e = e.Next() {
+		pairs[e.Value.(*URLPair).source] = e.Value.(*URLPair).target
+	}
+	c.failedJobGenerateListMutex.Unlock()
+
+	return pairs
 }
 
 func (c *Client) rulesHandler(jobListChan chan *transfer.Job) {
@@ -401,7 +641,7 @@ func (c *Client) rulesHandler(jobListChan chan *transfer.Job) {
 		go func() {
 			defer wg.Done()
 			defer log.Debugf("exit rule handler main loop")
-			for {
+			for !c.IsCancelled() {
 				urlPair, empty := c.GetNormalURLPair()
 				// no more job to generate
 				if empty && c.IsURLPairFinished() {
@@ -424,6 +664,16 @@ func (c *Client) rulesHandler(jobListChan chan *transfer.Job) {
 		}()
 	}
 	wg.Wait()
+
+	if c.IsCancelled() {
+		// keep the pairs not handled as failed, so they can be transferred again
+		c.normalURLPairListMutex.Lock()
+		c.failedJobGenerateListMutex.Lock()
+		c.failedJobGenerateList.PushBackList(c.normalURLPairList)
+		c.normalURLPairList.Init()
+		c.failedJobGenerateListMutex.Unlock()
+		c.normalURLPairListMutex.Unlock()
+	}
 }
 
 func (c *Client) jobsHandler(jobListChan chan *transfer.Job) {
@@ -439,10 +689,19 @@ func (c *Client) jobsHandler(jobListChan chan *transfer.Job) {
 				if !ok {
 					break
 				}
+				if c.IsCancelled() {
+					log.Infof("transfer is cancelled, skip job %s", job)
+					c.PutAFailedJob(job)
+					continue
+				}
+				job.Emit(progress.JobStarted)
 				if err := job.Run(); err != nil {
 					log.Errorf("handle job failed %s/%s:%s, %s", job.Source.GetRegistry(), job.Source.GetRepository(), job.Source.GetTag(), err)
+					job.Emit(progress.JobFailed)
 					c.PutAFailedJob(job)
+					continue
 				}
+				job.Emit(progress.JobSucceeded)
 			}
 		}()
 	}
@@ -451,6 +710,29 @@ func (c *Client) jobsHandler(jobListChan chan *transfer.Job) {
 
 }
 
+// reportQueueLength samples the length of pipeline queues until stopCh is closed
+func (c *Client) reportQueueLength(jobListChan chan *transfer.Job, stopCh chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		c.urlPairListMutex.Lock()
+		metrics.SetQueueLength("url_pair", c.urlPairList.Len())
+		c.urlPairListMutex.Unlock()
+
+		c.normalURLPairListMutex.Lock()
+		metrics.SetQueueLength("normal_url_pair", c.normalURLPairList.Len())
+		c.normalURLPairListMutex.Unlock()
+
+		metrics.SetQueueLength("job", len(jobListChan))
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
 // GetURLPair gets a URLPair from urlPairList
 func (c *Client) GetURLPair() (*URLPair, bool) {
 	c.urlPairListMutex.Lock()
@@ -495,6 +777,18 @@ func (c *Client) PutNormalURLPair(urlPair *URLPair) {
 	c.normalURLPairListMutex.Lock()
 	defer c.normalURLPairListMutex.Unlock()
 	c.normalURLPairList.PushBack(urlPair)
+
+	ev := progress.Event{Type: progress.PairDiscovered, Job: urlPair.source, Target: urlPair.target}
+	if sourceURL, err := utils.NewRepoURL(urlPair.source); err == nil {
+		ev.Job = sourceURL.GetURL()
+	}
+	if targetURL, err := utils.NewRepoURL(urlPair.target); err == nil {
+		ev.Target = targetURL.GetURL()
+	}
+	c.progress.Emit(ev)
+	if c.reporter != nil {
+		c.reporter.Emit(ev)
+	}
 }
 
 // GetJob return a transfer.Job struct if the job list is not empty
@@ -545,12 +839,12 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 		return fmt.Errorf("url %s format error: %v", target, err)
 	}
 
-	// if tag is not specific
-	if sourceURL.GetTag() == "" {
+	// if tag or digest is not specific
+	if sourceURL.GetReference() == "" {
 		return fmt.Errorf("source tag empty, source: %s", sourceURL.GetURL())
 	}
 
-	if targetURL.GetTag() == "" {
+	if targetURL.GetReference() == "" {
 		return fmt.Errorf("target tag empty, target: %s", targetURL.GetURL())
 	}
 
@@ -572,17 +866,35 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 		log.Infof("Cannot find auth information for %v, push actions will be anonymous", targetURL.GetURL())
 	}
 
-	imageSource, err = transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(), sourceURL.GetTag(), sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
+	if err := c.ensureTargetNamespace(targetURL, targetSecurity); err != nil {
+		return fmt.Errorf("provision namespace of %s error: %v", targetURL.GetURL(), err)
+	}
+
+	imageSource, err = c.newImageSource(sourceURL, sourceURL.GetReference())
 	if err != nil {
 		return fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
 	}
 
-	imageTarget, err = transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), targetURL.GetTag(), targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+	imageTarget, err = c.newImageTarget(targetURL, targetURL.GetReference())
 	if err != nil {
 		return fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 	}
 
-	jobListChan <- transfer.NewJob(imageSource, imageTarget)
+	job := transfer.NewJob(imageSource, imageTarget)
+	reporters := progress.Multi{c.progress, &metrics.Reporter{
+		SourceRegistry: sourceURL.GetRegistry(),
+		TargetRegistry: targetURL.GetRegistry(),
+	}}
+	if c.reporter != nil {
+		reporters = append(reporters, c.reporter)
+	}
+	job.Progress = reporters
+	job.Emit(progress.JobQueued)
+	select {
+	case jobListChan <- job:
+	case <-c.ctx.Done():
+		return fmt.Errorf("transfer is cancelled: %v", c.ctx.Err())
+	}
 
 	log.Infof("Generate a job for %s to %s", sourceURL.GetURL(), targetURL.GetURL())
 	return nil
@@ -675,8 +987,20 @@ func (c *Client) PutAFailedGenNormalURLPair(failedURLPair *URLPair) {
 
 }
 
+// newImageSource creates the image source of url with tag on the first available endpoint of its registry
+func (c *Client) newImageSource(url *utils.RepoURL, tag string) (*transfer.ImageSource, error) {
+	return transfer.NewImageSourceFromEndpoints(c.jobCtx, url.GetRegistry(), url.GetRepoWithNamespace(), tag,
+		c.config.GetEndpoints(url.GetRegistry(), url.GetNamespace()))
+}
+
+// newImageTarget creates the image target of url with tag on the first available endpoint of its registry
+func (c *Client) newImageTarget(url *utils.RepoURL, tag string) (*transfer.ImageTarget, error) {
+	return transfer.NewImageTargetFromEndpoints(c.jobCtx, url.GetRegistry(), url.GetRepoWithNamespace(), tag,
+		c.config.GetEndpoints(url.GetRegistry(), url.GetNamespace()))
+}
+
 // GenJobFilterTag is hornor by TagExistOverridden policy, skip generate job if tag in target and tag digest is same
-func (c *Client) GenJobFilterTag(sourceTags, targetTags []string, sourceURL, targetURL *utils.RepoURL, sourceSecurity, targetSecurity configs.Security, wg *sync.WaitGroup) {
+func (c *Client) GenJobFilterTag(sourceTags, targetTags []string, sourceURL, targetURL *utils.RepoURL, wg *sync.WaitGroup) {
 	tagChan := make(chan string, len(sourceTags))
 	wg.Add(1)
 	go func() {
@@ -696,6 +1020,10 @@ func (c *Client) GenJobFilterTag(sourceTags, targetTags []string, sourceURL, tar
 					source: sourceURL.GetURL() + ":" + tag,
 					target: targetURL.GetURL() + ":" + tag,
 				}
+				if c.IsCancelled() {
+					c.PutAFailedGenNormalURLPair(urlPair)
+					continue
+				}
 
 				log.Debugf("handle tag %s", urlPair.source)
 				//source tag exist in target
@@ -704,15 +1032,14 @@ func (c *Client) GenJobFilterTag(sourceTags, targetTags []string, sourceURL, tar
 						log.Warnf("Skip push image, target image %s/%s:%s already exist, flag \"--tag-exist-overridden\" is set so skip", targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), tag)
 						continue
 					}
-					imageSource, err := transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(),
-						tag, sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
+					imageSource, err := c.newImageSource(sourceURL, tag)
 					if err != nil {
 						log.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
 						c.PutAFailedGenNormalURLPair(urlPair)
 						continue
 					}
 
-					imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), tag, targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+					imageTarget, err := c.newImageTarget(targetURL, tag)
 					if err != nil {
 						log.Errorf("generate %s image target error: %v", targetURL.GetURL(), err)
 						c.PutAFailedGenNormalURLPair(urlPair)
@@ -747,21 +1074,45 @@ func (c *Client) GenJobFilterTag(sourceTags, targetTags []string, sourceURL, tar
 	}
 }
 
+// repoTagWorkers is the number of goroutines generating url pairs from the repositories of a cloud registry
+const repoTagWorkers = 5
+
 // HandleCcrToTCrTags get tags from ccr api and generate urlPair by filter tag
 func (c *Client) HandleCcrToTCrTags(repoChan chan string) error {
+	return c.handleRepoTags(repoChan, c.tcrRepo, func(ccrRepo string) bool {
+		if !c.isCcrRepoSelected(ccrRepo) {
+			log.Debugf("skip ccr repo %s", ccrRepo)
+			return false
+		}
+		c.migrateCcrRepoMetadata(ccrRepo)
+		return true
+	})
+}
+
+// handleRepoTags gets tags of the repositories from repoChan in the source provider and generates
+// urlPairs by filter tag, targetRepo maps a source repository to the target one, and prepare is called
+// before the tags of a repository are handled if it is not nil, the repository is skipped if it returns false
+func (c *Client) handleRepoTags(repoChan chan string, targetRepo func(string) string, prepare func(string) bool) error {
 	wg := sync.WaitGroup{}
-	for i := 0; i < 5; i++ {
+	for i := 0; i < repoTagWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for ccrRepo := range repoChan {
-				log.Infof("ccr repo is %s", ccrRepo)
-				source := fmt.Sprintf("%s%s%s", ccrapis.RegionPrefix[c.config.FlagConf.Config.CCRRegion], ".ccs.tencentyun.com/", ccrRepo)
-				target := c.config.FlagConf.Config.TCRName + ".tencentcloudcr.com/" + ccrRepo
+			for repo := range repoChan {
+				if prepare != nil && !prepare(repo) {
+					continue
+				}
+				log.Infof("source repo is %s", repo)
+				source := c.sourceProvider.Registry() + "/" + repo
+				target := c.targetProvider.Registry() + "/" + targetRepo(repo)
 				urlPair := &URLPair{
 					source: source,
 					target: target,
 				}
+				if c.IsCancelled() {
+					c.PutAFailedGenNormalURLPair(urlPair)
+					continue
+				}
 
 				err := c.GenCcrtoTcrTagURLPair(source, target, &wg)
 				if err != nil {
@@ -789,12 +1140,53 @@ func (c *Client) IsURLPairFinished() bool {
 	return c.urlPairFinished
 }
 
+// expandWildcardRule lists the repositories under the source registry or namespace of a rule like
+// registry/namespace/* and puts a url pair of each of them, the path of a repository after the source
+// prefix is appended to the target prefix
+func (c *Client) expandWildcardRule(source string, target string) error {
+	prefix := strings.TrimSuffix(source, utils.WildcardSuffix)
+	targetPrefix := strings.TrimSuffix(target, utils.WildcardSuffix)
+	if targetPrefix != "" && utils.CheckIfIncludeTag(targetPrefix) && strings.Contains(targetPrefix, "/") {
+		return fmt.Errorf("target of rule %s should not have a tag: %s", source, target)
+	}
+
+	parts := strings.SplitN(prefix, "/", 2)
+	registry, namespace := parts[0], ""
+	if len(parts) == 2 {
+		namespace = parts[1]
+	}
+
+	repos, err := c.listRepositories(registry, namespace)
+	if err != nil {
+		return fmt.Errorf("list repositories of %s error: %v", prefix, err)
+	}
+	log.Infof("Found %d repositories under %s", len(repos), prefix)
+
+	for _, repo := range repos {
+		urlPair := &URLPair{source: registry + "/" + repo}
+		if targetPrefix != "" {
+			rel := repo
+			if namespace != "" {
+				rel = strings.TrimPrefix(repo, namespace+"/")
+			}
+			urlPair.target = targetPrefix + "/" + rel
+		}
+		c.PutURLPair(urlPair)
+	}
+	return nil
+}
+
 // GenTagURLPair is generate normal image url that containt tag
 func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup) error {
 	if source == "" {
 		return fmt.Errorf("source url should not be empty")
 	}
 
+	// a failed wildcard rule is retried here
+	if utils.IsWildcardURL(source) {
+		return c.expandWildcardRule(source, target)
+	}
+
 	sourceURL, err := utils.NewRepoURL(source)
 	if err != nil {
 		return fmt.Errorf("url %s format error: %v", source, err)
@@ -835,13 +1227,13 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 
 	// multi-tags config
 	tags := sourceURL.GetTag()
-	if moreTag := strings.Split(tags, ","); len(moreTag) > 1 {
+	if moreTag := strings.Split(tags, ","); len(moreTag) > 1 && sourceURL.GetDigest() == "" {
 		if targetURL.GetTag() != "" && targetURL.GetTag() != sourceURL.GetTag() {
 			return fmt.Errorf("multi-tags source should not correspond to a target with tag: %s:%s",
 				sourceURL.GetURL(), targetURL.GetURL())
 		}
 		log.Debugf("source %s tags is %s", sourceURL.GetURL(), moreTag)
-		imageTarget, err = transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), targetURL.GetTag(), targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+		imageTarget, err = c.newImageTarget(targetURL, targetURL.GetTag())
 		if err != nil {
 			return fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 		}
@@ -850,23 +1242,23 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 		if err != nil {
 			return fmt.Errorf("get tags failed from %s error: %v", targetURL.GetURL(), err)
 		}
-		c.GenJobFilterTag(moreTag, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, wg)
+		c.GenJobFilterTag(moreTag, targetTags, sourceURL, targetURL, wg)
 		return nil
 	}
 
-	imageSource, err = transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(), sourceURL.GetTag(), sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
+	imageSource, err = c.newImageSource(sourceURL, sourceURL.GetReference())
 	if err != nil {
 		return fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
 	}
 
-	imageTarget, err = transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), targetURL.GetTag(), targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+	imageTarget, err = c.newImageTarget(targetURL, targetURL.GetReference())
 	if err != nil {
 		return fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 	}
 
 	// if tag is not specific, return tags
-	if sourceURL.GetTag() == "" {
-		if targetURL.GetTag() != "" {
+	if sourceURL.GetReference() == "" {
+		if targetURL.GetReference() != "" {
 			return fmt.Errorf("not allow source tag empty and target tag not empty, both side of the config: %s:%s",
 				sourceURL.GetURL(), targetURL.GetURL())
 		}
@@ -877,6 +1269,9 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 		if err != nil {
 			return fmt.Errorf("get tags failed from %s error: %v", sourceURL.GetURL(), err)
 		}
+		if sourceTags, err = c.selectSourceTags(imageSource, sourceTags); err != nil {
+			return err
+		}
 
 		targetTags, err := imageTarget.GetTargetRepoTags()
 		log.Debugf("target %s tags is %s", targetURL.GetURL(), targetTags)
@@ -884,25 +1279,25 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 			return fmt.Errorf("get tags failed from %s error: %v", targetURL.GetURL(), err)
 		}
 
-		c.GenJobFilterTag(sourceTags, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, wg)
+		c.GenJobFilterTag(sourceTags, targetTags, sourceURL, targetURL, wg)
 		return nil
 	}
 
-	// if source tag is set but without destinate tag, use the same tag as source
-	destTag := targetURL.GetTag()
+	// if source tag or digest is set but without destinate tag, use the same tag or digest as source
+	destTag := targetURL.GetReference()
 	if destTag == "" {
-		destTag = sourceURL.GetTag()
+		destTag = sourceURL.GetReference()
+		target = utils.JoinReference(targetURL.GetURL(), destTag)
 	}
 
-	imageTarget, err = transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(),
-		destTag, targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+	imageTarget, err = c.newImageTarget(targetURL, destTag)
 	if err != nil {
 		return fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 	}
 
 	sourceDigest, err := imageSource.GetImageDigest()
 	if err != nil {
-		log.Errorf("Failed to get source image digest from %s/%s:%s error: %v", imageSource.GetRegistry(), imageSource.GetRepository(), sourceURL.GetTag(), err)
+		log.Errorf("Failed to get source image digest from %s/%s:%s error: %v", imageSource.GetRegistry(), imageSource.GetRepository(), sourceURL.GetReference(), err)
 		return err
 	}
 	targetDigest, err := imageTarget.GetImageDigest()
@@ -934,7 +1329,7 @@ func (c *Client) HandleURLPair() {
 		go func() {
 			defer wg.Done()
 			defer log.Infof("exit HandleURLPair main loop")
-			for {
+			for !c.IsCancelled() {
 				urlPair, empty := c.GetURLPair()
 				// no more job to generate
 				if empty {
@@ -951,6 +1346,15 @@ func (c *Client) HandleURLPair() {
 		}()
 	}
 	wg.Wait()
+
+	if c.IsCancelled() {
+		c.urlPairListMutex.Lock()
+		c.failedGenNormalURLPairListMutex.Lock()
+		c.failedGenNormalURLPairList.PushBackList(c.urlPairList)
+		c.urlPairList.Init()
+		c.failedGenNormalURLPairListMutex.Unlock()
+		c.urlPairListMutex.Unlock()
+	}
 }
 
 // CcrtoTcrGenTagRetry put urlPair to normalURLPair if job is CcrtoTcr
@@ -963,7 +1367,7 @@ func (c *Client) CcrtoTcrGenTagRetry() {
 		go func() {
 			defer wg.Done()
 			defer log.Debugf("exit CcrtoTcrGenTagRetry main loop")
-			for {
+			for !c.IsCancelled() {
 				urlPair, empty := c.GetURLPair()
 				// no more job to generate
 				if empty {
@@ -982,6 +1386,63 @@ func (c *Client) CcrtoTcrGenTagRetry() {
 	wg.Wait()
 }
 
+// getSourceRepoTags get the tags of a repo from the api of the source registry of ccrToTcr and tcrToTcr mode,
+// only the ccrTagNums most recently pushed tags are returned in ccrToTcr mode
+func (c *Client) getSourceRepoTags(sourceURL *utils.RepoURL) ([]string, error) {
+	selector, err := c.tagSelector()
+	if err != nil {
+		return nil, err
+	}
+	if c.config.FlagConf.Config.CCRToTCR {
+		ccrTagNums := c.config.FlagConf.Config.CCRTagNums
+		if ccrTagNums < 0 {
+			return nil, fmt.Errorf("invalid value ccrTagNums %v", ccrTagNums)
+		}
+		if ccrTagNums > 0 && (selector.KeepLatest == 0 || ccrTagNums < selector.KeepLatest) {
+			selector.KeepLatest = ccrTagNums
+		}
+	}
+
+	tags, err := c.sourceProvider.ListTags(c.ctx, sourceURL.GetRepoWithNamespace())
+	if err != nil {
+		log.Errorf("Failed get source repo %s tags, error: %s", sourceURL.GetRepoWithNamespace(), err)
+		return nil, fmt.Errorf("failed get source repo %s tags, error: %s", sourceURL.GetRepoWithNamespace(), err)
+	}
+	sourceTags := provider.TagNames(selector.Select(tags))
+	if len(sourceTags) != len(tags) {
+		log.Infof("Select %d of %d tags of %s by push time", len(sourceTags), len(tags), sourceURL.GetOriginURL())
+	}
+
+	log.Debugf("source %s tags is %s", sourceURL.GetOriginURL(), sourceTags)
+	return sourceTags, nil
+}
+
+// selectSourceTags selects the tags of a repository of a generic registry by the created time of
+// their image configs, the configs are read only if the tag selector is not empty
+func (c *Client) selectSourceTags(imageSource *transfer.ImageSource, names []string) ([]string, error) {
+	selector, err := c.tagSelector()
+	if err != nil {
+		return nil, err
+	}
+	if selector.IsEmpty() {
+		return names, nil
+	}
+
+	tags := make([]provider.Tag, 0, len(names))
+	for _, name := range names {
+		created, err := imageSource.GetCreated(name)
+		if err != nil {
+			log.Warnf("Failed to get created time of %s/%s:%s, the tag is selected: %v",
+				imageSource.GetRegistry(), imageSource.GetRepository(), name, err)
+		}
+		tags = append(tags, provider.Tag{Name: name, PushTime: created})
+	}
+	selected := provider.TagNames(selector.Select(tags))
+	log.Infof("Select %d of %d tags of %s/%s by created time",
+		len(selected), len(names), imageSource.GetRegistry(), imageSource.GetRepository())
+	return selected, nil
+}
+
 // GenCcrtoTcrTagURLPair is generate normal url pair
 func (c *Client) GenCcrtoTcrTagURLPair(source string, target string, wg *sync.WaitGroup) error {
 	urlPair := &URLPair{
@@ -1015,22 +1476,12 @@ func (c *Client) GenCcrtoTcrTagURLPair(source string, target string, wg *sync.Wa
 	}
 
 	if sourceURL.GetTag() == "" {
-		ccrClient := ccrapis.NewCCRAPIClient()
-
-		ccrSecretID, ccrSecretKey, err := ccrapis.GetCcrSecret(c.config.Secret)
+		sourceTags, err := c.getSourceRepoTags(sourceURL)
 		if err != nil {
-			log.Errorf("GetCcrSecret error: %s", err)
 			return err
 		}
 
-		sourceTags, err := ccrClient.GetRepoTags(ccrSecretID, ccrSecretKey, c.config.FlagConf.Config.CCRRegion, sourceURL.GetRepoWithNamespace(), int64(c.config.FlagConf.Config.CCRTagNums))
-		log.Debugf("ccr target %s tags is %s", sourceURL.GetOriginURL(), sourceTags)
-		if err != nil {
-			log.Errorf("Failed get ccr repo %s tags, error: %s", sourceURL.GetRepoWithNamespace(), err)
-			return fmt.Errorf("failed get ccr repo %s tags, error: %s", sourceURL.GetRepoWithNamespace(), err)
-		}
-
-		imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), targetURL.GetTag(), targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+		imageTarget, err := c.newImageTarget(targetURL, targetURL.GetTag())
 		if err != nil {
 			return fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 		}
@@ -1042,18 +1493,18 @@ func (c *Client) GenCcrtoTcrTagURLPair(source string, target string, wg *sync.Wa
 		}
 
 		log.Debugf("GenCcrtoTcrTagURLPair call GenJobFilterTag")
-		c.GenJobFilterTag(sourceTags, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, wg)
+		c.GenJobFilterTag(sourceTags, targetTags, sourceURL, targetURL, wg)
 		return nil
 	}
 
 	// already contain tag
 
-	imageSource, err := transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(), sourceURL.GetTag(), sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
+	imageSource, err := c.newImageSource(sourceURL, sourceURL.GetTag())
 	if err != nil {
 		return fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
 	}
 
-	imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), targetURL.GetTag(), targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+	imageTarget, err := c.newImageTarget(targetURL, targetURL.GetTag())
 	if err != nil {
 		return fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 	}
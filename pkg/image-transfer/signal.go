@@ -0,0 +1,49 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// signalContext returns a context cancelled on the first SIGINT or SIGTERM,
+// the process exits on the second one without waiting for the jobs in flight
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigCh
+		log.Warnf("Received signal %s, stop transferring, send it again to exit immediately", sig)
+		cancel()
+
+		sig = <-sigCh
+		log.Errorf("Received signal %s again, exit", sig)
+		log.FlushLogger()
+		os.Exit(1)
+	}()
+
+	return ctx
+}
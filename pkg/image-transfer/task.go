@@ -0,0 +1,322 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/progress"
+)
+
+// TaskState is the state of a transfer task or a pair in it
+type TaskState string
+
+const (
+	// TaskPending means the task or pair is waiting to run
+	TaskPending TaskState = "pending"
+	// TaskRunning means the task or pair is running
+	TaskRunning TaskState = "running"
+	// TaskSucceeded means the task or pair finished without error
+	TaskSucceeded TaskState = "succeeded"
+	// TaskFailed means some pairs of the task failed, or the pair failed
+	TaskFailed TaskState = "failed"
+	// TaskCancelled means the task is cancelled
+	TaskCancelled TaskState = "cancelled"
+)
+
+// Task is a rule set submitted to be transferred by a Client
+type Task struct {
+	ID         string            `json:"id"`
+	Rules      map[string]string `json:"rules"`
+	State      TaskState         `json:"state"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	// RetryOf is the id of the task whose failures are transferred by this task
+	RetryOf  string             `json:"retryOf,omitempty"`
+	Progress *progress.Snapshot `json:"progress,omitempty"`
+
+	client *Client
+	pairs  *pairRecorder
+	// retried is set once the failures of the task are submitted as a new task
+	retried bool
+}
+
+// PairStatus is the state of a source image with tag in a task
+type PairStatus struct {
+	Source      string    `json:"source"`
+	Target      string    `json:"target"`
+	State       TaskState `json:"state"`
+	BytesCopied int64     `json:"bytesCopied"`
+	BlobsCopied int       `json:"blobsCopied"`
+	BlobsSkip   int       `json:"blobsSkipped"`
+}
+
+// pairRecorder records per pair status from progress events
+type pairRecorder struct {
+	mutex sync.Mutex
+	pairs map[string]*PairStatus
+}
+
+func newPairRecorder() *pairRecorder {
+	return &pairRecorder{pairs: make(map[string]*PairStatus)}
+}
+
+// Emit implements progress.Reporter
+func (r *pairRecorder) Emit(ev progress.Event) {
+	if ev.Job == "" {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	pair, ok := r.pairs[ev.Job]
+	if !ok {
+		pair = &PairStatus{Source: ev.Job, State: TaskPending}
+		r.pairs[ev.Job] = pair
+	}
+
+	switch ev.Type {
+	case progress.PairDiscovered:
+		pair.Target = ev.Target
+	case progress.JobStarted:
+		pair.State = TaskRunning
+	case progress.JobSucceeded:
+		pair.State = TaskSucceeded
+	case progress.JobFailed:
+		pair.State = TaskFailed
+	case progress.JobRetried:
+		pair.State = TaskPending
+	case progress.BlobBytes:
+		pair.BytesCopied += ev.Size
+	case progress.BlobFinished:
+		pair.BlobsCopied++
+	case progress.BlobSkipped:
+		pair.BlobsSkip++
+	}
+}
+
+func (r *pairRecorder) list() []PairStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	pairs := make([]PairStatus, 0, len(r.pairs))
+	for _, p := range r.pairs {
+		pairs = append(pairs, *p)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Source < pairs[j].Source })
+	return pairs
+}
+
+// TaskManager runs submitted tasks in background and keeps them in memory
+type TaskManager struct {
+	ctx    context.Context
+	config *configs.Configs
+	// running counts the tasks not finished
+	running sync.WaitGroup
+
+	mutex  sync.Mutex
+	nextID int
+	tasks  map[string]*Task
+}
+
+// NewTaskManager creates a TaskManager, config provides security and flags of the tasks,
+// all tasks are cancelled when ctx is done
+func NewTaskManager(ctx context.Context, config *configs.Configs) *TaskManager {
+	return &TaskManager{
+		ctx:    ctx,
+		config: config,
+		tasks:  make(map[string]*Task),
+	}
+}
+
+// Submit creates a task of rules and starts it
+func (m *TaskManager) Submit(rules map[string]string) (*Task, error) {
+	return m.submit(rules, "")
+}
+
+func (m *TaskManager) submit(rules map[string]string, retryOf string) (*Task, error) {
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("rules should not be empty")
+	}
+
+	client := newClient(m.ctx, m.config.WithImageList(rules))
+	recorder := newPairRecorder()
+	client.reporter = recorder
+
+	m.mutex.Lock()
+	m.nextID++
+	task := &Task{
+		ID:        strconv.Itoa(m.nextID),
+		Rules:     rules,
+		State:     TaskRunning,
+		CreatedAt: time.Now(),
+		RetryOf:   retryOf,
+		client:    client,
+		pairs:     recorder,
+	}
+	m.tasks[task.ID] = task
+	m.running.Add(1)
+	m.mutex.Unlock()
+
+	go func() {
+		defer m.running.Done()
+		m.run(task)
+	}()
+	return task, nil
+}
+
+func (m *TaskManager) run(task *Task) {
+	log.Infof("Start task %s with %d rules", task.ID, len(task.Rules))
+	err := task.client.NormalTransfer(task.Rules, nil)
+
+	state := TaskSucceeded
+	switch {
+	case task.client.IsCancelled():
+		state = TaskCancelled
+	case err != nil || len(task.client.FailedURLPairs()) != 0:
+		state = TaskFailed
+	}
+	if err != nil {
+		log.Errorf("task %s failed: %v", task.ID, err)
+	}
+
+	now := time.Now()
+	m.mutex.Lock()
+	task.State = state
+	task.FinishedAt = &now
+	m.mutex.Unlock()
+	log.Infof("Task %s finished, state %s", task.ID, state)
+}
+
+// Wait blocks until all submitted tasks are finished
+func (m *TaskManager) Wait() {
+	m.running.Wait()
+}
+
+// Get returns a copy of the task with progress, ok is false if the task does not exist
+func (m *TaskManager) Get(id string) (Task, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	task, ok := m.tasks[id]
+	if !ok {
+		return Task{}, false
+	}
+	snapshot := task.client.progress.Snapshot()
+	result := *task
+	result.Progress = &snapshot
+	return result, true
+}
+
+// List returns all tasks ordered by id
+func (m *TaskManager) List() []Task {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tasks := make([]Task, 0, len(m.tasks))
+	for _, task := range m.tasks {
+		tasks = append(tasks, *task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		a, _ := strconv.Atoi(tasks[i].ID)
+		b, _ := strconv.Atoi(tasks[j].ID)
+		return a < b
+	})
+	return tasks
+}
+
+// Pairs returns per pair status of a task
+func (m *TaskManager) Pairs(id string) ([]PairStatus, bool) {
+	m.mutex.Lock()
+	task, ok := m.tasks[id]
+	m.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	pairs := task.pairs.list()
+	known := make(map[string]bool, len(pairs))
+	for _, p := range pairs {
+		known[p.Source] = true
+	}
+	// pairs failed before a job is generated have no events
+	for source, target := range task.client.FailedURLPairs() {
+		if !known[source] {
+			pairs = append(pairs, PairStatus{Source: source, Target: target, State: TaskFailed})
+		}
+	}
+	return pairs, true
+}
+
+// Cancel stops a running task, jobs in progress are finished
+func (m *TaskManager) Cancel(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	task, ok := m.tasks[id]
+	if !ok {
+		return fmt.Errorf("task %s not found", id)
+	}
+	if task.State != TaskRunning {
+		return fmt.Errorf("task %s is %s, only running task can be cancelled", id, task.State)
+	}
+	task.client.Cancel()
+	return nil
+}
+
+// Retry submits a new task transferring the failed pairs of a finished task, a task is retried at most once
+func (m *TaskManager) Retry(id string) (retry *Task, err error) {
+	m.mutex.Lock()
+	task, ok := m.tasks[id]
+	if !ok {
+		m.mutex.Unlock()
+		return nil, fmt.Errorf("task %s not found", id)
+	}
+	if task.State == TaskRunning {
+		m.mutex.Unlock()
+		return nil, fmt.Errorf("task %s is still running", id)
+	}
+	if task.retried {
+		m.mutex.Unlock()
+		return nil, fmt.Errorf("task %s is already retried", id)
+	}
+	task.retried = true
+	m.mutex.Unlock()
+
+	failed := task.client.FailedURLPairs()
+	if len(failed) == 0 {
+		err = fmt.Errorf("task %s has no failures to retry", id)
+	} else {
+		retry, err = m.submit(failed, id)
+	}
+	if err != nil {
+		m.mutex.Lock()
+		task.retried = false
+		m.mutex.Unlock()
+	}
+	return retry, err
+}
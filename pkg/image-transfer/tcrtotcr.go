@@ -0,0 +1,107 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/provider"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// sourceTcrRegion returns the region of the source tcr instance, it is the same as target if not set
+func (c *Client) sourceTcrRegion() string {
+	if c.config.FlagConf.Config.SourceTCRRegion != "" {
+		return c.config.FlagConf.Config.SourceTCRRegion
+	}
+	return c.config.FlagConf.Config.TCRRegion
+}
+
+// TCRToTCRTransfer transfer all namespaces, repos and tags of a tcr instance to another tcr instance
+func (c *Client) TCRToTCRTransfer() error {
+	if err := c.initCloudProviders(); err != nil {
+		return err
+	}
+	if c.sourceProvider.Registry() == c.targetProvider.Registry() {
+		return fmt.Errorf("source and target tcr instance should not be the same: %s", c.sourceProvider.Registry())
+	}
+
+	failedNsList, err := c.CreateTargetTcrNs()
+	if err != nil {
+		log.Errorf("CreateTargetTcrNs error: %s", err)
+		return err
+	}
+	if len(failedNsList) != 0 {
+		log.Warnf("some source tcr namespace create failed in target tcr: %s", failedNsList)
+	}
+
+	repoChan, err := c.GenerateRepoRules(failedNsList)
+	if err != nil {
+		return err
+	}
+
+	return c.NormalTransfer(nil, repoChan)
+}
+
+// CreateTargetTcrNs creates the namespaces of source tcr missing in target tcr with the same visibility,
+// the namespaces still failed after retries are returned
+func (c *Client) CreateTargetTcrNs() ([]string, error) {
+	sourceNs, err := c.sourceProvider.ListNamespaces(c.ctx)
+	if err != nil {
+		log.Errorf("Get source tcr ns returned error: %s", err)
+		return nil, err
+	}
+	targetNs, err := c.targetProvider.ListNamespaces(c.ctx)
+	if err != nil {
+		log.Errorf("Get target tcr ns returned error: %s", err)
+		return nil, err
+	}
+
+	var missing []provider.Namespace
+	for _, ns := range sourceNs {
+		if !utils.IsContain(provider.NamespaceNames(targetNs), ns.Name) {
+			missing = append(missing, ns)
+		}
+	}
+	c.checkNamespaceQuota(len(missing))
+
+	var failedList []string
+	for _, ns := range missing {
+		log.Infof("create namespace %s in target tcr, public: %t", ns.Name, ns.Public)
+		for times := 0; ; times++ {
+			err = c.targetProvider.CreateNamespace(c.ctx, ns.Name, ns.Public)
+			if err == nil {
+				break
+			}
+			log.Errorf("tcr CreateNamespace %s error: %s", ns.Name, err)
+			if times >= c.config.FlagConf.Config.RetryNums {
+				failedList = append(failedList, ns.Name)
+				break
+			}
+		}
+	}
+	return failedList, nil
+}
+
+// HandleTcrToTcrTags get tags from source tcr api and generate urlPair by filter tag,
+// repositories keep their names in target tcr
+func (c *Client) HandleTcrToTcrTags(repoChan chan string) error {
+	return c.handleRepoTags(repoChan, func(repo string) string { return repo }, nil)
+}
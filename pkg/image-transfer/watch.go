@@ -0,0 +1,179 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// fileCheckInterval is the period of checking config files modification
+const fileCheckInterval = 10 * time.Second
+
+// Watcher runs transfer cycles repeatedly on an interval or a cron schedule,
+// a new cycle is triggered immediately when a config file is modified
+type Watcher struct {
+	opts     *options.ClientOptions
+	schedule cron.Schedule
+
+	// trigger starts a cycle out of the schedule
+	trigger  chan struct{}
+	modTimes map[string]time.Time
+	// reloaders receive the configs loaded by each cycle
+	reloaders []func(*configs.Configs)
+}
+
+// NewWatcher creates a Watcher from --sync-interval or --sync-cron
+func NewWatcher(opts *options.ClientOptions) (*Watcher, error) {
+	conf := opts.Config
+
+	var schedule cron.Schedule
+	switch {
+	case conf.SyncCron != "" && conf.SyncInterval > 0:
+		return nil, fmt.Errorf("flag --sync-cron and --sync-interval should not be set together")
+	case conf.SyncCron != "":
+		s, err := cron.ParseStandard(conf.SyncCron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron schedule %q: %v", conf.SyncCron, err)
+		}
+		schedule = s
+	case conf.SyncInterval > 0:
+		schedule = cron.Every(conf.SyncInterval)
+	default:
+		return nil, fmt.Errorf("one of flag --sync-cron or --sync-interval should be set in watch mode")
+	}
+
+	w := &Watcher{
+		opts:     opts,
+		schedule: schedule,
+		trigger:  make(chan struct{}, 1),
+		modTimes: make(map[string]time.Time),
+	}
+	w.configChanged()
+
+	return w, nil
+}
+
+// OnReload registers f to receive the configs loaded at the start of each cycle,
+// it is used by long running servers to pick up changes of config files
+func (w *Watcher) OnReload(f func(*configs.Configs)) {
+	w.reloaders = append(w.reloaders, f)
+}
+
+// IsWatchMode returns true if transfer should be run repeatedly
+func IsWatchMode(opts *options.ClientOptions) bool {
+	return opts.Config.SyncCron != "" || opts.Config.SyncInterval > 0
+}
+
+// Run runs the first cycle immediately and then loops until ctx is done
+func (w *Watcher) Run(ctx context.Context) error {
+	go w.watchConfigFiles(ctx)
+
+	for {
+		w.runOnce(ctx)
+		if ctx.Err() != nil {
+			log.Infof("Watch mode is stopped")
+			return nil
+		}
+
+		next := w.schedule.Next(time.Now())
+		log.Infof("Next transfer cycle will start at %s", next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-w.trigger:
+			timer.Stop()
+			log.Infof("Config files changed, start a new transfer cycle")
+		case <-ctx.Done():
+			timer.Stop()
+			log.Infof("Watch mode is stopped")
+			return nil
+		}
+	}
+}
+
+func (w *Watcher) runOnce(ctx context.Context) {
+	start := time.Now()
+	log.Infof("################# Start transfer cycle #################")
+
+	// rule and security files are read again by a new client, so changes are picked up
+	client, err := NewTransferClient(ctx, w.opts)
+	if err != nil {
+		log.Errorf("init Transfer Client error: %v", err)
+		return
+	}
+	for _, reload := range w.reloaders {
+		reload(client.config)
+	}
+
+	if err := client.Run(); err != nil {
+		log.Errorf("transfer cycle failed: %v", err)
+		return
+	}
+
+	log.Infof("################# Transfer cycle finished in %s #################", time.Since(start).Truncate(time.Second))
+}
+
+// watchConfigFiles triggers a cycle when a config file is modified until ctx is done
+func (w *Watcher) watchConfigFiles(ctx context.Context) {
+	ticker := time.NewTicker(fileCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if w.configChanged() {
+			select {
+			case w.trigger <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// configChanged records the modification time of config files and returns true if any of them changed
+func (w *Watcher) configChanged() bool {
+	conf := w.opts.Config
+	changed := false
+	for _, path := range []string{conf.RuleFile, conf.SecurityFile, conf.SecretFile, conf.MirrorsFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Warnf("stat config file %s error: %v", path, err)
+			continue
+		}
+		if last, ok := w.modTimes[path]; ok && !last.Equal(info.ModTime()) {
+			log.Infof("Config file %s is modified", path)
+			changed = true
+		}
+		w.modTimes[path] = info.ModTime()
+	}
+	return changed
+}
@@ -0,0 +1,267 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/progress"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+	"tkestack.io/image-transfer/pkg/webhook"
+)
+
+// maxWebhookBodySize limits the size of a webhook payload
+const maxWebhookBodySize = 1 << 20
+
+// maxPendingWebhookPairs limits the matched pushed images waiting for a job to be generated
+const maxPendingWebhookPairs = 1000
+
+// WebhookServer receives registry push events and transfers the pushed tags matched by the rule file
+type WebhookServer struct {
+	// client provides the context and flags of the server, and aborts the jobs in flight
+	client *Client
+	token  string
+	// rules generates jobs by the rule and security files loaded last, it is replaced by Reload
+	rules      *Client
+	rulesMutex sync.RWMutex
+	// pairCh queues the matched pushed images, jobs are generated from it
+	pairCh chan *URLPair
+	jobCh  chan *transfer.Job
+}
+
+// NewWebhookServer creates a WebhookServer, the server is shut down when ctx is done.
+// A token is required unless the server listens on a loopback address
+func NewWebhookServer(ctx context.Context, opts *options.ClientOptions) (*WebhookServer, error) {
+	if opts.Config.CCRToTCR || opts.Config.TCRToTCR {
+		return nil, fmt.Errorf("webhook server does not support ccrToTcr and tcrToTcr mode")
+	}
+	if opts.Config.WebhookToken == "" && !isLoopbackAddr(opts.Config.WebhookAddr) {
+		return nil, fmt.Errorf("--webhook-token is required if webhook server listens on a non-loopback address %s",
+			opts.Config.WebhookAddr)
+	}
+
+	client, err := NewTransferClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookServer{
+		client: client,
+		token:  opts.Config.WebhookToken,
+		rules:  client,
+		pairCh: make(chan *URLPair, maxPendingWebhookPairs),
+		jobCh:  make(chan *transfer.Job, opts.Config.RoutineNums),
+	}, nil
+}
+
+// Run listens on addr and transfers pushed tags until the listener fails or the server is shut down
+func (s *WebhookServer) Run(addr string) error {
+	workers := sync.WaitGroup{}
+	for i := 0; i < s.client.config.FlagConf.Config.RoutineNums; i++ {
+		workers.Add(2)
+		go func() {
+			defer workers.Done()
+			s.generator()
+		}()
+		go func() {
+			defer workers.Done()
+			s.worker()
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook/"+webhook.KindHarbor, s.handler(webhook.KindHarbor))
+	mux.HandleFunc("/webhook/"+webhook.KindTCR, s.handler(webhook.KindTCR))
+	mux.HandleFunc("/webhook/"+webhook.KindRegistry, s.handler(webhook.KindRegistry))
+
+	log.Infof("Webhook server listening on %s", addr)
+	server := &http.Server{Addr: addr, Handler: mux}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-s.client.ctx.Done():
+	}
+
+	grace := s.client.config.FlagConf.Config.GracePeriod
+	log.Infof("Shutting down webhook server, wait at most %s for the jobs in flight", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("shutdown webhook server error: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		log.Warnf("Grace period is over, abort the jobs in flight")
+		s.client.abort()
+		<-done
+	}
+	return nil
+}
+
+func (s *WebhookServer) handler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.token != "" && !checkBearerToken(r, s.token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events, err := webhook.ParsePushEvents(kind, body)
+		if err != nil {
+			log.Errorf("parse %s webhook error: %v", kind, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, ev := range events {
+			if !s.enqueue(ev) {
+				http.Error(w, "too many pending images", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Reload replaces the rules and security of the server by config, the jobs generated before are not changed
+func (s *WebhookServer) Reload(config *configs.Configs) {
+	rules := s.client.withConfig(config)
+	s.rulesMutex.Lock()
+	s.rules = rules
+	s.rulesMutex.Unlock()
+	log.Infof("Webhook server reloaded %d rules", len(config.ImageList))
+}
+
+// currentRules returns the client of the rules loaded last
+func (s *WebhookServer) currentRules() *Client {
+	s.rulesMutex.RLock()
+	defer s.rulesMutex.RUnlock()
+	return s.rules
+}
+
+// enqueue queues the pushed image if a rule matches it, it returns false if the queue is full
+func (s *WebhookServer) enqueue(ev webhook.PushEvent) bool {
+	source, target, ok := webhook.MatchRules(s.currentRules().config.ImageList, ev)
+	if !ok {
+		log.Infof("No rule matches pushed image %s, ignore it", ev.URL())
+		return true
+	}
+
+	if target == "" {
+		if s.client.config.FlagConf.Config.DefaultRegistry == "" {
+			log.Errorf("no target for pushed image %s, the default registry should not be empty", ev.URL())
+			return true
+		}
+		sourceURL, err := utils.NewRepoURL(source)
+		if err != nil {
+			log.Errorf("url %s format error: %v", source, err)
+			return true
+		}
+		target = s.client.config.FlagConf.Config.DefaultRegistry + "/" +
+			sourceURL.GetNamespace() + "/" + sourceURL.GetRepoWithTag()
+	}
+
+	log.Infof("Pushed image %s matches rule, transfer %s to %s", ev.URL(), source, target)
+	// generating a job checks the remote registries, do not block the webhook sender
+	select {
+	case s.pairCh <- &URLPair{source: source, target: target}:
+		return true
+	default:
+		log.Errorf("Too many pending images, drop pushed image %s", ev.URL())
+		return false
+	}
+}
+
+// generator generates jobs from the queued images until the server is shut down
+func (s *WebhookServer) generator() {
+	for {
+		var urlPair *URLPair
+		select {
+		case urlPair = <-s.pairCh:
+		case <-s.client.ctx.Done():
+			return
+		}
+
+		if err := s.currentRules().GenerateTransferJob(s.jobCh, urlPair.source, urlPair.target); err != nil {
+			log.Errorf("Generate transfer job %s to %s error: %v", urlPair.source, urlPair.target, err)
+		}
+	}
+}
+
+func (s *WebhookServer) worker() {
+	retryNums := s.client.config.FlagConf.Config.RetryNums
+	for {
+		var job *transfer.Job
+		select {
+		case job = <-s.jobCh:
+		case <-s.client.ctx.Done():
+			return
+		}
+
+		job.Emit(progress.JobStarted)
+		var err error
+		for times := 0; times <= retryNums && !s.client.IsCancelled(); times++ {
+			if times > 0 {
+				time.Sleep(time.Duration(times) * time.Second)
+				log.Infof("Retry transfer job %s/%s:%s, times %d", job.Source.GetRegistry(),
+					job.Source.GetRepository(), job.Source.GetTag(), times)
+			}
+			if err = job.Run(); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Errorf("handle job failed %s/%s:%s, %s", job.Source.GetRegistry(), job.Source.GetRepository(),
+				job.Source.GetTag(), err)
+			job.Emit(progress.JobFailed)
+			job.Close()
+			continue
+		}
+		job.Emit(progress.JobSucceeded)
+	}
+}
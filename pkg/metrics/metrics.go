@@ -0,0 +1,158 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/progress"
+)
+
+const namespace = "image_transfer"
+
+var (
+	// JobsTotal counts finished transfer jobs by outcome
+	JobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_total",
+		Help:      "Number of finished transfer jobs by outcome.",
+	}, []string{"outcome"})
+
+	// BlobsTotal counts blobs by result, copied or skipped
+	BlobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blobs_total",
+		Help:      "Number of blobs copied to or skipped because they already exist in target.",
+	}, []string{"result"})
+
+	// BytesTotal counts blob bytes transferred per source and target registry
+	BytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transferred_bytes_total",
+		Help:      "Number of blob bytes transferred from source registry to target registry.",
+	}, []string{"source_registry", "target_registry"})
+
+	// RequestDuration observes registry operations latency per registry, operation and status code
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "registry_request_duration_seconds",
+		Help:      "Latency of registry operations by registry, operation and status code.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"registry", "operation", "code"})
+
+	// RetriesTotal counts retried items per kind
+	RetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Number of retried jobs, url pairs and job generations.",
+	}, []string{"kind"})
+
+	// TimeoutsTotal counts jobs and blob copies aborted by timeouts
+	TimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "timeouts_total",
+		Help:      "Number of jobs exceeding the job timeout and blob copies stalled longer than the idle timeout.",
+	}, []string{"kind"})
+
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_length",
+		Help:      "Number of items waiting in the pipeline queues.",
+	}, []string{"queue"})
+)
+
+func init() {
+	prometheus.MustRegister(JobsTotal, BlobsTotal, BytesTotal, RequestDuration, RetriesTotal, TimeoutsTotal, queueLength)
+}
+
+// Serve starts a http server exposing /metrics on addr in background
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Infof("Serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("metrics server on %s exit: %v", addr, err)
+		}
+	}()
+}
+
+// ObserveResponse records the latency and the status code of resp of a registry operation started at start,
+// the code is "error" if no response is received
+func ObserveResponse(registry, operation string, start time.Time, resp *http.Response, err error) {
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	RequestDuration.WithLabelValues(registry, operation, code).Observe(time.Since(start).Seconds())
+}
+
+// ObserveRequest records the latency of a registry operation of containers/image started at start,
+// its response is not visible, so the code is "success" or "error", or the status code of a typed error
+func ObserveRequest(registry, operation string, start time.Time, err error) {
+	code := "success"
+	switch {
+	case err == nil:
+	case errors.As(err, &docker.ErrUnauthorizedForCredentials{}):
+		code = strconv.Itoa(http.StatusUnauthorized)
+	case errors.Is(err, docker.ErrTooManyRequests):
+		code = strconv.Itoa(http.StatusTooManyRequests)
+	default:
+		code = "error"
+	}
+	RequestDuration.WithLabelValues(registry, operation, code).Observe(time.Since(start).Seconds())
+}
+
+// SetQueueLength sets the current length of a pipeline queue
+func SetQueueLength(queue string, length int) {
+	queueLength.WithLabelValues(queue).Set(float64(length))
+}
+
+// Reporter turns progress events of a transfer job into metrics
+type Reporter struct {
+	SourceRegistry string
+	TargetRegistry string
+}
+
+var _ progress.Reporter = &Reporter{}
+
+// Emit implements progress.Reporter
+func (r *Reporter) Emit(ev progress.Event) {
+	switch ev.Type {
+	case progress.JobSucceeded:
+		JobsTotal.WithLabelValues("success").Inc()
+	case progress.JobFailed:
+		JobsTotal.WithLabelValues("failed").Inc()
+	case progress.JobRetried:
+		RetriesTotal.WithLabelValues("job").Inc()
+	case progress.BlobFinished:
+		BlobsTotal.WithLabelValues("copied").Inc()
+	case progress.BlobSkipped:
+		BlobsTotal.WithLabelValues("skipped").Inc()
+	case progress.BlobBytes:
+		BytesTotal.WithLabelValues(r.SourceRegistry, r.TargetRegistry).Add(float64(ev.Size))
+	}
+}
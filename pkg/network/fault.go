@@ -0,0 +1,242 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// Fault describes the failure injected into the requests of matching registries and paths, it is used
+// for chaos testing of transfers and retries. Exactly one of Latency, Status, Drop and Truncate is set
+type Fault struct {
+	// Host is the host or host:port of matching requests, all hosts if empty
+	Host string `yaml:"host"`
+	// Method is the http method of matching requests, all methods if empty
+	Method string `yaml:"method"`
+	// Path is a regular expression matched against the url path, e.g. /blobs/, all paths if empty
+	Path string `yaml:"path"`
+	// Rate is the probability of a matching request to fail, 1 if zero
+	Rate float64 `yaml:"rate"`
+	// Times limits the number of injected failures, unlimited if zero
+	Times int `yaml:"times"`
+
+	// Latency delays matching requests
+	Latency time.Duration `yaml:"latency"`
+	// Status is returned without sending matching requests, e.g. 429, 500 or 401
+	Status int `yaml:"status"`
+	// Drop breaks the response body with a connection error after AfterBytes bytes
+	Drop bool `yaml:"drop"`
+	// Truncate ends the response body after AfterBytes bytes
+	Truncate bool `yaml:"truncate"`
+	// AfterBytes is the number of bytes of response body read before it is dropped or truncated
+	AfterBytes int64 `yaml:"afterBytes"`
+}
+
+// fault is a Fault in effect
+type fault struct {
+	Fault
+	path      *regexp.Regexp
+	triggered int
+}
+
+// ErrFaultDropped is returned by the response body dropped by a fault
+var ErrFaultDropped = errors.New("connection reset by fault injection")
+
+var (
+	faultMutex sync.Mutex
+	faults     []*fault
+)
+
+// LoadFaults reads a yaml list of faults from path
+func LoadFaults(path string) ([]Fault, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read fault file %s error: %v", path, err)
+	}
+	var list []Fault
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return nil, fmt.Errorf("decode fault file %s error: %v", path, err)
+	}
+	return list, nil
+}
+
+// SetFaults replaces the faults injected into registry requests, nil disables fault injection.
+// Routing is enabled so that the requests of containers/image pass the faults too, only plain http
+// requests are visible to the router, requests in the tunnels of https registries are not affected
+func SetFaults(list []Fault) error {
+	parsed := make([]*fault, 0, len(list))
+	for i, f := range list {
+		actions := 0
+		for _, set := range []bool{f.Latency > 0, f.Status != 0, f.Drop, f.Truncate} {
+			if set {
+				actions++
+			}
+		}
+		if actions != 1 {
+			return fmt.Errorf("fault %d should set exactly one of latency, status, drop and truncate", i)
+		}
+		if f.Status != 0 && (f.Status < 100 || f.Status > 599) {
+			return fmt.Errorf("fault %d has invalid status %d", i, f.Status)
+		}
+		if f.Rate < 0 || f.Rate > 1 {
+			return fmt.Errorf("fault %d has invalid rate %v, should be in [0, 1]", i, f.Rate)
+		}
+		path, err := regexp.Compile(f.Path)
+		if err != nil {
+			return fmt.Errorf("fault %d has invalid path %s: %v", i, f.Path, err)
+		}
+		parsed = append(parsed, &fault{Fault: f, path: path})
+	}
+
+	faultMutex.Lock()
+	faults = parsed
+	faultMutex.Unlock()
+	if len(parsed) == 0 {
+		return nil
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	initDefaultProxy()
+	return enable()
+}
+
+// WithFaults wraps transport to inject the faults set by SetFaults into its requests
+func WithFaults(transport http.RoundTripper) http.RoundTripper {
+	return &faultTransport{RoundTripper: transport}
+}
+
+// faultTransport injects faults into requests
+type faultTransport struct {
+	http.RoundTripper
+}
+
+var _ http.RoundTripper = &faultTransport{}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := triggerFault(req)
+	if f == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	log.Warnf("Inject fault %+v into %s %s", f.Fault, req.Method, req.URL)
+
+	if f.Latency > 0 {
+		if err := sleep(req.Context(), f.Latency); err != nil {
+			return nil, err
+		}
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	if f.Status != 0 {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		body := fmt.Sprintf("%d %s by fault injection", f.Status, http.StatusText(f.Status))
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+			StatusCode:    f.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &faultBody{ReadCloser: resp.Body, remaining: f.AfterBytes, drop: f.Drop}
+	return resp, nil
+}
+
+// triggerFault returns the first fault matching req and triggered by its rate, nil if none is triggered
+func triggerFault(req *http.Request) *fault {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	for _, f := range faults {
+		if f.Host != "" && f.Host != req.URL.Host && f.Host != req.URL.Hostname() {
+			continue
+		}
+		if f.Method != "" && !strings.EqualFold(f.Method, req.Method) {
+			continue
+		}
+		if !f.path.MatchString(req.URL.Path) {
+			continue
+		}
+		if f.Times > 0 && f.triggered >= f.Times {
+			continue
+		}
+		if f.Rate > 0 && rand.Float64() >= f.Rate {
+			continue
+		}
+		f.triggered++
+		return f
+	}
+	return nil
+}
+
+// faultBody drops or truncates a response body after some bytes
+type faultBody struct {
+	io.ReadCloser
+	remaining int64
+	drop      bool
+}
+
+func (b *faultBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		if b.drop {
+			return 0, ErrFaultDropped
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
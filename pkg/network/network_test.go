@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestRouterRequiresToken(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	addr, err := startRouter("secret")
+	if err != nil {
+		t.Fatalf("start router error: %v", err)
+	}
+	for _, tc := range []struct {
+		user   *url.Userinfo
+		status int
+	}{
+		{user: nil, status: http.StatusProxyAuthRequired},
+		{user: url.UserPassword(routerUser, "wrong"), status: http.StatusProxyAuthRequired},
+		{user: url.UserPassword(routerUser, "secret"), status: http.StatusNoContent},
+	} {
+		proxyURL := &url.URL{Scheme: "http", User: tc.user, Host: addr}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		// the backend is on loopback, the request is sent to the router by an explicit proxy
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatalf("get through router error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("user %v: status %d, expected %d", tc.user, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestRouteFreeNoProxy(t *testing.T) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	defer func(n string, h map[string]string, p map[string]*url.URL) {
+		noProxy, hosts, proxies = n, h, p
+	}(noProxy, hosts, proxies)
+
+	noProxy = "internal.example.com, .corp.example.com,10.0.0.0/8,harbor.example.com"
+	hosts = map[string]string{"harbor.example.com": "10.0.1.10"}
+	proxies = map[string]*url.URL{"registry.corp.example.com:5000": nil}
+	if kept := routeFreeNoProxy(); kept != "internal.example.com,10.0.0.0/8" {
+		t.Errorf("kept NO_PROXY is %q", kept)
+	}
+}
+
+func TestTriggerFaultRate(t *testing.T) {
+	faultMutex.Lock()
+	faults = []*fault{
+		// almost never triggered by its rate, the next fault is checked then
+		{Fault: Fault{Status: http.StatusInternalServerError, Rate: 1e-12}, path: regexp.MustCompile("/blobs/")},
+		{Fault: Fault{Status: http.StatusServiceUnavailable}, path: regexp.MustCompile("/blobs/")},
+	}
+	faultMutex.Unlock()
+	defer func() {
+		faultMutex.Lock()
+		faults = nil
+		faultMutex.Unlock()
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "http://registry.example.com/v2/app/blobs/sha256:1", nil)
+	f := triggerFault(req)
+	if f == nil || f.Status != http.StatusServiceUnavailable {
+		t.Fatalf("triggered fault %v, expected the one of status %d", f, http.StatusServiceUnavailable)
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://registry.example.com/v2/app/manifests/v1", nil)
+	if f := triggerFault(req); f != nil {
+		t.Errorf("fault %v triggered by a request not matching its path", f)
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package progress
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of a progress event
+type EventType int
+
+const (
+	// PairDiscovered is emitted when a source/target url pair with tag is generated
+	PairDiscovered EventType = iota
+	// JobQueued is emitted when a transfer job is put to the job channel
+	JobQueued
+	// JobStarted is emitted when a worker begins to run a transfer job
+	JobStarted
+	// JobSucceeded is emitted when a transfer job finished without error
+	JobSucceeded
+	// JobFailed is emitted when a transfer job returned an error
+	JobFailed
+	// JobRetried is emitted when a failed transfer job is queued again
+	JobRetried
+	// BlobStarted is emitted before a blob is copied, Size may be -1 if unknown
+	BlobStarted
+	// BlobBytes is emitted while a blob is copied, Size is the number of new bytes
+	BlobBytes
+	// BlobFinished is emitted when a blob is copied to target
+	BlobFinished
+	// BlobSkipped is emitted when a blob already exists in target
+	BlobSkipped
+	// BlobAborted is emitted when copying a blob failed
+	BlobAborted
+)
+
+// Event is a progress event emitted by transfer jobs and client pipeline stages
+type Event struct {
+	Type EventType
+	// Job is the source image url with tag of the pair or job the event belongs to
+	Job string
+	// Target is the target image url with tag, it is set for PairDiscovered and the events of jobs,
+	// a source image may be transferred to several targets at the same time
+	Target string
+	// Name is the blob digest of blob events
+	Name string
+	Size int64
+}
+
+// Reporter receives progress events
+type Reporter interface {
+	Emit(ev Event)
+}
+
+// Snapshot is a point in time view of a Tracker
+type Snapshot struct {
+	Pairs       int64 `json:"pairs"`
+	Queued      int64 `json:"queued"`
+	Running     int64 `json:"running"`
+	Succeeded   int64 `json:"succeeded"`
+	Failed      int64 `json:"failed"`
+	BlobsCopied int64 `json:"blobsCopied"`
+	BlobsSkip   int64 `json:"blobsSkipped"`
+	BytesCopied int64 `json:"bytesCopied"`
+	// BytesTotal is the sum of the known sizes of blobs started so far
+	BytesTotal int64         `json:"bytesTotal"`
+	Elapsed    time.Duration `json:"elapsed"`
+	Active     []BlobState   `json:"active,omitempty"`
+}
+
+// BlobState is the copy state of an in-flight blob
+type BlobState struct {
+	Digest string `json:"digest"`
+	Copied int64  `json:"copied"`
+	Size   int64  `json:"size"`
+}
+
+// Tracker counts progress events, it is safe for concurrent use
+type Tracker struct {
+	pairs       int64
+	queued      int64
+	running     int64
+	succeeded   int64
+	failed      int64
+	blobsCopied int64
+	blobsSkip   int64
+	bytesCopied int64
+	bytesTotal  int64
+
+	start time.Time
+
+	activeMutex sync.Mutex
+	// active is keyed by target and blob digest
+	active map[string]*BlobState
+}
+
+var _ Reporter = &Tracker{}
+
+// NewTracker creates a Tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		start:  time.Now(),
+		active: make(map[string]*BlobState),
+	}
+}
+
+// Emit records a progress event
+func (t *Tracker) Emit(ev Event) {
+	switch ev.Type {
+	case PairDiscovered:
+		atomic.AddInt64(&t.pairs, 1)
+	case JobQueued:
+		atomic.AddInt64(&t.queued, 1)
+	case JobStarted:
+		atomic.AddInt64(&t.queued, -1)
+		atomic.AddInt64(&t.running, 1)
+	case JobSucceeded:
+		atomic.AddInt64(&t.running, -1)
+		atomic.AddInt64(&t.succeeded, 1)
+	case JobFailed:
+		atomic.AddInt64(&t.running, -1)
+		atomic.AddInt64(&t.failed, 1)
+	case JobRetried:
+		atomic.AddInt64(&t.failed, -1)
+		atomic.AddInt64(&t.queued, 1)
+	case BlobStarted:
+		if ev.Size > 0 {
+			atomic.AddInt64(&t.bytesTotal, ev.Size)
+		}
+		t.activeMutex.Lock()
+		t.active[blobKey(ev)] = &BlobState{Digest: ev.Name, Size: ev.Size}
+		t.activeMutex.Unlock()
+	case BlobBytes:
+		atomic.AddInt64(&t.bytesCopied, ev.Size)
+		t.activeMutex.Lock()
+		if b, ok := t.active[blobKey(ev)]; ok {
+			b.Copied += ev.Size
+		}
+		t.activeMutex.Unlock()
+	case BlobFinished:
+		atomic.AddInt64(&t.blobsCopied, 1)
+		t.activeMutex.Lock()
+		delete(t.active, blobKey(ev))
+		t.activeMutex.Unlock()
+	case BlobSkipped:
+		atomic.AddInt64(&t.blobsSkip, 1)
+	case BlobAborted:
+		t.activeMutex.Lock()
+		if b, ok := t.active[blobKey(ev)]; ok && b.Size > 0 {
+			atomic.AddInt64(&t.bytesTotal, -b.Size)
+			atomic.AddInt64(&t.bytesCopied, -b.Copied)
+		}
+		delete(t.active, blobKey(ev))
+		t.activeMutex.Unlock()
+	}
+}
+
+// blobKey identifies a blob copy of a job, a blob may be copied to several targets at the same time
+func blobKey(ev Event) string {
+	return ev.Target + "@" + ev.Name
+}
+
+// Snapshot returns the current counters of the Tracker
+func (t *Tracker) Snapshot() Snapshot {
+	s := Snapshot{
+		Pairs:       atomic.LoadInt64(&t.pairs),
+		Queued:      atomic.LoadInt64(&t.queued),
+		Running:     atomic.LoadInt64(&t.running),
+		Succeeded:   atomic.LoadInt64(&t.succeeded),
+		Failed:      atomic.LoadInt64(&t.failed),
+		BlobsCopied: atomic.LoadInt64(&t.blobsCopied),
+		BlobsSkip:   atomic.LoadInt64(&t.blobsSkip),
+		BytesCopied: atomic.LoadInt64(&t.bytesCopied),
+		BytesTotal:  atomic.LoadInt64(&t.bytesTotal),
+		Elapsed:     time.Since(t.start),
+	}
+
+	t.activeMutex.Lock()
+	for _, b := range t.active {
+		s.Active = append(s.Active, *b)
+	}
+	t.activeMutex.Unlock()
+
+	return s
+}
+
+// Throughput returns the average bytes per second since the tracker started
+func (s Snapshot) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.BytesCopied) / s.Elapsed.Seconds()
+}
+
+// ETA estimates the remaining time of the blobs started so far, returns -1 if unknown
+func (s Snapshot) ETA() time.Duration {
+	rate := s.Throughput()
+	remaining := s.BytesTotal - s.BytesCopied
+	if rate <= 0 || remaining <= 0 {
+		return -1
+	}
+	return time.Duration(float64(remaining)/rate) * time.Second
+}
+
+// Multi sends events to all of its reporters
+type Multi []Reporter
+
+// Emit implements Reporter
+func (m Multi) Emit(ev Event) {
+	for _, r := range m {
+		r.Emit(ev)
+	}
+}
+
+// NewReader wraps a blob stream and emits BlobBytes events for every read,
+// ev is the template of emitted events. If r is nil, rc is returned as is.
+func NewReader(rc io.ReadCloser, r Reporter, ev Event) io.ReadCloser {
+	if r == nil {
+		return rc
+	}
+	ev.Type = BlobBytes
+	return &countingReader{ReadCloser: rc, reporter: r, ev: ev}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	reporter Reporter
+	ev       Event
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		ev := c.ev
+		ev.Size = int64(n)
+		c.reporter.Emit(ev)
+	}
+	return n, err
+}
@@ -0,0 +1,49 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package progress
+
+import "testing"
+
+func TestTrackerBlobOfSeveralTargets(t *testing.T) {
+	tracker := NewTracker()
+	const source, digest = "registry.example.com/app:v1", "sha256:1"
+	a := Event{Job: source, Target: "a.example.com/app:v1", Name: digest}
+	b := Event{Job: source, Target: "b.example.com/app:v1", Name: digest}
+
+	for _, ev := range []Event{a, b} {
+		ev.Type, ev.Size = BlobStarted, 100
+		tracker.Emit(ev)
+		ev.Type, ev.Size = BlobBytes, 40
+		tracker.Emit(ev)
+	}
+	a.Type = BlobFinished
+	tracker.Emit(a)
+	if s := tracker.Snapshot(); len(s.Active) != 1 || s.Active[0].Copied != 40 {
+		t.Fatalf("active blobs after one target finished: %+v", s.Active)
+	}
+
+	// the aborted copy of one target rolls back its own bytes only
+	b.Type = BlobAborted
+	tracker.Emit(b)
+	s := tracker.Snapshot()
+	if len(s.Active) != 0 || s.BytesCopied != 40 || s.BytesTotal != 100 {
+		t.Errorf("snapshot after one target aborted: active %d, copied %d, total %d", len(s.Active),
+			s.BytesCopied, s.BytesTotal)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// ModeAuto renders a tty view if stderr is a terminal, summary lines otherwise
+	ModeAuto = "auto"
+	// ModeTTY always renders the tty view
+	ModeTTY = "tty"
+	// ModePlain logs periodic summary lines
+	ModePlain = "plain"
+	// ModeNone disables progress output
+	ModeNone = "none"
+
+	// max in-flight blobs shown in the tty view
+	maxActiveLines = 10
+	ttyInterval    = 500 * time.Millisecond
+)
+
+// Printer periodically renders the state of a Tracker
+type Printer struct {
+	tracker  *Tracker
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+
+	lines    int
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewPrinter creates a Printer for mode, it returns nil if mode is ModeNone.
+// interval is the period of summary lines in plain mode.
+func NewPrinter(t *Tracker, mode string, interval time.Duration) (*Printer, error) {
+	p := &Printer{
+		tracker:  t,
+		out:      os.Stderr,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+	}
+
+	switch mode {
+	case ModeNone:
+		return nil, nil
+	case ModeAuto, "":
+		p.tty = isTerminal(os.Stderr)
+	case ModeTTY:
+		p.tty = true
+	case ModePlain:
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q, must be one of auto, tty, plain, none", mode)
+	}
+
+	if p.tty {
+		p.interval = ttyInterval
+	}
+	if p.interval <= 0 {
+		return nil, fmt.Errorf("progress interval must be positive")
+	}
+	return p, nil
+}
+
+// Start renders progress in background until Stop is called
+func (p *Printer) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render()
+			case <-p.stopCh:
+				p.render()
+				return
+			}
+		}
+	}()
+}
+
+// Stop renders the final state and stops the background loop
+func (p *Printer) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+	p.wg.Wait()
+}
+
+func (p *Printer) render() {
+	s := p.tracker.Snapshot()
+	if !p.tty {
+		log.Infof("Progress: %s", summary(s))
+		return
+	}
+
+	var b strings.Builder
+	// move cursor to the beginning of the previous frame and clear it
+	if p.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA\033[J", p.lines)
+	}
+	lines := []string{summary(s)}
+
+	sort.Slice(s.Active, func(i, j int) bool { return s.Active[i].Digest < s.Active[j].Digest })
+	for i, blob := range s.Active {
+		if i == maxActiveLines {
+			lines = append(lines, fmt.Sprintf("  ... and %d more blobs", len(s.Active)-maxActiveLines))
+			break
+		}
+		lines = append(lines, "  "+blobLine(blob))
+	}
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteString("\n")
+	}
+	p.lines = len(lines)
+
+	fmt.Fprint(p.out, b.String())
+}
+
+func summary(s Snapshot) string {
+	eta := "unknown"
+	if d := s.ETA(); d >= 0 {
+		eta = d.String()
+	}
+	return fmt.Sprintf("pairs %d | jobs queued %d running %d done %d failed %d | blobs copied %d skipped %d | %s/%s | %s/s | elapsed %s | eta %s",
+		s.Pairs, s.Queued, s.Running, s.Succeeded, s.Failed, s.BlobsCopied, s.BlobsSkip,
+		HumanBytes(s.BytesCopied), HumanBytes(s.BytesTotal), HumanBytes(int64(s.Throughput())),
+		s.Elapsed.Truncate(time.Second), eta)
+}
+
+func blobLine(b BlobState) string {
+	digest := b.Digest
+	if i := strings.Index(digest, ":"); i >= 0 && len(digest) > i+13 {
+		digest = digest[i+1 : i+13]
+	}
+	if b.Size <= 0 {
+		return fmt.Sprintf("%s %s", digest, HumanBytes(b.Copied))
+	}
+	return fmt.Sprintf("%s %s/%s %3.0f%%", digest, HumanBytes(b.Copied), HumanBytes(b.Size),
+		float64(b.Copied)*100/float64(b.Size))
+}
+
+// HumanBytes formats a byte count like 1.5MiB
+func HumanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
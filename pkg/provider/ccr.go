@@ -0,0 +1,167 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/apis/ccrapis"
+)
+
+// ccr api page size
+const ccrPageSize = int64(100)
+
+// CCR is the provider of tencent cloud ccr personal edition of a region
+type CCR struct {
+	client    *ccrapis.CCRAPIClient
+	secretID  string
+	secretKey string
+	region    string
+}
+
+// NewCCR creates the provider of ccr in region
+func NewCCR(secretID, secretKey, region string) *CCR {
+	return &CCR{
+		client:    ccrapis.NewCCRAPIClient(),
+		secretID:  secretID,
+		secretKey: secretKey,
+		region:    region,
+	}
+}
+
+// Registry returns the ccr domain of the region
+func (p *CCR) Registry() string {
+	return ccrapis.RegionPrefix[p.region] + ".ccs.tencentyun.com"
+}
+
+// ListNamespaces lists all ccr namespaces, ccr sets visibility by repo so namespaces are not public
+func (p *CCR) ListNamespaces(ctx context.Context) ([]Namespace, error) {
+	var namespaces []Namespace
+	for offset := int64(0); ; offset += ccrPageSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resp, err := p.client.DescribeNamespacePersonal(p.secretID, p.secretKey, p.region, offset, ccrPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("list ccr namespaces error: %v", err)
+		}
+		for _, ns := range resp.Response.Data.NamespaceInfo {
+			if ns.Namespace != nil {
+				namespaces = append(namespaces, Namespace{Name: *ns.Namespace})
+			}
+		}
+		if len(resp.Response.Data.NamespaceInfo) == 0 || offset+ccrPageSize >= *resp.Response.Data.NamespaceCount {
+			return namespaces, nil
+		}
+	}
+}
+
+// ListRepositories lists ccr repos under namespace, or all repos of the account
+func (p *CCR) ListRepositories(ctx context.Context, namespace string) ([]string, error) {
+	var repos []string
+	for offset := int64(0); ; offset += ccrPageSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resp, err := p.client.DescribeRepositoryOwnerPersonal(p.secretID, p.secretKey, p.region, offset, ccrPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("list ccr repos offset %d error: %v", offset, err)
+		}
+		for _, repo := range resp.Response.Data.RepoInfo {
+			if repo.RepoName != nil && underNamespace(*repo.RepoName, namespace) {
+				repos = append(repos, *repo.RepoName)
+			}
+		}
+		if len(resp.Response.Data.RepoInfo) == 0 || offset+ccrPageSize >= *resp.Response.Data.TotalCount {
+			return repos, nil
+		}
+	}
+}
+
+// ListTags lists tags of a ccr repo with their push time
+func (p *CCR) ListTags(ctx context.Context, repository string) ([]Tag, error) {
+	var tags []Tag
+	for offset := int64(0); ; offset += ccrPageSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resp, err := p.client.DescribeImagePersonal(p.secretID, p.secretKey, p.region, repository, offset, ccrPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Response == nil || resp.Response.Data == nil || resp.Response.Data.TagCount == nil {
+			return nil, fmt.Errorf("DescribeImagePersonal resp is nil")
+		}
+		for _, info := range resp.Response.Data.TagInfo {
+			if info.TagName != nil {
+				tags = append(tags, Tag{Name: *info.TagName, PushTime: parseTime(info.PushTime)})
+			}
+		}
+		if len(resp.Response.Data.TagInfo) == 0 || offset+ccrPageSize >= *resp.Response.Data.TagCount {
+			return tags, nil
+		}
+	}
+}
+
+// CreateNamespace creates a ccr namespace, public is ignored since ccr sets visibility by repo
+func (p *CCR) CreateNamespace(ctx context.Context, namespace string, public bool) error {
+	_, err := p.client.CreateNamespacePersonal(p.secretID, p.secretKey, p.region, namespace)
+	return err
+}
+
+// GetQuota gets the namespace and repo quota of the account and their usage
+func (p *CCR) GetQuota(ctx context.Context) (*Quota, error) {
+	quota := &Quota{NamespaceLimit: Unknown, RepoLimit: Unknown}
+	resp, err := p.client.DescribeUserQuotaPersonal(p.secretID, p.secretKey, p.region)
+	if err != nil {
+		return nil, fmt.Errorf("get ccr quota error: %v", err)
+	}
+	if resp.Response.Data != nil {
+		for _, limit := range resp.Response.Data.LimitInfo {
+			if limit.Type == nil || limit.Value == nil {
+				continue
+			}
+			switch *limit.Type {
+			case "namespace":
+				quota.NamespaceLimit = *limit.Value
+			case "repo":
+				quota.RepoLimit = *limit.Value
+			}
+		}
+	}
+
+	nsResp, err := p.client.DescribeNamespacePersonal(p.secretID, p.secretKey, p.region, 0, 1)
+	if err != nil {
+		return nil, fmt.Errorf("get ccr namespace count error: %v", err)
+	}
+	quota.NamespaceCount = *nsResp.Response.Data.NamespaceCount
+	repoResp, err := p.client.DescribeRepositoryOwnerPersonal(p.secretID, p.secretKey, p.region, 0, 1)
+	if err != nil {
+		return nil, fmt.Errorf("get ccr repo count error: %v", err)
+	}
+	quota.RepoCount = *repoResp.Response.Data.TotalCount
+	return quota, nil
+}
+
+// underNamespace reports whether repo is under namespace, any repo is under an empty namespace
+func underNamespace(repo, namespace string) bool {
+	return namespace == "" || strings.HasPrefix(repo, strings.TrimSuffix(namespace, "/")+"/")
+}
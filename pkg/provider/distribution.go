@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/registry"
+)
+
+// Distribution is the provider of a registry serving only the distribution api, like docker registry and quay
+type Distribution struct {
+	client *registry.Client
+	// registryType decides the api to list repositories
+	registryType string
+}
+
+// Registry returns the domain of the registry
+func (p *Distribution) Registry() string {
+	return p.client.Registry()
+}
+
+// ListNamespaces lists the namespaces of the repositories of the registry
+func (p *Distribution) ListNamespaces(ctx context.Context) ([]Namespace, error) {
+	repos, err := p.ListRepositories(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []Namespace
+	seen := make(map[string]bool)
+	for _, repo := range repos {
+		parts := strings.SplitN(repo, "/", 2)
+		if len(parts) != 2 || seen[parts[0]] {
+			continue
+		}
+		seen[parts[0]] = true
+		namespaces = append(namespaces, Namespace{Name: parts[0]})
+	}
+	return namespaces, nil
+}
+
+// ListRepositories lists repositories under namespace by the api of the registry type
+func (p *Distribution) ListRepositories(ctx context.Context, namespace string) ([]string, error) {
+	return p.client.ListRepositories(ctx, p.registryType, namespace)
+}
+
+// ListTags lists tags of repository by the tags list api, push times are unknown
+func (p *Distribution) ListTags(ctx context.Context, repository string) ([]Tag, error) {
+	names, err := p.client.Tags(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		tags = append(tags, Tag{Name: name})
+	}
+	return tags, nil
+}
+
+// CreateNamespace is not supported by the distribution api
+func (p *Distribution) CreateNamespace(ctx context.Context, namespace string, public bool) error {
+	return fmt.Errorf("creating namespace %s is not supported by registry %s", namespace, p.client.Registry())
+}
+
+// GetQuota returns an unknown quota, it is not provided by the distribution api
+func (p *Distribution) GetQuota(ctx context.Context) (*Quota, error) {
+	return &Quota{NamespaceLimit: Unknown, NamespaceCount: Unknown, RepoLimit: Unknown, RepoCount: Unknown}, nil
+}
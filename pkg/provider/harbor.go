@@ -0,0 +1,84 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provider
+
+import (
+	"context"
+
+	"tkestack.io/image-transfer/pkg/registry"
+)
+
+// Harbor is the provider of a harbor registry, namespaces are harbor projects
+type Harbor struct {
+	client *registry.Client
+}
+
+// Registry returns the domain of harbor
+func (p *Harbor) Registry() string {
+	return p.client.Registry()
+}
+
+// ListNamespaces lists the projects of harbor
+func (p *Harbor) ListNamespaces(ctx context.Context) ([]Namespace, error) {
+	projects, err := p.client.HarborProjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]Namespace, 0, len(projects))
+	for _, project := range projects {
+		namespaces = append(namespaces, Namespace{Name: project.Name, Public: project.Metadata.Public == "true"})
+	}
+	return namespaces, nil
+}
+
+// ListRepositories lists repositories of the project of namespace, or of all projects
+func (p *Harbor) ListRepositories(ctx context.Context, namespace string) ([]string, error) {
+	return p.client.HarborRepositories(ctx, namespace)
+}
+
+// ListTags lists tags of the artifacts of repository with their push time
+func (p *Harbor) ListTags(ctx context.Context, repository string) ([]Tag, error) {
+	harborTags, err := p.client.HarborTags(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]Tag, 0, len(harborTags))
+	for _, tag := range harborTags {
+		tags = append(tags, Tag{Name: tag.Name, PushTime: tag.PushTime})
+	}
+	return tags, nil
+}
+
+// CreateNamespace creates a harbor project
+func (p *Harbor) CreateNamespace(ctx context.Context, namespace string, public bool) error {
+	return p.client.CreateHarborProject(ctx, namespace, public)
+}
+
+// GetQuota gets the number of projects and repositories, harbor limits storage only so limits are unknown
+func (p *Harbor) GetQuota(ctx context.Context) (*Quota, error) {
+	projects, err := p.client.HarborProjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	quota := &Quota{NamespaceLimit: Unknown, NamespaceCount: int64(len(projects)), RepoLimit: Unknown}
+	for _, project := range projects {
+		quota.RepoCount += project.RepoCount
+	}
+	return quota, nil
+}
@@ -0,0 +1,122 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+// Package provider abstracts the apis of registries to discover and create namespaces, repositories and tags
+package provider
+
+import (
+	"context"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/registry"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// Unknown is the value of a quota which is not provided by the registry
+const Unknown = -1
+
+// RegistryProvider discovers and creates namespaces, repositories and tags of a registry by its api
+type RegistryProvider interface {
+	// Registry returns the domain images of the registry are pulled from and pushed to
+	Registry() string
+	// ListNamespaces lists all namespaces of the registry
+	ListNamespaces(ctx context.Context) ([]Namespace, error)
+	// ListRepositories lists repositories under namespace, all repositories are listed if namespace is empty.
+	// Names contain their namespace
+	ListRepositories(ctx context.Context, namespace string) ([]string, error)
+	// ListTags lists tags of repository namespace/repo in the order returned by the api
+	ListTags(ctx context.Context, repository string) ([]Tag, error)
+	// CreateNamespace creates a namespace
+	CreateNamespace(ctx context.Context, namespace string, public bool) error
+	// GetQuota gets the quota and usage of namespaces and repositories
+	GetQuota(ctx context.Context) (*Quota, error)
+}
+
+// Namespace is a namespace of a registry, like a harbor project
+type Namespace struct {
+	Name   string
+	Public bool
+}
+
+// Tag is a tag of a repository, PushTime is zero if it is not provided by the registry
+type Tag struct {
+	Name     string
+	PushTime time.Time
+}
+
+// Quota is the quota and usage of a registry, a field is Unknown if it is not provided
+type Quota struct {
+	NamespaceLimit int64
+	NamespaceCount int64
+	RepoLimit      int64
+	RepoCount      int64
+}
+
+// New creates the provider of a registry accessed by the registry api, the type of the registry
+// is detected if it is not set in security
+func New(ctx context.Context, host string, security configs.Security) (RegistryProvider, error) {
+	client, err := transfer.NewRegistryClient(host, security)
+	if err != nil {
+		return nil, err
+	}
+	registryType := security.Type
+	if registryType == "" {
+		registryType = client.DetectType(ctx)
+		log.Debugf("Detected type of registry %s: %s", host, registryType)
+	}
+	if registryType == registry.TypeHarbor {
+		return &Harbor{client: client}, nil
+	}
+	return &Distribution{client: client, registryType: registryType}, nil
+}
+
+// TagNames returns the names of tags
+func TagNames(tags []Tag) []string {
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	return names
+}
+
+// NamespaceNames returns the names of namespaces
+func NamespaceNames(namespaces []Namespace) []string {
+	names := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		names = append(names, ns.Name)
+	}
+	return names
+}
+
+// parseTime parses a time returned by tencent cloud api, zero time is returned if it is empty or invalid
+func parseTime(value *string) time.Time {
+	if value == nil || *value == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, *value); err == nil {
+		return t
+	}
+	// times without zone are in china standard time
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", *value, time.FixedZone("CST", 8*3600)); err == nil {
+		return t
+	}
+	log.Debugf("unknown time format %s", *value)
+	return time.Time{}
+}
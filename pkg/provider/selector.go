@@ -0,0 +1,87 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// TagSelector selects tags of a repository by their push time, all tags are selected if it is empty
+type TagSelector struct {
+	// PushedAfter selects tags pushed after it, no limit if zero
+	PushedAfter time.Time
+	// KeepLatest keeps the most recently pushed tags, no limit if zero
+	KeepLatest int
+}
+
+// NewTagSelector creates a TagSelector of tags pushed within the last days and after the date,
+// the later one is used if both are set. date is like 2006-01-02 in local time or in RFC3339 format
+func NewTagSelector(withinDays int, after string, keepLatest int) (TagSelector, error) {
+	var selector TagSelector
+	if withinDays < 0 {
+		return selector, fmt.Errorf("invalid days %d, should not be negative", withinDays)
+	}
+	if keepLatest < 0 {
+		return selector, fmt.Errorf("invalid number of latest tags %d, should not be negative", keepLatest)
+	}
+	selector.KeepLatest = keepLatest
+
+	if withinDays > 0 {
+		selector.PushedAfter = time.Now().AddDate(0, 0, -withinDays)
+	}
+	if after != "" {
+		date, err := time.ParseInLocation("2006-01-02", after, time.Local)
+		if err != nil {
+			if date, err = time.Parse(time.RFC3339, after); err != nil {
+				return selector, fmt.Errorf("invalid date %s, should be like 2006-01-02 or 2006-01-02T15:04:05+08:00", after)
+			}
+		}
+		if date.After(selector.PushedAfter) {
+			selector.PushedAfter = date
+		}
+	}
+	return selector, nil
+}
+
+// IsEmpty reports whether all tags are selected
+func (s TagSelector) IsEmpty() bool {
+	return s.PushedAfter.IsZero() && s.KeepLatest == 0
+}
+
+// Select returns the selected tags, the most recently pushed first if KeepLatest is set.
+// Tags without push time are not filtered by PushedAfter and are ranked after the others
+func (s TagSelector) Select(tags []Tag) []Tag {
+	selected := make([]Tag, 0, len(tags))
+	for _, tag := range tags {
+		if s.PushedAfter.IsZero() || tag.PushTime.IsZero() || tag.PushTime.After(s.PushedAfter) {
+			selected = append(selected, tag)
+		}
+	}
+	if s.KeepLatest > 0 {
+		sort.SliceStable(selected, func(i, j int) bool {
+			return selected[i].PushTime.After(selected[j].PushTime)
+		})
+		if len(selected) > s.KeepLatest {
+			selected = selected[:s.KeepLatest]
+		}
+	}
+	return selected
+}
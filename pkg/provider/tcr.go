@@ -0,0 +1,187 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"tkestack.io/image-transfer/pkg/apis/tcrapis"
+)
+
+// TCRDomainSuffix is the domain suffix of tcr instances, the instance name is the first label
+const TCRDomainSuffix = ".tencentcloudcr.com"
+
+// tcr api page size, offset of tcr api is the page number from 1
+const tcrPageSize = int64(100)
+
+// TCR is the provider of a tencent cloud tcr enterprise instance
+type TCR struct {
+	client    *tcrapis.TCRAPIClient
+	name      string
+	region    string
+	secretID  string
+	secretKey string
+
+	mutex sync.Mutex
+	id    string
+}
+
+// NewTCR creates the provider of tcr instance name, its id is looked up by name if id is empty
+func NewTCR(name, id, region, secretID, secretKey string) *TCR {
+	return &TCR{
+		client:    tcrapis.NewTCRAPIClient(),
+		name:      name,
+		id:        id,
+		region:    region,
+		secretID:  secretID,
+		secretKey: secretKey,
+	}
+}
+
+// ID returns the id of the instance, it is looked up once by name
+func (p *TCR) ID() (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.id != "" {
+		return p.id, nil
+	}
+	id, err := p.client.GetInstanceID(p.secretID, p.secretKey, p.region, p.name)
+	if err != nil {
+		return "", err
+	}
+	p.id = id
+	return id, nil
+}
+
+// Registry returns the domain of the instance
+func (p *TCR) Registry() string {
+	return p.name + TCRDomainSuffix
+}
+
+// ListNamespaces lists all namespaces of the instance with their visibility
+func (p *TCR) ListNamespaces(ctx context.Context) ([]Namespace, error) {
+	id, err := p.ID()
+	if err != nil {
+		return nil, err
+	}
+	nsList, err := p.client.GetAllNamespaces(p.secretID, p.secretKey, p.region, id)
+	if err != nil {
+		return nil, fmt.Errorf("list namespaces of tcr %s error: %v", id, err)
+	}
+	namespaces := make([]Namespace, 0, len(nsList))
+	for _, ns := range nsList {
+		if ns.Name != nil {
+			namespaces = append(namespaces, Namespace{Name: *ns.Name, Public: ns.Public != nil && *ns.Public})
+		}
+	}
+	return namespaces, nil
+}
+
+// ListRepositories lists repositories under namespace, or of all namespaces of the instance
+func (p *TCR) ListRepositories(ctx context.Context, namespace string) ([]string, error) {
+	id, err := p.ID()
+	if err != nil {
+		return nil, err
+	}
+	var nsNames []string
+	if namespace != "" {
+		nsNames = []string{strings.SplitN(namespace, "/", 2)[0]}
+	} else {
+		namespaces, err := p.ListNamespaces(ctx)
+		if err != nil {
+			return nil, err
+		}
+		nsNames = NamespaceNames(namespaces)
+	}
+
+	var repos []string
+	for _, ns := range nsNames {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		names, err := p.client.GetAllRepositories(p.secretID, p.secretKey, p.region, id, ns)
+		if err != nil {
+			return nil, fmt.Errorf("list repos of tcr namespace %s error: %v", ns, err)
+		}
+		for _, name := range names {
+			if repo := ns + "/" + name; underNamespace(repo, namespace) {
+				repos = append(repos, repo)
+			}
+		}
+	}
+	return repos, nil
+}
+
+// ListTags lists tags of repository namespace/repo, the update time of an image is its push time
+func (p *TCR) ListTags(ctx context.Context, repository string) ([]Tag, error) {
+	id, err := p.ID()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("tcr repository %s should be in the form of namespace/repo", repository)
+	}
+
+	var tags []Tag
+	for page := int64(1); ; page++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resp, err := p.client.DescribeImages(p.secretID, p.secretKey, p.region, id, parts[0], parts[1], page, tcrPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range resp.Response.ImageInfoList {
+			if info.ImageVersion != nil {
+				tags = append(tags, Tag{Name: *info.ImageVersion, PushTime: parseTime(info.UpdateTime)})
+			}
+		}
+		if len(resp.Response.ImageInfoList) == 0 || page*tcrPageSize >= *resp.Response.TotalCount {
+			return tags, nil
+		}
+	}
+}
+
+// CreateNamespace creates a namespace of the instance
+func (p *TCR) CreateNamespace(ctx context.Context, namespace string, public bool) error {
+	id, err := p.ID()
+	if err != nil {
+		return err
+	}
+	_, err = p.client.CreateNamespace(p.secretID, p.secretKey, p.region, id, namespace, public)
+	return err
+}
+
+// GetQuota gets the number of namespaces, the quota of an instance is not provided by the api
+func (p *TCR) GetQuota(ctx context.Context) (*Quota, error) {
+	namespaces, err := p.ListNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Quota{
+		NamespaceLimit: Unknown,
+		NamespaceCount: int64(len(namespaces)),
+		RepoLimit:      Unknown,
+		RepoCount:      Unknown,
+	}, nil
+}
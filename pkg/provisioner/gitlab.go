@@ -0,0 +1,78 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// gitlab creates gitlab groups with a personal or group access token, the api of gitlab is
+// usually served on another host than its registry so apiURL is required
+type gitlab struct {
+	api    *apiClient
+	public bool
+}
+
+func newGitLab(registry string, security configs.Security, secret map[string]configs.Secret) (Provisioner, error) {
+	conf := security.NamespaceProvisioner
+	if conf.APIURL == "" || conf.Token == "" {
+		return nil, fmt.Errorf("apiURL and token of gitlab api of %s should be set", registry)
+	}
+	api, err := newAPIClient(registry, security)
+	if err != nil {
+		return nil, err
+	}
+	api.header.Set("PRIVATE-TOKEN", conf.Token)
+	return &gitlab{api: api, public: conf.Public}, nil
+}
+
+// EnsureNamespace creates the top level gitlab group of namespace
+func (g *gitlab) EnsureNamespace(ctx context.Context, namespace string) error {
+	code, err := g.api.do(ctx, http.MethodGet, "/api/v4/groups/"+url.PathEscape(namespace), nil)
+	if err != nil {
+		return fmt.Errorf("check gitlab group %s error: %v", namespace, err)
+	}
+	if code == http.StatusOK {
+		return nil
+	}
+
+	visibility := "private"
+	if g.public {
+		visibility = "public"
+	}
+	log.Infof("Create gitlab group %s, visibility: %s", namespace, visibility)
+	code, err = g.api.do(ctx, http.MethodPost, "/api/v4/groups", map[string]string{
+		"name":       namespace,
+		"path":       namespace,
+		"visibility": visibility,
+	})
+	if err != nil {
+		return fmt.Errorf("create gitlab group %s error: %v", namespace, err)
+	}
+	if code != http.StatusCreated {
+		return fmt.Errorf("create gitlab group %s error: unexpected status code %d", namespace, code)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// harbor creates harbor projects with the username and password of security
+type harbor struct {
+	api    *apiClient
+	public bool
+}
+
+func newHarbor(registry string, security configs.Security, secret map[string]configs.Secret) (Provisioner, error) {
+	api, err := newAPIClient(registry, security)
+	if err != nil {
+		return nil, err
+	}
+	return &harbor{api: api, public: security.NamespaceProvisioner.Public}, nil
+}
+
+// EnsureNamespace creates the harbor project of namespace
+func (h *harbor) EnsureNamespace(ctx context.Context, namespace string) error {
+	code, err := h.api.do(ctx, http.MethodHead, "/api/v2.0/projects?project_name="+url.QueryEscape(namespace), nil)
+	if err != nil {
+		return fmt.Errorf("check harbor project %s error: %v", namespace, err)
+	}
+	if code == http.StatusOK {
+		return nil
+	}
+
+	log.Infof("Create harbor project %s, public: %t", namespace, h.public)
+	code, err = h.api.do(ctx, http.MethodPost, "/api/v2.0/projects", map[string]interface{}{
+		"project_name": namespace,
+		"metadata":     map[string]string{"public": strconv.FormatBool(h.public)},
+	})
+	if err != nil {
+		return fmt.Errorf("create harbor project %s error: %v", namespace, err)
+	}
+	// conflict means it is created by someone else meanwhile
+	if code != http.StatusCreated && code != http.StatusConflict {
+		return fmt.Errorf("create harbor project %s error: unexpected status code %d", namespace, code)
+	}
+	return nil
+}
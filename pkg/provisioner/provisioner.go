@@ -0,0 +1,140 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+// Package provisioner creates the missing namespaces of target registries before images are pushed
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/registry"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// Provisioner creates namespaces of a registry, like harbor projects or gitlab groups
+type Provisioner interface {
+	// EnsureNamespace creates namespace if it does not exist
+	EnsureNamespace(ctx context.Context, namespace string) error
+}
+
+// Factory creates the Provisioner of a registry from its security and the tencent cloud secret
+type Factory func(registry string, security configs.Security, secret map[string]configs.Secret) (Provisioner, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+func init() {
+	Register(registry.TypeTCR, newTCR)
+	Register(registry.TypeHarbor, newHarbor)
+	Register(registry.TypeQuay, newQuay)
+	Register(registry.TypeGitLab, newGitLab)
+}
+
+// Register makes a provisioner available by name in security file
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[name] = factory
+}
+
+// New creates the Provisioner configured in security of registry, nil is returned if none is configured
+func New(registry string, security configs.Security, secret map[string]configs.Secret) (Provisioner, error) {
+	conf := security.NamespaceProvisioner
+	if conf == nil {
+		return nil, nil
+	}
+	name := conf.Type
+	if name == "" {
+		name = security.Type
+	}
+	if name == "" {
+		return nil, fmt.Errorf("type of namespace provisioner of %s is not set", registry)
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown namespace provisioner %s of %s", name, registry)
+	}
+	return factory(registry, security, secret)
+}
+
+// apiClient sends requests to the management api of a registry, with the tls settings of the registry
+type apiClient struct {
+	client *registry.Client
+	// apiURL is the address of the api, requests are sent to the registry if empty
+	apiURL string
+	// header is set on every request, e.g. the token of the api
+	header http.Header
+}
+
+func newAPIClient(host string, security configs.Security) (*apiClient, error) {
+	client, err := transfer.NewRegistryClient(host, security)
+	if err != nil {
+		return nil, err
+	}
+	return &apiClient{
+		client: client,
+		apiURL: strings.TrimSuffix(security.NamespaceProvisioner.APIURL, "/"),
+		header: make(http.Header),
+	}, nil
+}
+
+// do sends a request with a json body if body is not nil, the response body is closed and its status code returned
+func (c *apiClient) do(ctx context.Context, method, path string, body interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.DoAPI(req)
+	if err != nil {
+		return 0, err
+	}
+	defer registry.DrainAndClose(resp)
+	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode != http.StatusNotFound &&
+		resp.StatusCode != http.StatusConflict {
+		return resp.StatusCode, registry.ResponseError(resp)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,67 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// quay creates quay organizations with an oauth token of the api
+type quay struct {
+	api *apiClient
+}
+
+func newQuay(registry string, security configs.Security, secret map[string]configs.Secret) (Provisioner, error) {
+	if security.NamespaceProvisioner.Token == "" {
+		return nil, fmt.Errorf("token of quay api of %s is not set", registry)
+	}
+	api, err := newAPIClient(registry, security)
+	if err != nil {
+		return nil, err
+	}
+	api.header.Set("Authorization", "Bearer "+security.NamespaceProvisioner.Token)
+	return &quay{api: api}, nil
+}
+
+// EnsureNamespace creates the quay organization of namespace, visibility of quay is set by repository
+func (q *quay) EnsureNamespace(ctx context.Context, namespace string) error {
+	code, err := q.api.do(ctx, http.MethodGet, "/api/v1/organization/"+url.PathEscape(namespace), nil)
+	if err != nil {
+		return fmt.Errorf("check quay organization %s error: %v", namespace, err)
+	}
+	if code == http.StatusOK {
+		return nil
+	}
+
+	log.Infof("Create quay organization %s", namespace)
+	code, err = q.api.do(ctx, http.MethodPost, "/api/v1/organization/", map[string]string{"name": namespace})
+	if err != nil {
+		return fmt.Errorf("create quay organization %s error: %v", namespace, err)
+	}
+	if code != http.StatusCreated && code != http.StatusOK {
+		return fmt.Errorf("create quay organization %s error: unexpected status code %d", namespace, code)
+	}
+	return nil
+}
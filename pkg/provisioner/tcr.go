@@ -0,0 +1,92 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/tcrapis"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/provider"
+)
+
+// tcr creates namespaces of a tcr instance by tencent cloud api
+type tcr struct {
+	provider *provider.TCR
+	public   bool
+}
+
+func newTCR(registry string, security configs.Security, secret map[string]configs.Secret) (Provisioner, error) {
+	conf := security.NamespaceProvisioner
+	secretID, secretKey, region := conf.SecretID, conf.SecretKey, conf.Region
+
+	if secretID == "" || secretKey == "" {
+		if id, key, err := tcrapis.GetTcrSecret(secret); err == nil {
+			secretID, secretKey = id, key
+		} else {
+			secretID, secretKey = os.Getenv("TENCENTCLOUD_SECRET_ID"), os.Getenv("TENCENTCLOUD_SECRET_KEY")
+		}
+	}
+	if secretID == "" || secretKey == "" {
+		return nil, fmt.Errorf("tencent cloud secret of tcr %s is not set", registry)
+	}
+
+	if region == "" && security.TokenProvider != nil {
+		region = security.TokenProvider.Region
+	}
+	if region == "" {
+		region = os.Getenv("TENCENTCLOUD_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("region of tcr %s is not set", registry)
+	}
+
+	host := strings.Split(registry, ":")[0]
+	if conf.InstanceID == "" && !strings.HasSuffix(host, provider.TCRDomainSuffix) {
+		return nil, fmt.Errorf("instanceId of tcr %s is not set", registry)
+	}
+	name := strings.TrimSuffix(host, provider.TCRDomainSuffix)
+	return &tcr{
+		provider: provider.NewTCR(name, conf.InstanceID, region, secretID, secretKey),
+		public:   conf.Public,
+	}, nil
+}
+
+// EnsureNamespace creates the tcr namespace if it does not exist
+func (p *tcr) EnsureNamespace(ctx context.Context, namespace string) error {
+	nsList, err := p.provider.ListNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ns := range nsList {
+		if ns.Name == namespace {
+			return nil
+		}
+	}
+
+	log.Infof("Create tcr namespace %s of %s, public: %t", namespace, p.provider.Registry(), p.public)
+	if err := p.provider.CreateNamespace(ctx, namespace, p.public); err != nil {
+		return fmt.Errorf("create tcr namespace %s error: %v", namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Types of registries, they decide the api used to list repositories
+const (
+	// TypeDistribution lists repositories by the _catalog api of distribution, e.g. docker registry and quay
+	TypeDistribution = "registry"
+	// TypeHarbor lists repositories by harbor project and repository apis
+	TypeHarbor = "harbor"
+	// TypeDockerHub lists repositories of an organization by docker hub api
+	TypeDockerHub = "dockerhub"
+	// TypeQuay, TypeGitLab and TypeTCR list repositories by the _catalog api
+	TypeQuay   = "quay"
+	TypeGitLab = "gitlab"
+	TypeTCR    = "tcr"
+)
+
+// page size of the listing apis
+const pageSize = 100
+
+// dockerHubAPI is the address of docker hub api
+const dockerHubAPI = "https://hub.docker.com"
+
+// linkRegexp matches the next page of a Link header like: </v2/_catalog?last=a&n=100>; rel="next"
+var linkRegexp = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// dockerHubRegistries are the registry names of docker hub
+var dockerHubRegistries = []string{"registry.hub.docker.com", "docker.io", "index.docker.io", "registry-1.docker.io"}
+
+// IsDockerHub reports whether registry is docker hub
+func IsDockerHub(registry string) bool {
+	for _, r := range dockerHubRegistries {
+		if registry == r {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectType detects the type of the registry of the client
+func (c *Client) DetectType(ctx context.Context) string {
+	if IsDockerHub(c.registry) {
+		return TypeDockerHub
+	}
+	if c.IsHarbor(ctx) {
+		return TypeHarbor
+	}
+	return TypeDistribution
+}
+
+// IsHarbor reports whether the registry of the client serves harbor api
+func (c *Client) IsHarbor(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/api/v2.0/systeminfo", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.DoAPI(req)
+	if err != nil {
+		return false
+	}
+	defer DrainAndClose(resp)
+	return resp.StatusCode == http.StatusOK && strings.Contains(resp.Header.Get("Content-Type"), "json")
+}
+
+// ListRepositories lists repositories under namespace by the api of registry type,
+// all repositories of the registry are listed if namespace is empty. Names contain their namespace
+func (c *Client) ListRepositories(ctx context.Context, registryType, namespace string) ([]string, error) {
+	switch registryType {
+	case TypeDistribution, TypeQuay, TypeGitLab, TypeTCR:
+		return c.Catalog(ctx, namespace)
+	case TypeHarbor:
+		return c.HarborRepositories(ctx, namespace)
+	case TypeDockerHub:
+		return c.DockerHubRepositories(ctx, namespace)
+	}
+	return nil, fmt.Errorf("unknown registry type %s of %s", registryType, c.registry)
+}
+
+// Catalog lists repositories by the _catalog api, only those under namespace if it is not empty
+func (c *Client) Catalog(ctx context.Context, namespace string) ([]string, error) {
+	var repos []string
+	next := "/v2/_catalog?n=" + strconv.Itoa(pageSize)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.Do(req, "registry:catalog:*")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = ResponseError(resp)
+			DrainAndClose(resp)
+			return nil, fmt.Errorf("list catalog of %s error: %v", c.registry, err)
+		}
+		var body struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		DrainAndClose(resp)
+		if err != nil {
+			return nil, fmt.Errorf("decode catalog of %s error: %v", c.registry, err)
+		}
+		for _, repo := range body.Repositories {
+			if underNamespace(repo, namespace) {
+				repos = append(repos, repo)
+			}
+		}
+
+		next = ""
+		if m := linkRegexp.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = m[1]
+		}
+	}
+	return repos, nil
+}
+
+// Tags lists the tags of repository by the tags list api
+func (c *Client) Tags(ctx context.Context, repository string) ([]string, error) {
+	var tags []string
+	next := "/v2/" + repository + "/tags/list?n=" + strconv.Itoa(pageSize)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.Do(req, RepositoryScope(repository, "pull"))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = ResponseError(resp)
+			DrainAndClose(resp)
+			return nil, fmt.Errorf("list tags of %s/%s error: %v", c.registry, repository, err)
+		}
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		DrainAndClose(resp)
+		if err != nil {
+			return nil, fmt.Errorf("decode tags of %s/%s error: %v", c.registry, repository, err)
+		}
+		tags = append(tags, body.Tags...)
+
+		next = ""
+		if m := linkRegexp.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = m[1]
+		}
+	}
+	return tags, nil
+}
+
+// HarborRepositories lists repositories of the harbor project of namespace, or of all projects
+// if namespace is empty. namespace may be a path under the project
+func (c *Client) HarborRepositories(ctx context.Context, namespace string) ([]string, error) {
+	var projects []string
+	if namespace != "" {
+		projects = []string{strings.SplitN(namespace, "/", 2)[0]}
+	} else {
+		all, err := c.HarborProjects(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range all {
+			projects = append(projects, project.Name)
+		}
+	}
+
+	var repos []string
+	for _, project := range projects {
+		path := "/api/v2.0/projects/" + url.PathEscape(project) + "/repositories"
+		err := c.harborPages(ctx, path, func(data []byte) (int, error) {
+			var page []struct {
+				Name string `json:"name"`
+			}
+			if err := json.Unmarshal(data, &page); err != nil {
+				return 0, err
+			}
+			for _, repo := range page {
+				if underNamespace(repo.Name, namespace) {
+					repos = append(repos, repo.Name)
+				}
+			}
+			return len(page), nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list repositories of harbor project %s/%s error: %v", c.registry, project, err)
+		}
+	}
+	return repos, nil
+}
+
+// harborPages gets the pages of a harbor listing api, handle returns the number of items of a page
+func (c *Client) harborPages(ctx context.Context, path string, handle func([]byte) (int, error)) error {
+	for page := 1; ; page++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			fmt.Sprintf("%s?page=%d&page_size=%d", path, page, pageSize), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.DoAPI(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = ResponseError(resp)
+			DrainAndClose(resp)
+			return err
+		}
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(resp.Body)
+		DrainAndClose(resp)
+		if err != nil {
+			return err
+		}
+		n, err := handle(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		total, _ := strconv.Atoi(resp.Header.Get("X-Total-Count"))
+		if n < pageSize || (total > 0 && page*pageSize >= total) {
+			return nil
+		}
+	}
+}
+
+// DockerHubRepositories lists repositories of the docker hub organization or user namespace
+func (c *Client) DockerHubRepositories(ctx context.Context, namespace string) ([]string, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("namespace is required to list repositories of docker hub")
+	}
+	org := strings.SplitN(namespace, "/", 2)[0]
+
+	var authorization string
+	if c.credentials.Username != "" && c.credentials.Password != "" {
+		token, err := c.dockerHubLogin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		authorization = "JWT " + token
+	}
+
+	var repos []string
+	next := fmt.Sprintf("%s/v2/repositories/%s/?page_size=%d", dockerHubAPI, url.PathEscape(org), pageSize)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = ResponseError(resp)
+			DrainAndClose(resp)
+			return nil, fmt.Errorf("list docker hub repositories of %s error: %v", org, err)
+		}
+		var body struct {
+			Next    string `json:"next"`
+			Results []struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"results"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		DrainAndClose(resp)
+		if err != nil {
+			return nil, fmt.Errorf("decode docker hub repositories of %s error: %v", org, err)
+		}
+		for _, repo := range body.Results {
+			name := org + "/" + repo.Name
+			if underNamespace(name, namespace) {
+				repos = append(repos, name)
+			}
+		}
+		next = body.Next
+	}
+	return repos, nil
+}
+
+// dockerHubLogin gets a jwt of docker hub api with the credentials of the client
+func (c *Client) dockerHubLogin(ctx context.Context) (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"username": c.credentials.Username,
+		"password": c.credentials.Password,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dockerHubAPI+"/v2/users/login/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("login docker hub error: %v", err)
+	}
+	defer DrainAndClose(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login docker hub error: %v", ResponseError(resp))
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode docker hub login response error: %v", err)
+	}
+	return body.Token, nil
+}
+
+// DoAPI sends a request to the management api of the registry with basic authentication unless
+// req has an Authorization header, a req.URL without host is resolved against the registry
+func (c *Client) DoAPI(req *http.Request) (*http.Response, error) {
+	if err := c.ping(req.Context()); err != nil {
+		return nil, err
+	}
+	if req.URL.Host == "" {
+		c.mutex.Lock()
+		req.URL.Scheme = c.scheme
+		c.mutex.Unlock()
+		req.URL.Host = c.registry
+	}
+	if req.Header.Get("Authorization") == "" && c.credentials.Username != "" && c.credentials.Password != "" {
+		req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+	}
+	return c.client.Do(req)
+}
+
+// underNamespace reports whether repo is under namespace, any repo is under an empty namespace
+func underNamespace(repo, namespace string) bool {
+	return namespace == "" || strings.HasPrefix(repo, strings.TrimSuffix(namespace, "/")+"/")
+}
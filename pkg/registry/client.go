@@ -0,0 +1,387 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	"tkestack.io/image-transfer/pkg/network"
+)
+
+// defaultTokenExpiry is used if a token response has no expires_in
+const defaultTokenExpiry = 60 * time.Second
+
+// Client sends requests to the distribution API of a registry, it answers
+// basic and bearer token authentication challenges of the registry
+type Client struct {
+	registry    string
+	credentials Credentials
+	options     Options
+	client      *http.Client
+
+	mutex sync.Mutex
+	// scheme is https or http, it is empty until the registry is pinged
+	scheme    string
+	challenge *challenge
+	// tokens caches bearer tokens by scope
+	tokens map[string]token
+}
+
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// Credentials authenticates requests to a registry, requests are anonymous if all fields are empty
+type Credentials struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token exchanged for bearer tokens
+	IdentityToken string
+	// RegistryToken is a bearer token sent to the registry as is
+	RegistryToken string
+}
+
+// Options configures the connection to a registry
+type Options struct {
+	// Insecure skips verifying the certificate of registry and tries plain http if https fails
+	Insecure bool
+	// PlainHTTP sends requests to registry in plain http only
+	PlainHTTP bool
+	// CertDir contains ca certificates *.crt and client certificates *.cert with keys *.key like
+	// docker certs.d, the certs.d directories of the registry in default locations are used if empty
+	CertDir string
+}
+
+// defaultCertDirs are looked up for a directory named by the registry host if Options.CertDir is empty,
+// after ~/.config/containers/certs.d, in the same order as containers/image
+var defaultCertDirs = []string{
+	"/etc/containers/certs.d",
+	"/etc/docker/certs.d",
+}
+
+// NewClient creates a Client of registry with the certificates of options
+func NewClient(registry string, credentials Credentials, options Options) (*Client, error) {
+	transport := network.Transport()
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.Insecure}
+	if dir := certDir(registry, options.CertDir); dir != "" && !options.PlainHTTP {
+		if err := tlsclientconfig.SetupCertificates(dir, tlsConfig); err != nil {
+			return nil, fmt.Errorf("load certificates of %s error: %v", registry, err)
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &Client{
+		registry:    registry,
+		credentials: credentials,
+		options:     options,
+		client:      &http.Client{Transport: network.WithFaults(transport)},
+		tokens:      make(map[string]token),
+	}, nil
+}
+
+// certDir returns dir, or the first certs.d directory of registry found in default locations
+func certDir(registry, dir string) string {
+	if dir != "" {
+		return dir
+	}
+	bases := defaultCertDirs
+	if home, err := os.UserHomeDir(); err == nil {
+		bases = append([]string{filepath.Join(home, ".config/containers/certs.d")}, bases...)
+	}
+	for _, base := range bases {
+		path := filepath.Join(base, registry)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// Registry returns the registry host of the client
+func (c *Client) Registry() string {
+	return c.registry
+}
+
+// RepositoryScope returns the token scope of actions on repository, e.g. "pull" or "pull,push"
+func RepositoryScope(repository, actions string) string {
+	return "repository:" + repository + ":" + actions
+}
+
+// Do sends req with the credentials of scope, a req.URL without host is resolved against the registry.
+// If the registry asks for authentication again, a request without body or with GetBody is resent once
+func (c *Client) Do(req *http.Request, scope string) (*http.Response, error) {
+	if err := c.ping(req.Context()); err != nil {
+		return nil, err
+	}
+	if req.URL.Host == "" {
+		c.mutex.Lock()
+		req.URL.Scheme = c.scheme
+		c.mutex.Unlock()
+		req.URL.Host = c.registry
+	}
+
+	if err := c.authorize(req, scope); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	// the token is expired or does not cover scope, ask for a new one
+	ch := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	resp.Body.Close()
+	c.mutex.Lock()
+	if ch != nil {
+		c.challenge = ch
+	}
+	delete(c.tokens, scope)
+	c.mutex.Unlock()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.authorize(retry, scope); err != nil {
+		return nil, err
+	}
+	return c.client.Do(retry)
+}
+
+// Ping checks that the registry is reachable
+func (c *Client) Ping(ctx context.Context) error {
+	return c.ping(ctx)
+}
+
+// ping finds the scheme and the authentication challenge of the registry
+func (c *Client) ping(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.scheme != "" {
+		return nil
+	}
+
+	schemes := []string{"https"}
+	if c.options.PlainHTTP {
+		schemes = []string{"http"}
+	} else if c.options.Insecure {
+		schemes = append(schemes, "http")
+	}
+	var lastErr error
+	for _, scheme := range schemes {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+c.registry+"/v2/", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		DrainAndClose(resp)
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.challenge = parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		}
+		c.scheme = scheme
+		return nil
+	}
+	return fmt.Errorf("error pinging registry %s: %v", c.registry, lastErr)
+}
+
+// authorize sets the Authorization header of req answering the challenge of the registry
+func (c *Client) authorize(req *http.Request, scope string) error {
+	if c.credentials.RegistryToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.credentials.RegistryToken)
+		return nil
+	}
+
+	c.mutex.Lock()
+	ch := c.challenge
+	c.mutex.Unlock()
+	if ch == nil {
+		return nil
+	}
+
+	switch ch.scheme {
+	case "basic":
+		if c.credentials.Username != "" && c.credentials.Password != "" {
+			req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+		}
+	case "bearer":
+		t, err := c.token(req.Context(), ch, scope)
+		if err != nil {
+			return err
+		}
+		if t != "" {
+			req.Header.Set("Authorization", "Bearer "+t)
+		}
+	}
+	return nil
+}
+
+// token returns a cached token of scope or gets one from the realm of challenge
+func (c *Client) token(ctx context.Context, ch *challenge, scope string) (string, error) {
+	c.mutex.Lock()
+	t, ok := c.tokens[scope]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(t.expires) {
+		return t.value, nil
+	}
+
+	realm, err := url.Parse(ch.params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm %q of registry %s", ch.params["realm"], c.registry)
+	}
+	query := realm.Query()
+	if service := ch.params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+
+	var req *http.Request
+	if c.credentials.IdentityToken != "" {
+		// OAuth2 refresh token grant, as docker does with an identity token
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", c.credentials.IdentityToken)
+		query.Set("client_id", "image-transfer")
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(query.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		realm.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if c.credentials.Username != "" && c.credentials.Password != "" {
+			req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get token of registry %s error: %v", c.registry, err)
+	}
+	defer DrainAndClose(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token of registry %s error: %v", c.registry, ResponseError(resp))
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode token of registry %s error: %v", c.registry, err)
+	}
+	t = token{value: body.Token, expires: time.Now().Add(defaultTokenExpiry)}
+	if t.value == "" {
+		t.value = body.AccessToken
+	}
+	if body.ExpiresIn > 0 {
+		// refresh a little earlier than the registry expects
+		t.expires = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - 5*time.Second)
+	}
+
+	c.mutex.Lock()
+	c.tokens[scope] = t
+	c.mutex.Unlock()
+	return t.value, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like: Bearer realm="...",service="...",scope="..."
+func parseChallenge(header string) *challenge {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil
+	}
+	parts := strings.SplitN(header, " ", 2)
+	ch := &challenge{scheme: strings.ToLower(parts[0]), params: make(map[string]string)}
+	if len(parts) == 1 {
+		return ch
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		ch.params[key] = value
+		rest = strings.TrimLeft(strings.TrimSpace(rest), ",")
+	}
+	return ch
+}
+
+// ResponseError returns an error of an unexpected response including the beginning of its body
+func ResponseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected status code %d from %s %s: %s", resp.StatusCode,
+		resp.Request.Method, resp.Request.URL.Path, strings.TrimSpace(string(body)))
+}
+
+// DrainAndClose reads the rest of the body and closes it, so the connection is reused
+func DrainAndClose(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
@@ -0,0 +1,77 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{header: "", scheme: ""},
+		{header: "Basic", scheme: "basic", params: map[string]string{}},
+		{header: `Basic realm="Registry Realm"`, scheme: "basic", params: map[string]string{"realm": "Registry Realm"}},
+		{
+			header: `Bearer realm="https://auth.example.com/token",service="registry.example.com",` +
+				`scope="repository:team/app:pull,push"`,
+			scheme: "bearer",
+			params: map[string]string{
+				"realm":   "https://auth.example.com/token",
+				"service": "registry.example.com",
+				"scope":   "repository:team/app:pull,push",
+			},
+		},
+		{
+			// commas in quoted values do not separate params, spaces around separators are ignored
+			header: `Bearer scope="repository:a:pull,push repository:b:pull" , realm="https://auth.example.com/token?a=1,2"`,
+			scheme: "bearer",
+			params: map[string]string{
+				"scope": "repository:a:pull,push repository:b:pull",
+				"realm": "https://auth.example.com/token?a=1,2",
+			},
+		},
+		{
+			header: `Bearer realm=https://auth.example.com/token,Service=registry.example.com`,
+			scheme: "bearer",
+			params: map[string]string{"realm": "https://auth.example.com/token", "service": "registry.example.com"},
+		},
+		{
+			// an unterminated quoted value ends at the end of the header
+			header: `Bearer realm="https://auth.example.com/token,service=x`,
+			scheme: "bearer",
+			params: map[string]string{"realm": "https://auth.example.com/token,service=x"},
+		},
+	} {
+		ch := parseChallenge(tc.header)
+		if tc.scheme == "" {
+			if ch != nil {
+				t.Errorf("parseChallenge(%q) = %v, expected nil", tc.header, ch)
+			}
+			continue
+		}
+		if ch == nil || ch.scheme != tc.scheme || !reflect.DeepEqual(ch.params, tc.params) {
+			t.Errorf("parseChallenge(%q) = %+v, expected %s %v", tc.header, ch, tc.scheme, tc.params)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HarborProject is a project of harbor
+type HarborProject struct {
+	Name      string `json:"name"`
+	RepoCount int64  `json:"repo_count"`
+	Metadata  struct {
+		Public string `json:"public"`
+	} `json:"metadata"`
+}
+
+// HarborTag is a tag of an artifact of harbor
+type HarborTag struct {
+	Name     string    `json:"name"`
+	PushTime time.Time `json:"push_time"`
+}
+
+// HarborProjects lists all projects of harbor
+func (c *Client) HarborProjects(ctx context.Context) ([]HarborProject, error) {
+	var projects []HarborProject
+	err := c.harborPages(ctx, "/api/v2.0/projects", func(data []byte) (int, error) {
+		var page []HarborProject
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		projects = append(projects, page...)
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list harbor projects of %s error: %v", c.registry, err)
+	}
+	return projects, nil
+}
+
+// HarborTags lists the tags of the artifacts of repository project/repo with their push time
+func (c *Client) HarborTags(ctx context.Context, repository string) ([]HarborTag, error) {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("harbor repository %s should be in the form of project/repo", repository)
+	}
+	// slashes in repository name are escaped twice by harbor api
+	path := "/api/v2.0/projects/" + url.PathEscape(parts[0]) + "/repositories/" +
+		url.PathEscape(url.PathEscape(parts[1])) + "/artifacts"
+
+	var tags []HarborTag
+	err := c.harborPages(ctx, path, func(data []byte) (int, error) {
+		var page []struct {
+			Tags []HarborTag `json:"tags"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+		for _, artifact := range page {
+			tags = append(tags, artifact.Tags...)
+		}
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list artifacts of harbor repository %s/%s error: %v", c.registry, repository, err)
+	}
+	return tags, nil
+}
+
+// CreateHarborProject creates a harbor project
+func (c *Client) CreateHarborProject(ctx context.Context, name string, public bool) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"project_name": name,
+		"metadata":     map[string]string{"public": strconv.FormatBool(public)},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/v2.0/projects", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.DoAPI(req)
+	if err != nil {
+		return err
+	}
+	defer DrainAndClose(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("create harbor project %s of %s error: %v", name, c.registry, ResponseError(resp))
+	}
+	return nil
+}
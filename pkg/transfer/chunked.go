@@ -0,0 +1,374 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/metrics"
+	"tkestack.io/image-transfer/pkg/registry"
+)
+
+// chunkRetries is the number of times a failed chunk is resumed before the blob copy fails
+const chunkRetries = 3
+
+// chunkSize is the size of chunks of a blob upload, blobs not larger than it are pushed in one stream
+var chunkSize int64
+
+// SetChunkSize enables chunked and resumable upload for blobs larger than size, 0 disables it
+func SetChunkSize(size int64) {
+	chunkSize = size
+}
+
+// uploadSession is a chunked upload of a blob in progress, it is kept after a failure
+// so the blob is resumed from offset when the job is retried
+type uploadSession struct {
+	location string
+	offset   int64
+}
+
+// uploadSessions keeps the upload sessions of an image target by blob digest, they are
+// released with the target when the job ends
+type uploadSessions struct {
+	sync.Mutex
+	m map[digest.Digest]*uploadSession
+}
+
+func newUploadSessions() *uploadSessions {
+	return &uploadSessions{m: make(map[digest.Digest]*uploadSession)}
+}
+
+// take removes the session of blob d and returns it
+func (s *uploadSessions) take(d digest.Digest) (*uploadSession, bool) {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.m[d]
+	delete(s.m, d)
+	return session, ok
+}
+
+// keep stores the session of blob d
+func (s *uploadSessions) keep(d digest.Digest, session *uploadSession) {
+	s.Lock()
+	defer s.Unlock()
+	s.m[d] = session
+}
+
+// takeAll removes all sessions and returns them
+func (s *uploadSessions) takeAll() []*uploadSession {
+	s.Lock()
+	defer s.Unlock()
+	sessions := make([]*uploadSession, 0, len(s.m))
+	for d, session := range s.m {
+		sessions = append(sessions, session)
+		delete(s.m, d)
+	}
+	return sessions
+}
+
+// GetABlobRange gets a blob from remote image starting at offset
+func (i *ImageSource) GetABlobRange(d digest.Digest, offset int64) (io.ReadCloser, error) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(i.ctx, http.MethodGet,
+		"/v2/"+i.repository+"/blobs/"+d.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := i.client.Do(req, registry.RepositoryScope(i.repository, "pull"))
+	metrics.ObserveResponse(i.registry, "get_blob", start, resp, err)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		// the registry or its storage ignores range, skip the bytes already uploaded
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	default:
+		defer registry.DrainAndClose(resp)
+		return nil, registry.ResponseError(resp)
+	}
+}
+
+// PutABlobChunked pushes a blob in chunks of the chunk size, open returns the blob content from offset.
+// A failed chunk is resumed from the offset acknowledged by the registry, and the upload session is
+// kept for a later retry if the blob still fails
+func (i *ImageTarget) PutABlobChunked(open func(offset int64) (io.ReadCloser, error), blobInfo types.BlobInfo) error {
+	session, ok := i.uploads.take(blobInfo.Digest)
+
+	if ok {
+		if err := i.refreshUpload(session); err != nil {
+			log.Warnf("Upload session of blob %s is lost, restart it: %v", blobInfo.Digest, err)
+			ok = false
+		} else {
+			log.Infof("Resume upload of blob %s to %s/%s from offset %d", blobInfo.Digest,
+				i.registry, i.repository, session.offset)
+		}
+	}
+	if !ok {
+		location, err := i.startUpload()
+		if err != nil {
+			return err
+		}
+		session = &uploadSession{location: location}
+	}
+
+	err := i.putChunks(session, open, blobInfo)
+	if err != nil {
+		// the chunks acknowledged are not pushed again by the next retry
+		i.uploads.keep(blobInfo.Digest, session)
+	}
+	return err
+}
+
+func (i *ImageTarget) putChunks(session *uploadSession, open func(offset int64) (io.ReadCloser, error),
+	blobInfo types.BlobInfo) error {
+	var blob io.ReadCloser
+	defer func() {
+		if blob != nil {
+			blob.Close()
+		}
+	}()
+
+	for retries := 0; session.offset < blobInfo.Size; {
+		var err error
+		if blob == nil {
+			blob, err = open(session.offset)
+		}
+		if err == nil {
+			n := chunkSize
+			if left := blobInfo.Size - session.offset; left < n {
+				n = left
+			}
+			err = i.putChunk(session, io.LimitReader(blob, n), n)
+		}
+		if err == nil {
+			// the limit of retries applies to each chunk
+			retries = 0
+			continue
+		}
+
+		if blob != nil {
+			blob.Close()
+			blob = nil
+		}
+		retries++
+		if retries > chunkRetries || i.ctx.Err() != nil {
+			return err
+		}
+		log.Warnf("Put chunk of blob %s to %s/%s at offset %d failed, resume it: %v", blobInfo.Digest,
+			i.registry, i.repository, session.offset, err)
+		time.Sleep(time.Duration(retries) * time.Second)
+		if err := i.refreshUpload(session); err != nil {
+			return err
+		}
+	}
+
+	return i.finishUpload(session, blobInfo.Digest)
+}
+
+// startUpload starts an upload session and returns its location
+func (i *ImageTarget) startUpload() (string, error) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(i.ctx, http.MethodPost, "/v2/"+i.repository+"/blobs/uploads/", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := i.client.Do(req, registry.RepositoryScope(i.repository, "pull,push"))
+	if err == nil {
+		defer registry.DrainAndClose(resp)
+		if resp.StatusCode != http.StatusAccepted {
+			err = registry.ResponseError(resp)
+		}
+	}
+	metrics.ObserveResponse(i.registry, "start_upload", start, resp, err)
+	if err != nil {
+		return "", err
+	}
+	return resolveLocation(resp)
+}
+
+// putChunk sends n bytes of chunk at the offset of session and moves the offset
+func (i *ImageTarget) putChunk(session *uploadSession, chunk io.Reader, n int64) error {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(i.ctx, http.MethodPatch, session.location, ioutil.NopCloser(chunk))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", session.offset, session.offset+n-1))
+
+	resp, err := i.client.Do(req, registry.RepositoryScope(i.repository, "pull,push"))
+	if err == nil {
+		defer registry.DrainAndClose(resp)
+		if resp.StatusCode != http.StatusAccepted {
+			err = registry.ResponseError(resp)
+		}
+	}
+	metrics.ObserveResponse(i.registry, "put_blob_chunk", start, resp, err)
+	if err != nil {
+		return err
+	}
+
+	location, err := resolveLocation(resp)
+	if err != nil {
+		return err
+	}
+	session.location = location
+	if end, ok := parseRange(resp.Header.Get("Range")); ok && end+1 != session.offset+n {
+		return fmt.Errorf("registry acknowledged %d bytes, expect %d", end+1, session.offset+n)
+	}
+	session.offset += n
+	return nil
+}
+
+// refreshUpload gets the offset acknowledged by the registry of session
+func (i *ImageTarget) refreshUpload(session *uploadSession) error {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(i.ctx, http.MethodGet, session.location, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := i.client.Do(req, registry.RepositoryScope(i.repository, "pull,push"))
+	if err == nil {
+		defer registry.DrainAndClose(resp)
+		if resp.StatusCode != http.StatusNoContent {
+			err = registry.ResponseError(resp)
+		}
+	}
+	metrics.ObserveResponse(i.registry, "upload_status", start, resp, err)
+	if err != nil {
+		return err
+	}
+
+	if location, err := resolveLocation(resp); err == nil {
+		session.location = location
+	}
+	end, ok := parseRange(resp.Header.Get("Range"))
+	switch {
+	case !ok:
+		return fmt.Errorf("invalid range %q of upload session", resp.Header.Get("Range"))
+	case end == 0 && session.offset == 0:
+		// "0-0" is returned for an empty session too
+		session.offset = 0
+	default:
+		session.offset = end + 1
+	}
+	return nil
+}
+
+// finishUpload commits the session as blob d, the registry verifies the digest of the content
+func (i *ImageTarget) finishUpload(session *uploadSession, d digest.Digest) error {
+	start := time.Now()
+	location, err := url.Parse(session.location)
+	if err != nil {
+		return err
+	}
+	query := location.Query()
+	query.Set("digest", d.String())
+	location.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(i.ctx, http.MethodPut, location.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := i.client.Do(req, registry.RepositoryScope(i.repository, "pull,push"))
+	if err == nil {
+		defer registry.DrainAndClose(resp)
+		if resp.StatusCode != http.StatusCreated {
+			err = registry.ResponseError(resp)
+		}
+	}
+	metrics.ObserveResponse(i.registry, "finish_upload", start, resp, err)
+	return err
+}
+
+// cancelUploads deletes the upload sessions kept for retries on the registry, it is called when the job
+// is abandoned. The context of the target may be cancelled already, so the requests have their own
+func (i *ImageTarget) cancelUploads() {
+	for _, session := range i.uploads.takeAll() {
+		if err := i.deleteUpload(session); err != nil {
+			log.Warnf("Cancel upload session %s of %s/%s error: %v", session.location, i.registry, i.repository, err)
+		}
+	}
+}
+
+// deleteUpload cancels session on the registry, a session expired already is ignored
+func (i *ImageTarget) deleteUpload(session *uploadSession) error {
+	start := time.Now()
+	ctx, cancel := requestContext(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, session.location, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := i.client.Do(req, registry.RepositoryScope(i.repository, "pull,push"))
+	if err == nil {
+		defer registry.DrainAndClose(resp)
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+			err = registry.ResponseError(resp)
+		}
+	}
+	metrics.ObserveResponse(i.registry, "cancel_upload", start, resp, err)
+	return err
+}
+
+// resolveLocation returns the absolute url of the Location header of resp
+func resolveLocation(resp *http.Response) (string, error) {
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location from %s: %v", resp.Request.URL.Host, err)
+	}
+	return location.String(), nil
+}
+
+// parseRange parses the Range header of upload responses, e.g. 0-1023, and returns the last byte offset
+func parseRange(header string) (int64, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return end, true
+}
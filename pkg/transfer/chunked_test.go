@@ -0,0 +1,252 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/registry"
+)
+
+// uploadRegistry serves the blob upload api of a single upload session of repository app
+type uploadRegistry struct {
+	mutex sync.Mutex
+	data  []byte
+	// failPatchAt makes the first PATCH at each of these offsets fail
+	failPatchAt map[int64]bool
+	// onFailure is called when a PATCH fails
+	onFailure func()
+	// starts counts the upload sessions started, deletes the sessions cancelled
+	starts  int
+	deletes int
+	// blob is served by its digest, ranges are ignored if ignoreRange is set
+	blob        []byte
+	ignoreRange bool
+}
+
+func (r *uploadRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	const location = "/v2/app/blobs/uploads/session"
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case req.Method == http.MethodPost && req.URL.Path == "/v2/app/blobs/uploads/":
+		r.starts++
+		r.data = nil
+		w.Header().Set("Location", location)
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodGet && req.URL.Path == location:
+		w.Header().Set("Location", location)
+		// "0-0" is returned for an empty session too
+		end := len(r.data) - 1
+		if end < 0 {
+			end = 0
+		}
+		w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPatch && req.URL.Path == location:
+		start, err := strconv.ParseInt(strings.SplitN(req.Header.Get("Content-Range"), "-", 2)[0], 10, 64)
+		if err != nil || start != int64(len(r.data)) {
+			http.Error(w, "invalid content range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if r.failPatchAt[start] {
+			delete(r.failPatchAt, start)
+			if r.onFailure != nil {
+				r.onFailure()
+			}
+			http.Error(w, "chunk failed", http.StatusInternalServerError)
+			return
+		}
+		chunk, _ := ioutil.ReadAll(req.Body)
+		r.data = append(r.data, chunk...)
+		w.Header().Set("Location", location)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(r.data)-1))
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodDelete && req.URL.Path == location:
+		r.deletes++
+		r.data = nil
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPut && req.URL.Path == location:
+		if req.URL.Query().Get("digest") != digest.FromBytes(r.data).String() {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodGet && req.URL.Path == "/v2/app/blobs/"+digest.FromBytes(r.blob).String():
+		if rng := req.Header.Get("Range"); rng != "" && !r.ignoreRange {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(r.blob[offset:])
+			return
+		}
+		w.Write(r.blob)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func newUploadTarget(t *testing.T, ctx context.Context, server *httptest.Server) *ImageTarget {
+	host := strings.TrimPrefix(server.URL, "http://")
+	client, err := registry.NewClient(host, registry.Credentials{}, registry.Options{PlainHTTP: true})
+	if err != nil {
+		t.Fatalf("create registry client error: %v", err)
+	}
+	return &ImageTarget{registry: host, endpoint: host, repository: "app", ctx: ctx, client: client,
+		uploads: newUploadSessions()}
+}
+
+// offsetRecorder opens blob from an offset and records the offsets
+type offsetRecorder struct {
+	blob    []byte
+	offsets []int64
+}
+
+func (r *offsetRecorder) open(offset int64) (io.ReadCloser, error) {
+	r.offsets = append(r.offsets, offset)
+	return ioutil.NopCloser(bytes.NewReader(r.blob[offset:])), nil
+}
+
+func TestPutABlobChunkedResume(t *testing.T) {
+	defer SetChunkSize(0)
+	SetChunkSize(4)
+
+	blob := []byte("0123456789abcdef!")
+	info := types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	// each failure is resumed, the number of failures of a blob is not limited
+	reg := &uploadRegistry{failPatchAt: map[int64]bool{4: true, 8: true, 12: true, 16: true}}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	// a failed chunk is resumed from the offset acknowledged by the registry
+	source := &offsetRecorder{blob: blob}
+	if err := newUploadTarget(t, context.Background(), server).PutABlobChunked(source.open, info); err != nil {
+		t.Fatalf("put blob in chunks error: %v", err)
+	}
+	if fmt.Sprint(source.offsets) != "[0 4 8 12 16]" || !bytes.Equal(reg.data, blob) || reg.starts != 1 {
+		t.Errorf("opened at %v, uploaded %q in %d sessions", source.offsets, reg.data, reg.starts)
+	}
+}
+
+func TestPutABlobChunkedRetry(t *testing.T) {
+	defer SetChunkSize(0)
+	SetChunkSize(4)
+
+	blob := []byte("0123456789abcdef!")
+	info := types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	ctx, cancel := context.WithCancel(context.Background())
+	// the job is cancelled while a chunk fails, so the blob fails without resuming it
+	reg := &uploadRegistry{failPatchAt: map[int64]bool{12: true}, onFailure: cancel}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	target := newUploadTarget(t, ctx, server)
+	source := &offsetRecorder{blob: blob}
+	if err := target.PutABlobChunked(source.open, info); err == nil {
+		t.Fatalf("put blob in chunks should fail")
+	}
+
+	// the retry of the job resumes the upload session kept by the target
+	source.offsets = nil
+	if err := target.WithContext(context.Background()).PutABlobChunked(source.open, info); err != nil {
+		t.Fatalf("retry put blob in chunks error: %v", err)
+	}
+	if fmt.Sprint(source.offsets) != "[12]" || !bytes.Equal(reg.data, blob) || reg.starts != 1 {
+		t.Errorf("retry opened at %v, uploaded %q in %d sessions", source.offsets, reg.data, reg.starts)
+	}
+}
+
+func TestCancelUploads(t *testing.T) {
+	defer SetChunkSize(0)
+	SetChunkSize(1)
+
+	blob := []byte("0123")
+	info := types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	ctx, cancel := context.WithCancel(context.Background())
+	reg := &uploadRegistry{failPatchAt: map[int64]bool{1: true}, onFailure: cancel}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	target := newUploadTarget(t, ctx, server)
+	source := &offsetRecorder{blob: blob}
+	if err := target.PutABlobChunked(source.open, info); err == nil {
+		t.Fatalf("put blob in chunks should fail")
+	}
+
+	// a session with one byte acknowledged is resumed from it
+	source.offsets = nil
+	retry := target.WithContext(context.Background())
+	if session, ok := retry.uploads.take(info.Digest); !ok {
+		t.Fatalf("upload session is not kept")
+	} else if err := retry.refreshUpload(session); err != nil || session.offset != 1 {
+		t.Fatalf("refresh upload session = %d, %v, expected offset 1", session.offset, err)
+	} else {
+		retry.uploads.keep(info.Digest, session)
+	}
+
+	// the kept session is deleted when the job is abandoned
+	retry.cancelUploads()
+	if reg.deletes != 1 {
+		t.Errorf("%d upload sessions deleted, expected 1", reg.deletes)
+	}
+	if _, ok := retry.uploads.take(info.Digest); ok {
+		t.Errorf("upload session is kept after cancelled")
+	}
+}
+
+func TestGetABlobRange(t *testing.T) {
+	blob := []byte("0123456789abcdef!")
+	for _, ignoreRange := range []bool{false, true} {
+		server := httptest.NewServer(&uploadRegistry{blob: blob, ignoreRange: ignoreRange})
+		host := strings.TrimPrefix(server.URL, "http://")
+		client, err := registry.NewClient(host, registry.Credentials{}, registry.Options{PlainHTTP: true})
+		if err != nil {
+			t.Fatalf("create registry client error: %v", err)
+		}
+		source := &ImageSource{registry: host, endpoint: host, repository: "app", ctx: context.Background(),
+			client: client}
+		for _, offset := range []int64{0, 5, int64(len(blob))} {
+			rc, err := source.GetABlobRange(digest.FromBytes(blob), offset)
+			if err != nil {
+				t.Fatalf("get blob from offset %d error: %v", offset, err)
+			}
+			content, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			if !bytes.Equal(content, blob[offset:]) {
+				t.Errorf("get blob from offset %d, ignore range %t = %q", offset, ignoreRange, content)
+			}
+		}
+		server.Close()
+	}
+}
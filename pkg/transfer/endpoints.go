@@ -0,0 +1,95 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"fmt"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// NewImageSourceFromEndpoints creates an ImageSource of a logical registry on the first endpoint which
+// has the image, or is reachable if tag is empty. The ImageSource keeps the logical registry name
+func NewImageSourceFromEndpoints(ctx context.Context, registry, repository, tag string,
+	endpoints []configs.Endpoint) (*ImageSource, error) {
+	var lastErr error
+	for _, endpoint := range endpoints {
+		source, err := NewImageSource(ctx, endpoint.Registry, repository, tag, endpoint.Security)
+		if err == nil && tag == "" {
+			err = pingEndpoint(ctx, source.client.Ping)
+		}
+		if err != nil {
+			if len(endpoints) > 1 {
+				log.Warnf("Endpoint %s of %s is not available for %s: %v", endpoint.Registry, registry, repository, err)
+			}
+			lastErr = err
+			continue
+		}
+		if endpoint.Registry != registry {
+			log.Debugf("Pull %s/%s from endpoint %s", registry, repository, endpoint.Registry)
+		}
+		source.endpoint = endpoint.Registry
+		source.registry = registry
+		return source, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no endpoints of %s", registry)
+	}
+	return nil, lastErr
+}
+
+// NewImageTargetFromEndpoints creates an ImageTarget of a logical registry on the first reachable endpoint,
+// the ImageTarget keeps the logical registry name
+func NewImageTargetFromEndpoints(ctx context.Context, registry, repository, tag string,
+	endpoints []configs.Endpoint) (*ImageTarget, error) {
+	var lastErr error
+	for _, endpoint := range endpoints {
+		target, err := NewImageTarget(ctx, endpoint.Registry, repository, tag, endpoint.Security)
+		if err == nil && len(endpoints) > 1 {
+			if err = pingEndpoint(ctx, target.client.Ping); err != nil {
+				target.Close()
+			}
+		}
+		if err != nil {
+			if len(endpoints) > 1 {
+				log.Warnf("Endpoint %s of %s is not available for %s: %v", endpoint.Registry, registry, repository, err)
+			}
+			lastErr = err
+			continue
+		}
+		if endpoint.Registry != registry {
+			log.Debugf("Push %s/%s to endpoint %s", registry, repository, endpoint.Registry)
+		}
+		target.endpoint = endpoint.Registry
+		target.registry = registry
+		return target, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no endpoints of %s", registry)
+	}
+	return nil, lastErr
+}
+
+func pingEndpoint(ctx context.Context, ping func(context.Context) error) error {
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+	return ping(reqCtx)
+}
@@ -19,12 +19,23 @@
 package transfer
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
 	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/boltdb"
 	"github.com/containers/image/v5/pkg/blobinfocache/memory"
 	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
 	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/metrics"
+	"tkestack.io/image-transfer/pkg/progress"
+	"tkestack.io/image-transfer/pkg/utils"
 )
 
 var (
@@ -34,10 +45,18 @@ var (
 	Memory = memory.New()
 )
 
+// UsePersistentCache replaces the in-memory blobinfocache with a bolt db file at path,
+// so known blob locations in target are kept between transfer cycles and runs
+func UsePersistentCache(path string) {
+	Memory = boltdb.New(path)
+}
+
 // Job act as a sync action, it will pull a images from source to target
 type Job struct {
 	Source *ImageSource
 	Target *ImageTarget
+	// Progress receives blob events of this job, may be nil
+	Progress progress.Reporter
 }
 
 // NewJob creates a transfer job
@@ -49,64 +68,69 @@ func NewJob(source *ImageSource, target *ImageTarget) *Job {
 	}
 }
 
-// Run is the main function of a transfer job
+// Close releases the source and target of a job which is not run again,
+// the chunked uploads kept for its retries are cancelled
+func (j *Job) Close() {
+	if err := j.Source.Close(); err != nil {
+		log.Warnf("close source of job %s error: %v", j, err)
+	}
+	if err := j.Target.Close(); err != nil {
+		log.Warnf("close target of job %s error: %v", j, err)
+	}
+}
+
+// Run is the main function of a transfer job, it is aborted if the job timeout is exceeded
 func (j *Job) Run() error {
+	deadline := time.Now().Add(timeouts.Job)
+	sourceCtx, cancelSource := jobContext(j.Source.ctx)
+	defer cancelSource()
+	targetCtx, cancelTarget := jobContext(j.Target.ctx)
+	defer cancelTarget()
+
+	err := j.run(j.Source.WithContext(sourceCtx), j.Target.WithContext(targetCtx))
+	if err != nil && timeouts.Job > 0 && !time.Now().Before(deadline) {
+		metrics.TimeoutsTotal.WithLabelValues("job").Inc()
+		return fmt.Errorf("job exceeded timeout %s: %v", timeouts.Job, err)
+	}
+	return err
+}
+
+func (j *Job) run(source *ImageSource, target *ImageTarget) error {
 	// get manifest from source
-	manifestByte, manifestType, err := j.Source.GetManifest()
+	manifestByte, manifestType, err := source.GetManifest()
 	if err != nil {
 		log.Errorf("Failed to get manifest from %s/%s:%s error: %v",
-			j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
+			source.GetRegistry(), source.GetRepository(), source.GetTag(), err)
 		return err
 	}
-	log.Infof("Get manifest from %s/%s:%s", j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
+	log.Infof("Get manifest from %s/%s:%s", source.GetRegistry(), source.GetRepository(), source.GetTag())
 
-	blobInfos, err := j.Source.GetBlobInfos(manifestByte, manifestType)
+	blobInfos, err := source.GetBlobInfos(manifestByte, manifestType)
 	if err != nil {
 		log.Errorf("Get blob info from %s/%s:%s error: %v",
-			j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
+			source.GetRegistry(), source.GetRepository(), source.GetTag(), err)
 		return err
 	}
 
 	// blob transformation
 	for _, blobinfo := range blobInfos {
-		blobExist, err := j.Target.CheckBlobExist(blobinfo)
+		digest := blobinfo.Digest.String()
+		blobExist, err := target.CheckBlobExist(blobinfo)
 		if err != nil {
 			log.Errorf("Check blob %s(%v) to %s/%s:%s exist error: %v",
-				blobinfo.Digest, blobinfo.Size, j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag(), err)
+				blobinfo.Digest, blobinfo.Size, target.GetRegistry(), target.GetRepository(), target.GetTag(), err)
 			return err
 		}
 
 		if !blobExist {
-			// pull a blob from source
-			log.Infof("Getting blob from %s/%s:%s ing...", j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
-			blob, size, err := j.Source.GetABlob(blobinfo)
-			if err != nil {
-				log.Errorf("Get blob %s(%v) from %s/%s:%s failed: %v", blobinfo.Digest,
-					size, j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
-				return err
-			}
-
-			log.Infof("Get a blob %s(%v) from %s/%s:%s success", blobinfo.Digest, size,
-				j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
-
-			blobinfo.Size = size
-			// push a blob to target
-			log.Infof("Putting blob to %s/%s:%s ing...", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
-			if err := j.Target.PutABlob(blob, blobinfo); err != nil {
-				log.Errorf("Put blob %s(%v) to %s/%s:%s failed: %v", blobinfo.Digest, blobinfo.Size,
-					j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag(), err)
-				if closeErr := blob.Close(); closeErr != nil {
-					return errors.Wrapf(err, " (close error: %v)", closeErr)
-				}
+			if err := j.copyBlob(source, target, blobinfo); err != nil {
 				return err
 			}
-
-			log.Infof("Put blob %s(%v) to %s/%s:%s success", blobinfo.Digest, blobinfo.Size,
-				j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
 		} else {
+			j.emit(progress.BlobSkipped, digest, blobinfo.Size)
 			// print the log of ignored blob
 			log.Infof("Blob %s(%v) has been pushed to %s, will not be pulled", blobinfo.Digest,
-				blobinfo.Size, j.Target.GetRegistry()+"/"+j.Target.GetRepository())
+				blobinfo.Size, target.GetRegistry()+"/"+target.GetRepository())
 		}
 	}
 
@@ -135,7 +159,7 @@ func (j *Job) Run() error {
 				log.Infof("handle manifest OS:%s Architecture:%s ", manifestDescriptorElem.Platform.OS,
 					manifestDescriptorElem.Platform.Architecture)
 
-				subManifestByte, _, err = j.Source.source.GetManifest(j.Source.ctx, &manifestDescriptorElem.Digest)
+				subManifestByte, _, err = source.GetSubManifest(manifestDescriptorElem.Digest)
 				if err != nil {
 					log.Errorf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v",
 						manifestDescriptorElem.Digest, manifestDescriptorElem.Platform.OS,
@@ -143,14 +167,14 @@ func (j *Job) Run() error {
 					return err
 				}
 
-				if err := j.Target.PushManifest(subManifestByte); err != nil {
-					log.Errorf("Put manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
-						j.Target.GetRepository(), j.Target.GetTag(), err)
+				if err := target.PushSubManifest(subManifestByte, manifestDescriptorElem.Digest); err != nil {
+					log.Errorf("Put manifest to %s/%s:%s error: %v", target.GetRegistry(),
+						target.GetRepository(), target.GetTag(), err)
 					return err
 				}
 
-				log.Infof("Put manifest to %s/%s:%s os:%s arch:%s", j.Target.GetRegistry(), j.Target.GetRepository(),
-					j.Target.GetTag(), manifestDescriptorElem.Platform.OS, manifestDescriptorElem.Platform.Architecture)
+				log.Infof("Put manifest to %s/%s:%s os:%s arch:%s", target.GetRegistry(), target.GetRepository(),
+					target.GetTag(), manifestDescriptorElem.Platform.OS, manifestDescriptorElem.Platform.Architecture)
 			}
 		} else if manifestType == specsv1.MediaTypeImageIndex {
 			ociIndexesObj := manifestListObj.(*manifest.OCI1Index)
@@ -159,7 +183,7 @@ func (j *Job) Run() error {
 				log.Infof("handle OCI manifest OS:%s Architecture:%s ", descriptor.Platform.OS,
 					descriptor.Platform.Architecture)
 
-				subManifestByte, _, err = j.Source.source.GetManifest(j.Source.ctx, &descriptor.Digest)
+				subManifestByte, _, err = source.GetSubManifest(descriptor.Digest)
 				if err != nil {
 					log.Errorf("Get OCI manifest %v of OS:%s Architecture:%s for image index error: %v",
 						descriptor.Digest, descriptor.Platform.OS,
@@ -167,40 +191,218 @@ func (j *Job) Run() error {
 					return err
 				}
 
-				if err := j.Target.PushManifest(subManifestByte); err != nil {
-					log.Errorf("Put OCI manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
-						j.Target.GetRepository(), j.Target.GetTag(), err)
+				if err := target.PushSubManifest(subManifestByte, descriptor.Digest); err != nil {
+					log.Errorf("Put OCI manifest to %s/%s:%s error: %v", target.GetRegistry(),
+						target.GetRepository(), target.GetTag(), err)
 					return err
 				}
 
-				log.Infof("Put OCI manifest to %s/%s:%s os:%s arch:%s", j.Target.GetRegistry(), j.Target.GetRepository(),
-					j.Target.GetTag(), descriptor.Platform.OS, descriptor.Platform.Architecture)
+				log.Infof("Put OCI manifest to %s/%s:%s os:%s arch:%s", target.GetRegistry(), target.GetRepository(),
+					target.GetTag(), descriptor.Platform.OS, descriptor.Platform.Architecture)
 			}
 		}
 
 		// push manifest list to target
-		if err := j.Target.PushManifest(manifestByte); err != nil {
-			log.Errorf("Put manifestList to %s/%s:%s error: %v", j.Target.GetRegistry(),
-				j.Target.GetRepository(), j.Target.GetTag(), err)
+		if err := target.PushManifest(manifestByte); err != nil {
+			log.Errorf("Put manifestList to %s/%s:%s error: %v", target.GetRegistry(),
+				target.GetRepository(), target.GetTag(), err)
 			return err
 		}
 
-		log.Infof("Put manifestList to %s/%s:%s", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+		log.Infof("Put manifestList to %s/%s:%s", target.GetRegistry(), target.GetRepository(), target.GetTag())
 
 	} else {
 
 		// push manifest to target
-		if err := j.Target.PushManifest(manifestByte); err != nil {
-			log.Errorf("Put manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
-				j.Target.GetRepository(), j.Target.GetTag(), err)
+		if err := target.PushManifest(manifestByte); err != nil {
+			log.Errorf("Put manifest to %s/%s:%s error: %v", target.GetRegistry(),
+				target.GetRepository(), target.GetTag(), err)
 			return err
 		}
 
-		log.Infof("Put manifest to %s/%s:%s", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+		log.Infof("Put manifest to %s/%s:%s", target.GetRegistry(), target.GetRepository(), target.GetTag())
 	}
 
-	log.Infof("Synchronization successfully from %s/%s:%s to %s/%s:%s", j.Source.GetRegistry(), j.Source.GetRepository(),
-		j.Source.GetTag(), j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	log.Infof("Synchronization successfully from %s/%s:%s to %s/%s:%s", source.GetRegistry(), source.GetRepository(),
+		source.GetTag(), target.GetRegistry(), target.GetRepository(), target.GetTag())
 
 	return nil
 }
+
+// copyBlob pulls a blob from source and pushes it to target, the copy is aborted
+// if no bytes flow for the idle timeout
+func (j *Job) copyBlob(source *ImageSource, target *ImageTarget, blobinfo types.BlobInfo) error {
+	digest := blobinfo.Digest.String()
+	sourceCtx, cancelSource := context.WithCancel(source.ctx)
+	defer cancelSource()
+	targetCtx, cancelTarget := context.WithCancel(target.ctx)
+	defer cancelTarget()
+	stall := newWatchdog(timeouts.BlobIdle, func() {
+		cancelSource()
+		cancelTarget()
+	})
+	defer stall.stop()
+	source, target = source.WithContext(sourceCtx), target.WithContext(targetCtx)
+
+	if spool != nil && blobinfo.Size > 0 {
+		err := j.copyBlobSpooled(source, target, blobinfo, stall)
+		if err != errSpoolFull {
+			return err
+		}
+		log.Warnf("Blob %s(%v) does not fit into spool, copy it directly", blobinfo.Digest, blobinfo.Size)
+	}
+	if chunkSize > 0 && blobinfo.Size > chunkSize {
+		return j.copyBlobChunked(source, target, blobinfo, stall)
+	}
+
+	// pull a blob from source
+	log.Infof("Getting blob from %s/%s:%s ing...", source.GetRegistry(), source.GetRepository(), source.GetTag())
+	blob, size, err := source.GetABlob(blobinfo)
+	if err != nil {
+		err = stallError(stall, err)
+		log.Errorf("Get blob %s(%v) from %s/%s:%s failed: %v", blobinfo.Digest,
+			size, source.GetRegistry(), source.GetRepository(), source.GetTag(), err)
+		return err
+	}
+	stall.kick()
+
+	log.Infof("Get a blob %s(%v) from %s/%s:%s success", blobinfo.Digest, size,
+		source.GetRegistry(), source.GetRepository(), source.GetTag())
+
+	blobinfo.Size = size
+	j.emit(progress.BlobStarted, digest, size)
+	blob = progress.NewReader(stall.reader(blob), j.Progress, j.event(progress.BlobBytes, digest, 0))
+	// push a blob to target
+	log.Infof("Putting blob to %s/%s:%s ing...", target.GetRegistry(), target.GetRepository(), target.GetTag())
+	if err := target.PutABlob(blob, blobinfo); err != nil {
+		err = stallError(stall, err)
+		log.Errorf("Put blob %s(%v) to %s/%s:%s failed: %v", blobinfo.Digest, blobinfo.Size,
+			target.GetRegistry(), target.GetRepository(), target.GetTag(), err)
+		j.emit(progress.BlobAborted, digest, size)
+		if closeErr := blob.Close(); closeErr != nil {
+			return errors.Wrapf(err, " (close error: %v)", closeErr)
+		}
+		return err
+	}
+
+	j.emit(progress.BlobFinished, digest, size)
+	log.Infof("Put blob %s(%v) to %s/%s:%s success", blobinfo.Digest, blobinfo.Size,
+		target.GetRegistry(), target.GetRepository(), target.GetTag())
+	return nil
+}
+
+// copyBlobSpooled downloads a blob into spool and verifies it before uploading it from disk,
+// so a failed upload does not pull the blob again
+func (j *Job) copyBlobSpooled(source *ImageSource, target *ImageTarget, blobinfo types.BlobInfo, stall *watchdog) error {
+	digest := blobinfo.Digest.String()
+	file, err := spool.Open(blobinfo.Digest, blobinfo.Size, func(offset int64) (io.ReadCloser, error) {
+		blob, err := source.GetABlobRange(blobinfo.Digest, offset)
+		if err != nil {
+			return nil, err
+		}
+		stall.kick()
+		return stall.reader(blob), nil
+	})
+	if err == errSpoolFull {
+		return err
+	}
+	if err != nil {
+		err = stallError(stall, err)
+		log.Errorf("Get blob %s(%v) from %s/%s:%s to spool failed: %v", blobinfo.Digest, blobinfo.Size,
+			source.GetRegistry(), source.GetRepository(), source.GetTag(), err)
+		return err
+	}
+	defer spool.Release(blobinfo.Digest)
+	defer file.Close()
+	stall.kick()
+
+	open := func(offset int64) (io.ReadCloser, error) {
+		blob := ioutil.NopCloser(io.NewSectionReader(file, offset, blobinfo.Size-offset))
+		return progress.NewReader(stall.reader(blob), j.Progress, j.event(progress.BlobBytes, digest, 0)), nil
+	}
+
+	j.emit(progress.BlobStarted, digest, blobinfo.Size)
+	log.Infof("Putting blob %s(%v) from spool to %s/%s:%s", blobinfo.Digest, blobinfo.Size,
+		target.GetRegistry(), target.GetRepository(), target.GetTag())
+	if chunkSize > 0 && blobinfo.Size > chunkSize {
+		err = target.PutABlobChunked(open, blobinfo)
+	} else {
+		blob, _ := open(0)
+		err = target.PutABlob(blob, blobinfo)
+	}
+	if err != nil {
+		err = stallError(stall, err)
+		log.Errorf("Put blob %s(%v) to %s/%s:%s failed: %v", blobinfo.Digest, blobinfo.Size,
+			target.GetRegistry(), target.GetRepository(), target.GetTag(), err)
+		j.emit(progress.BlobAborted, digest, blobinfo.Size)
+		return err
+	}
+
+	j.emit(progress.BlobFinished, digest, blobinfo.Size)
+	log.Infof("Put blob %s(%v) to %s/%s:%s success", blobinfo.Digest, blobinfo.Size,
+		target.GetRegistry(), target.GetRepository(), target.GetTag())
+	return nil
+}
+
+// copyBlobChunked pushes a large blob in chunks, the content is pulled again by ranged
+// requests from the offset acknowledged by target if a chunk fails
+func (j *Job) copyBlobChunked(source *ImageSource, target *ImageTarget, blobinfo types.BlobInfo, stall *watchdog) error {
+	digest := blobinfo.Digest.String()
+	open := func(offset int64) (io.ReadCloser, error) {
+		blob, err := source.GetABlobRange(blobinfo.Digest, offset)
+		if err != nil {
+			log.Errorf("Get blob %s(%v) from %s/%s:%s at offset %d failed: %v", blobinfo.Digest, blobinfo.Size,
+				source.GetRegistry(), source.GetRepository(), source.GetTag(), offset, err)
+			return nil, err
+		}
+		stall.kick()
+		return progress.NewReader(stall.reader(blob), j.Progress, j.event(progress.BlobBytes, digest, 0)), nil
+	}
+
+	j.emit(progress.BlobStarted, digest, blobinfo.Size)
+	log.Infof("Putting blob %s(%v) to %s/%s:%s in chunks of %d bytes", blobinfo.Digest, blobinfo.Size,
+		target.GetRegistry(), target.GetRepository(), target.GetTag(), chunkSize)
+	if err := target.PutABlobChunked(open, blobinfo); err != nil {
+		err = stallError(stall, err)
+		log.Errorf("Put blob %s(%v) to %s/%s:%s failed: %v", blobinfo.Digest, blobinfo.Size,
+			target.GetRegistry(), target.GetRepository(), target.GetTag(), err)
+		j.emit(progress.BlobAborted, digest, blobinfo.Size)
+		return err
+	}
+
+	j.emit(progress.BlobFinished, digest, blobinfo.Size)
+	log.Infof("Put blob %s(%v) to %s/%s:%s success", blobinfo.Digest, blobinfo.Size,
+		target.GetRegistry(), target.GetRepository(), target.GetTag())
+	return nil
+}
+
+// stallError replaces the context cancelled error of a stalled blob copy
+func stallError(stall *watchdog, err error) error {
+	if !stall.Stalled() {
+		return err
+	}
+	metrics.TimeoutsTotal.WithLabelValues("blob_idle").Inc()
+	return fmt.Errorf("blob copy stalled, no data for %s: %v", timeouts.BlobIdle, err)
+}
+
+// String returns the source image url of the job
+func (j *Job) String() string {
+	return utils.JoinReference(j.Source.GetRegistry()+"/"+j.Source.GetRepository(), j.Source.GetTag())
+}
+
+// Emit sends a job event to the progress reporter of the job
+func (j *Job) Emit(t progress.EventType) {
+	j.emit(t, "", 0)
+}
+
+func (j *Job) emit(t progress.EventType, name string, size int64) {
+	if j.Progress != nil {
+		j.Progress.Emit(j.event(t, name, size))
+	}
+}
+
+// event returns an event of the job, name is the digest of blob events
+func (j *Job) event(t progress.EventType, name string, size int64) progress.Event {
+	target := utils.JoinReference(j.Target.GetRegistry()+"/"+j.Target.GetRepository(), j.Target.GetTag())
+	return progress.Event{Type: t, Job: j.String(), Target: target, Name: name, Size: size}
+}
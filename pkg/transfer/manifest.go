@@ -69,7 +69,7 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 			log.Infof("handle manifest OS:%s Architecture:%s ", manifestDescriptorElem.Platform.OS,
 				manifestDescriptorElem.Platform.Architecture)
 
-			subManifestByte, subManifestType, err := i.source.GetManifest(i.ctx, &manifestDescriptorElem.Digest)
+			subManifestByte, subManifestType, err := i.GetSubManifest(manifestDescriptorElem.Digest)
 			if err != nil {
 				log.Errorf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v",
 					manifestDescriptorElem.Digest, manifestDescriptorElem.Platform.OS,
@@ -111,7 +111,7 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 			log.Infof("handle OCI manifest OS:%s Architecture:%s ", descriptor.Platform.OS,
 				descriptor.Platform.Architecture)
 
-			subManifestByte, subManifestType, err := i.source.GetManifest(i.ctx, &descriptor.Digest)
+			subManifestByte, subManifestType, err := i.GetSubManifest(descriptor.Digest)
 			if err != nil {
 				log.Errorf("Get OCI manifest %v of OS:%s Architecture:%s for image index error: %v",
 					descriptor.Digest, descriptor.Platform.OS,
@@ -21,6 +21,7 @@ package transfer
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 
@@ -28,62 +29,59 @@ import (
 
 
 	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/types"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/metrics"
+	"tkestack.io/image-transfer/pkg/registry"
 	"tkestack.io/image-transfer/pkg/utils"
 )
 
 // ImageSource is a reference to a remote image need to be pulled.
 type ImageSource struct {
-	registry   string
+	registry string
+	// endpoint is the host serving registry, it is registry itself unless registry has mirrors
+	endpoint   string
 	repository string
 	tag        string
 	sourceRef  types.ImageReference
 	source     types.ImageSource
 	ctx        context.Context
 	sysctx     *types.SystemContext
+	// client sends requests not supported by source, e.g. ranged blob requests
+	client *registry.Client
 }
 
 // NewImageSource generates a PullJob by repository, the repository string must include "tag",
-// if username or password is empty, access to repository will be anonymous.
-// a repository string is the rest part of the images url except "tag" and "registry"
-func NewImageSource(registry, repository, tag, username, password string, insecure bool) (*ImageSource, error) {
+// if security has no credentials, access to repository will be anonymous.
+// a repository string is the rest part of the images url except "tag" and "registry", tag may be a digest
+func NewImageSource(ctx context.Context, registry, repository, tag string, security configs.Security) (*ImageSource, error) {
 	if utils.CheckIfIncludeTag(repository) {
 		return nil, fmt.Errorf("repository string should not include tag")
 	}
 
-	// tag may be empty
-	tagWithColon := ""
-	if tag != "" {
-		tagWithColon = ":" + tag
-	}
-
-	srcRef, err := docker.ParseReference("//" + registry + "/" + repository + tagWithColon)
+	// tag may be empty or a digest
+	srcRef, err := docker.ParseReference("//" + utils.JoinReference(registry+"/"+repository, tag))
 	if err != nil {
 		return nil, err
 	}
 
-	var sysctx *types.SystemContext
-	if insecure {
-		// destinatoin registry is http service
-		sysctx = &types.SystemContext{
-			DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
-		}
-	} else {
-		sysctx = &types.SystemContext{}
+	sysctx, err := newSystemContext(security)
+	if err != nil {
+		return nil, err
 	}
-
-	ctx := context.WithValue(context.Background(), interface{}("ImageSource"), repository)
-	if username != "" && password != "" {
-		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: username,
-			Password: password,
-		}
+	client, err := NewRegistryClient(registry, security)
+	if err != nil {
+		return nil, err
 	}
+	ctx = context.WithValue(ctx, interface{}("ImageSource"), repository)
 
 	var rawSource types.ImageSource
 	if tag != "" {
 		// if tag is empty, will attach to the "latest" tag, and will get a error if "latest" is not exist
-		rawSource, err = srcRef.NewImageSource(ctx, sysctx)
+		reqCtx, cancel := requestContext(ctx)
+		rawSource, err = srcRef.NewImageSource(reqCtx, sysctx)
+		cancel()
 		if err != nil {
 			return nil, err
 		}
@@ -94,18 +92,42 @@ func NewImageSource(registry, repository, tag, username, password string, insecu
 		source:     rawSource,
 		ctx:        ctx,
 		sysctx:     sysctx,
+		client:     client,
 		registry:   registry,
+		endpoint:   registry,
 		repository: repository,
 		tag:        tag,
 	}, nil
 }
 
+// WithContext returns a shallow copy of i whose requests use ctx
+func (i *ImageSource) WithContext(ctx context.Context) *ImageSource {
+	source := *i
+	source.ctx = ctx
+	return &source
+}
+
 // GetManifest get manifest file from source image
 func (i *ImageSource) GetManifest() ([]byte, string, error) {
 	if i.source == nil {
 		return nil, "", fmt.Errorf("can not get manifest file without specfied a tag")
 	}
-	return i.source.GetManifest(i.ctx, nil)
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	manifestByte, manifestType, err := i.source.GetManifest(ctx, nil)
+	metrics.ObserveRequest(i.registry, "get_manifest", start, err)
+	return manifestByte, manifestType, err
+}
+
+// GetSubManifest gets a manifest of a manifest list or an image index by digest
+func (i *ImageSource) GetSubManifest(d digest.Digest) ([]byte, string, error) {
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	manifestByte, manifestType, err := i.source.GetManifest(ctx, &d)
+	metrics.ObserveRequest(i.registry, "get_manifest", start, err)
+	return manifestByte, manifestType, err
 }
 
 // GetBlobInfos get blobs from source image.
@@ -140,7 +162,10 @@ func (i *ImageSource) GetBlobInfos(manifestByte []byte, manifestType string) ([]
 
 // GetABlob gets a blob from remote image
 func (i *ImageSource) GetABlob(blobInfo types.BlobInfo) (io.ReadCloser, int64, error) {
-	return i.source.GetBlob(i.ctx, types.BlobInfo{Digest: blobInfo.Digest, Size: -1}, NoCache)
+	start := time.Now()
+	blob, size, err := i.source.GetBlob(i.ctx, types.BlobInfo{Digest: blobInfo.Digest, Size: -1}, NoCache)
+	metrics.ObserveRequest(i.registry, "get_blob", start, err)
+	return blob, size, err
 }
 
 // Close an ImageSource
@@ -153,6 +178,11 @@ func (i *ImageSource) GetRegistry() string {
 	return i.registry
 }
 
+// GetEndpoint returns the host serving the registry of a ImageSource
+func (i *ImageSource) GetEndpoint() string {
+	return i.endpoint
+}
+
 // GetRepository returns the repository of a ImageSource
 func (i *ImageSource) GetRepository() string {
 	return i.repository
@@ -165,10 +195,52 @@ func (i *ImageSource) GetTag() string {
 
 // GetSourceRepoTags gets all the tags of a repository which ImageSource belongs to
 func (i *ImageSource) GetSourceRepoTags() ([]string, error) {
-	return docker.GetRepositoryTags(i.ctx, i.sysctx, i.sourceRef)
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	tags, err := docker.GetRepositoryTags(ctx, i.sysctx, i.sourceRef)
+	metrics.ObserveRequest(i.registry, "list_tags", start, err)
+	return tags, err
 }
 
 // GetImageDigest checks if a tag exist for target, return target tag of digest
 func (i *ImageSource) GetImageDigest() (digest.Digest, error) {
-	return docker.GetDigest(i.ctx, i.sysctx, i.sourceRef)
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	d, err := docker.GetDigest(ctx, i.sysctx, i.sourceRef)
+	metrics.ObserveRequest(i.registry, "get_digest", start, err)
+	return d, err
+}
+
+// GetCreated gets the created time in the image config of a tag of the repository, the image of
+// the current platform is inspected if the tag is a manifest list. It is zero if the config has no created time
+func (i *ImageSource) GetCreated(tag string) (time.Time, error) {
+	named, err := reference.WithTag(reference.TrimNamed(i.sourceRef.DockerReference()), tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ref, err := docker.NewReference(named)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	img, err := ref.NewImage(ctx, i.sysctx)
+	if err != nil {
+		metrics.ObserveRequest(i.registry, "get_config", start, err)
+		return time.Time{}, err
+	}
+	defer img.Close()
+	info, err := img.Inspect(ctx)
+	metrics.ObserveRequest(i.registry, "get_config", start, err)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info.Created == nil {
+		return time.Time{}, nil
+	}
+	return *info.Created, nil
 }
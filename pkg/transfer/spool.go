@@ -0,0 +1,275 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// spoolRetries is the number of times a failed blob download to spool is resumed
+const spoolRetries = 3
+
+// errSpoolFull means a blob does not fit into the spool, it is copied without spool
+var errSpoolFull = errors.New("spool is full")
+
+// spool is nil if blobs are streamed from source to target directly
+var spool *Spool
+
+// Spool is a local cache directory of blobs bounded by size, blobs are downloaded and
+// verified into it before being uploaded, the least recently used blobs are evicted first
+type Spool struct {
+	dir   string
+	limit int64
+
+	mutex sync.Mutex
+	// size is the total size of entries and space reserved by downloads
+	size    int64
+	entries map[digest.Digest]*spoolEntry
+}
+
+type spoolEntry struct {
+	size     int64
+	lastUsed time.Time
+	// refs is the number of readers of the blob, a blob in use is not evicted
+	refs int
+}
+
+// UseSpool downloads blobs into dir before uploading them, limit is the max total size of blobs in bytes
+func UseSpool(dir string, limit int64) error {
+	s, err := NewSpool(dir, limit)
+	if err != nil {
+		return err
+	}
+	spool = s
+	return nil
+}
+
+// NewSpool creates a Spool in dir, blobs left by previous runs are kept and reused
+func NewSpool(dir string, limit int64) (*Spool, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("spool size should be larger than 0")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create spool dir %s error: %v", dir, err)
+	}
+
+	s := &Spool{dir: dir, limit: limit, entries: make(map[digest.Digest]*spoolEntry)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		// downloads interrupted by a previous run
+		if strings.HasSuffix(path, ".tmp") {
+			return os.Remove(path)
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		d := digest.Digest(strings.Replace(filepath.ToSlash(rel), "/", ":", 1))
+		if d.Validate() != nil {
+			return nil
+		}
+		s.entries[d] = &spoolEntry{size: info.Size(), lastUsed: info.ModTime()}
+		s.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load spool dir %s error: %v", dir, err)
+	}
+
+	s.mutex.Lock()
+	s.evict(0)
+	s.mutex.Unlock()
+	log.Infof("Spool %s has %d blobs, %d bytes", dir, len(s.entries), s.size)
+	return s, nil
+}
+
+func (s *Spool) path(d digest.Digest) string {
+	return filepath.Join(s.dir, d.Algorithm().String(), d.Hex())
+}
+
+// Open returns the blob d in spool, fetch is called to download it from an offset if it is not
+// in spool. The caller should call Release after the returned file is closed
+func (s *Spool) Open(d digest.Digest, size int64, fetch func(offset int64) (io.ReadCloser, error)) (*os.File, error) {
+	if f, ok := s.acquire(d); ok {
+		log.Infof("Blob %s is found in spool", d)
+		return f, nil
+	}
+
+	if !s.reserve(size) {
+		return nil, errSpoolFull
+	}
+	err := s.download(d, size, fetch)
+	s.mutex.Lock()
+	s.size -= size
+	if err == nil {
+		if _, ok := s.entries[d]; !ok {
+			s.entries[d] = &spoolEntry{size: size}
+			s.size += size
+		}
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := s.acquire(d); ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("blob %s is evicted from spool", d)
+}
+
+// Release marks the blob d opened by Open is not used
+func (s *Spool) Release(d digest.Digest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e, ok := s.entries[d]; ok && e.refs > 0 {
+		e.refs--
+	}
+}
+
+func (s *Spool) acquire(d digest.Digest) (*os.File, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.entries[d]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(s.path(d))
+	if err != nil {
+		log.Warnf("Open blob %s in spool error: %v", d, err)
+		s.remove(d)
+		return nil, false
+	}
+	e.refs++
+	e.lastUsed = time.Now()
+	return f, true
+}
+
+// reserve evicts blobs until size fits into spool and counts it, false if it does not fit
+func (s *Spool) reserve(size int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.evict(size) {
+		return false
+	}
+	s.size += size
+	return true
+}
+
+// evict removes the least recently used blobs not in use until size more bytes fit into spool
+func (s *Spool) evict(size int64) bool {
+	if s.size+size <= s.limit {
+		return true
+	}
+
+	var candidates []digest.Digest
+	for d, e := range s.entries {
+		if e.refs == 0 {
+			candidates = append(candidates, d)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return s.entries[candidates[i]].lastUsed.Before(s.entries[candidates[j]].lastUsed)
+	})
+	for _, d := range candidates {
+		if s.size+size <= s.limit {
+			break
+		}
+		log.Debugf("Evict blob %s from spool", d)
+		s.remove(d)
+	}
+	return s.size+size <= s.limit
+}
+
+func (s *Spool) remove(d digest.Digest) {
+	if err := os.Remove(s.path(d)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Remove blob %s from spool error: %v", d, err)
+	}
+	s.size -= s.entries[d].size
+	delete(s.entries, d)
+}
+
+// download fetches blob d into a temporary file, resumes it from the downloaded size on failure,
+// and moves it into spool after its digest is verified
+func (s *Spool) download(d digest.Digest, size int64, fetch func(offset int64) (io.ReadCloser, error)) error {
+	path := s.path(d)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), d.Hex()+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var offset int64
+	for retries := 0; offset < size; retries++ {
+		if retries > 0 {
+			// the job is aborted, e.g. by a stall or a cancellation
+			if retries > spoolRetries || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+			log.Warnf("Download blob %s to spool failed at offset %d, resume it: %v", d, offset, err)
+			time.Sleep(time.Duration(retries) * time.Second)
+		}
+
+		var blob io.ReadCloser
+		if blob, err = fetch(offset); err != nil {
+			continue
+		}
+		var n int64
+		n, err = io.Copy(tmp, io.LimitReader(blob, size-offset))
+		blob.Close()
+		offset += n
+		if err == nil && offset < size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, tmp); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("digest of blob %s downloaded to spool does not match", d)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,172 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/registry"
+)
+
+// certDirs caches the directories generated for caFile, certFile and keyFile of security settings,
+// so clients of the same settings share one. They are created in base, a private temporary directory
+// of the process, which is removed by RemoveCertDirs
+var certDirs = struct {
+	sync.Mutex
+	base string
+	m    map[string]string
+}{m: make(map[string]string)}
+
+// newSystemContext creates the SystemContext of a registry from its security settings
+func newSystemContext(security configs.Security) (*types.SystemContext, error) {
+	sysctx := &types.SystemContext{}
+	if security.Insecure || security.PlainHTTP {
+		// containers/image can not be forced to use plain http, it tries https first and only falls back
+		// to http if certificate verification is skipped. So PlainHTTP is the same as Insecure here,
+		// while the registry client of NewRegistryClient sends plain http only
+		sysctx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	dir, err := certDir(security)
+	if err != nil {
+		return nil, err
+	}
+	sysctx.DockerCertPath = dir
+
+	if security.RegistryToken != "" {
+		sysctx.DockerBearerRegistryToken = security.RegistryToken
+	} else if (security.Username != "" && security.Password != "") || security.IdentityToken != "" {
+		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username:      security.Username,
+			Password:      security.Password,
+			IdentityToken: security.IdentityToken,
+		}
+	}
+	return sysctx, nil
+}
+
+// NewRegistryClient creates a client of the distribution API with the same settings as newSystemContext
+func NewRegistryClient(host string, security configs.Security) (*registry.Client, error) {
+	dir, err := certDir(security)
+	if err != nil {
+		return nil, err
+	}
+	return registry.NewClient(host, registry.Credentials{
+		Username:      security.Username,
+		Password:      security.Password,
+		IdentityToken: security.IdentityToken,
+		RegistryToken: security.RegistryToken,
+	}, registry.Options{
+		Insecure:  security.Insecure,
+		PlainHTTP: security.PlainHTTP,
+		CertDir:   dir,
+	})
+}
+
+// certDir returns the certs.d like directory of security. Both containers/image and the registry client
+// only read certificates from a directory, so a directory linking caFile, certFile, keyFile and the
+// files of certDir is generated if any of the files is set
+func certDir(security configs.Security) (string, error) {
+	if security.CAFile == "" && security.CertFile == "" && security.KeyFile == "" {
+		return security.CertDir, nil
+	}
+
+	key := security.CAFile + "\x00" + security.CertFile + "\x00" + security.KeyFile + "\x00" + security.CertDir
+	certDirs.Lock()
+	defer certDirs.Unlock()
+	if dir, ok := certDirs.m[key]; ok {
+		return dir, nil
+	}
+
+	// the base directory has a random name and mode 0700, other users can not plant certificates in it
+	if certDirs.base == "" {
+		base, err := ioutil.TempDir("", "image-transfer-certs-")
+		if err != nil {
+			return "", fmt.Errorf("create certificate directory error: %v", err)
+		}
+		certDirs.base = base
+	}
+	sum := sha256.Sum256([]byte(key))
+	dir := filepath.Join(certDirs.base, hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("create certificate directory error: %v", err)
+	}
+
+	links := map[string]string{}
+	if security.CertDir != "" {
+		files, err := ioutil.ReadDir(security.CertDir)
+		if err != nil {
+			return "", fmt.Errorf("read certDir %s error: %v", security.CertDir, err)
+		}
+		for _, file := range files {
+			links[file.Name()] = filepath.Join(security.CertDir, file.Name())
+		}
+	}
+	for name, path := range map[string]string{"ca.crt": security.CAFile, "client.cert": security.CertFile,
+		"client.key": security.KeyFile} {
+		if path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return "", fmt.Errorf("certificate file error: %v", err)
+		}
+		links[name] = abs
+	}
+
+	for name, path := range links {
+		link := filepath.Join(dir, name)
+		if target, err := os.Readlink(link); err == nil && target == path {
+			continue
+		}
+		os.Remove(link)
+		if err := os.Symlink(path, link); err != nil {
+			return "", fmt.Errorf("link certificate file %s error: %v", path, err)
+		}
+	}
+	certDirs.m[key] = dir
+	return dir, nil
+}
+
+// RemoveCertDirs removes the certificate directories generated for security settings, it is called
+// when the process exits
+func RemoveCertDirs() {
+	certDirs.Lock()
+	defer certDirs.Unlock()
+	if certDirs.base == "" {
+		return
+	}
+	if err := os.RemoveAll(certDirs.base); err != nil {
+		log.Warnf("Remove certificate directory %s error: %v", certDirs.base, err)
+	}
+	certDirs.base = ""
+	certDirs.m = make(map[string]string)
+}
@@ -0,0 +1,73 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tkestack.io/image-transfer/configs"
+)
+
+func TestCertDir(t *testing.T) {
+	files, err := ioutil.TempDir("", "certs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(files) })
+	caFile := filepath.Join(files, "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte("ca"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveCertDirs()
+
+	security := configs.Security{CAFile: caFile}
+	dir, err := certDir(security)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "ca.crt")); err != nil || target != caFile {
+		t.Fatalf("ca.crt links to %q, error %v, expect %q", target, err, caFile)
+	}
+
+	// clients of the same settings share the directory
+	for i := 0; i < 3; i++ {
+		again, err := certDir(security)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != dir {
+			t.Fatalf("certDir returns %s, expect %s", again, dir)
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d certificate directories are created, expect 1", len(entries))
+	}
+
+	RemoveCertDirs()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("certificate directory %s is not removed: %v", dir, err)
+	}
+}
@@ -22,63 +22,61 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 
 	"github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/types"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/metrics"
+	"tkestack.io/image-transfer/pkg/registry"
 	"tkestack.io/image-transfer/pkg/utils"
 )
 
 // ImageTarget is a reference of a remote image we will push to
 type ImageTarget struct {
-	registry   string
+	registry string
+	// endpoint is the host serving registry, it is registry itself unless registry has mirrors
+	endpoint   string
 	repository string
 	tag        string
 	targetRef  types.ImageReference
 	target     types.ImageDestination
 	ctx        context.Context
 	sysctx    *types.SystemContext
+	// client sends requests not supported by target, e.g. chunked uploads
+	client *registry.Client
+	// uploads keeps failed chunked uploads, they are resumed when the job is retried
+	uploads *uploadSessions
 }
 
 // NewImageTarget generates a ImageTarget by repository, the repository string must include "tag".
-// If username or password is empty, access to repository will be anonymous.
-func NewImageTarget(registry, repository, tag, username, password string, insecure bool) (*ImageTarget, error) {
+// If security has no credentials, access to repository will be anonymous.
+func NewImageTarget(ctx context.Context, registry, repository, tag string, security configs.Security) (*ImageTarget, error) {
 	if utils.CheckIfIncludeTag(repository) {
 		return nil, fmt.Errorf("repository string should not include tag")
 	}
 
-	// tag may be empty
-	tagWithColon := ""
-	if tag != "" {
-		tagWithColon = ":" + tag
-	}
-
-	// if tag is empty, will attach to the "latest" tag
-	destRef, err := docker.ParseReference("//" + registry + "/" + repository + tagWithColon)
+	// if tag is empty, will attach to the "latest" tag, tag may be a digest
+	destRef, err := docker.ParseReference("//" + utils.JoinReference(registry+"/"+repository, tag))
 	if err != nil {
 		return nil, err
 	}
 
-	var sysctx *types.SystemContext
-	if insecure {
-		// destinatoin registry is http service
-		sysctx = &types.SystemContext{
-			DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
-		}
-	} else {
-		sysctx = &types.SystemContext{}
+	sysctx, err := newSystemContext(security)
+	if err != nil {
+		return nil, err
 	}
-
-	ctx := context.WithValue(context.Background(), interface{}("ImageTarget"), repository)
-	if username != "" && password != "" {
-		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: username,
-			Password: password,
-		}
+	client, err := NewRegistryClient(registry, security)
+	if err != nil {
+		return nil, err
 	}
+	ctx = context.WithValue(ctx, interface{}("ImageTarget"), repository)
 
-	rawtarget, err := destRef.NewImageDestination(ctx, sysctx)
+	reqCtx, cancel := requestContext(ctx)
+	rawtarget, err := destRef.NewImageDestination(reqCtx, sysctx)
+	cancel()
 	if err != nil {
 		return nil, err
 	}
@@ -88,23 +86,51 @@ func NewImageTarget(registry, repository, tag, username, password string, insecu
 		target:    rawtarget,
 		ctx:       ctx,
 		sysctx: sysctx,
+		client: client,
+		uploads:    newUploadSessions(),
 		registry:   registry,
+		endpoint:   registry,
 		repository: repository,
 		tag:        tag,
 	}, nil
 }
 
+// WithContext returns a shallow copy of i whose requests use ctx
+func (i *ImageTarget) WithContext(ctx context.Context) *ImageTarget {
+	target := *i
+	target.ctx = ctx
+	return &target
+}
+
 // PushManifest push a manifest file to target image
 func (i *ImageTarget) PushManifest(manifestByte []byte) error {
-	return i.target.PutManifest(i.ctx, manifestByte, nil)
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	err := i.target.PutManifest(ctx, manifestByte, nil)
+	metrics.ObserveRequest(i.registry, "put_manifest", start, err)
+	return err
+}
+
+// PushSubManifest pushes a manifest of a manifest list or an image index by its digest d,
+// the reference of target refers to the list as a whole and may be a digest
+func (i *ImageTarget) PushSubManifest(manifestByte []byte, d digest.Digest) error {
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	err := i.target.PutManifest(ctx, manifestByte, &d)
+	metrics.ObserveRequest(i.registry, "put_manifest", start, err)
+	return err
 }
 
 // PutABlob push a blob to target image
 func (i *ImageTarget) PutABlob(blob io.ReadCloser, blobInfo types.BlobInfo) error {
+	start := time.Now()
 	_, err := i.target.PutBlob(i.ctx, blob, types.BlobInfo{
 		Digest: blobInfo.Digest,
 		Size:   blobInfo.Size,
 	}, Memory, true)
+	metrics.ObserveRequest(i.registry, "put_blob", start, err)
 
 	// io.ReadCloser need to be close
 	defer blob.Close()
@@ -114,16 +140,21 @@ func (i *ImageTarget) PutABlob(blob io.ReadCloser, blobInfo types.BlobInfo) erro
 
 // CheckBlobExist checks if a blob exist for target and reuse exist blobs
 func (i *ImageTarget) CheckBlobExist(blobInfo types.BlobInfo) (bool, error) {
-	exist, _, err := i.target.TryReusingBlob(i.ctx, types.BlobInfo{
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	exist, _, err := i.target.TryReusingBlob(ctx, types.BlobInfo{
 		Digest: blobInfo.Digest,
 		Size:   blobInfo.Size,
 	}, Memory, false)
+	metrics.ObserveRequest(i.registry, "check_blob", start, err)
 
 	return exist, err
 }
 
-// Close a ImageTarget
+// Close a ImageTarget, the chunked uploads kept for retries are cancelled
 func (i *ImageTarget) Close() error {
+	i.cancelUploads()
 	return i.target.Close()
 }
 
@@ -132,6 +163,11 @@ func (i *ImageTarget) GetRegistry() string {
 	return i.registry
 }
 
+// GetEndpoint returns the host serving the registry of a ImageTarget
+func (i *ImageTarget) GetEndpoint() string {
+	return i.endpoint
+}
+
 // GetRepository returns the repository of a ImageTarget
 func (i *ImageTarget) GetRepository() string {
 	return i.repository
@@ -144,12 +180,21 @@ func (i *ImageTarget) GetTag() string {
 
 // GetImageDigest checks if a tag exist for target, return target tag of digest
 func (i *ImageTarget) GetImageDigest() (digest.Digest, error) {
-	return docker.GetDigest(i.ctx, i.sysctx, i.targetRef)
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	d, err := docker.GetDigest(ctx, i.sysctx, i.targetRef)
+	metrics.ObserveRequest(i.registry, "get_digest", start, err)
+	return d, err
 }
 
 // GetTargetRepoTags gets all the tags of a repository which ImageTarget belongs to
 func (i *ImageTarget) GetTargetRepoTags() ([]string, error) {
-	tags, err := docker.GetRepositoryTags(i.ctx, i.sysctx, i.targetRef)
+	start := time.Now()
+	ctx, cancel := requestContext(i.ctx)
+	defer cancel()
+	tags, err := docker.GetRepositoryTags(ctx, i.sysctx, i.targetRef)
+	metrics.ObserveRequest(i.registry, "list_tags", start, err)
 	if err != nil && utils.IsTagsNotFound(err) {
 		return nil, nil
 	}
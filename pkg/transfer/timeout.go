@@ -0,0 +1,125 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Timeouts limits the time of registry operations, a zero value means no limit
+type Timeouts struct {
+	// Request limits a manifest, tag or blob existence API call
+	Request time.Duration
+	// Job limits a whole run of a job, including all its blobs and manifests
+	Job time.Duration
+	// BlobIdle aborts a blob copy if no bytes are read from source for this long
+	BlobIdle time.Duration
+}
+
+// timeouts used by all image sources, targets and jobs
+var timeouts Timeouts
+
+// SetTimeouts sets the timeouts of registry operations
+func SetTimeouts(t Timeouts) {
+	timeouts = t
+}
+
+// requestContext returns a context of ctx limited by the request timeout
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeouts.Request <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeouts.Request)
+}
+
+// jobContext returns a context of ctx limited by the job timeout
+func jobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeouts.Job <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeouts.Job)
+}
+
+// watchdog calls abort if it is not kicked for timeout, so a stalled blob copy
+// blocked in a request of source or target is released by the cancelled context
+type watchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+
+	mutex sync.Mutex
+	// stalled is true if abort is called by the watchdog
+	stalled bool
+}
+
+// newWatchdog starts a watchdog, it does nothing if timeout is zero
+func newWatchdog(timeout time.Duration, abort func()) *watchdog {
+	w := &watchdog{timeout: timeout}
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() {
+			w.mutex.Lock()
+			w.stalled = true
+			w.mutex.Unlock()
+			abort()
+		})
+	}
+	return w
+}
+
+// kick resets the watchdog
+func (w *watchdog) kick() {
+	if w.timer != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// stop stops the watchdog
+func (w *watchdog) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Stalled returns true if abort is called because the watchdog is not kicked in time
+func (w *watchdog) Stalled() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.stalled
+}
+
+// reader returns a reader of rc which kicks the watchdog when bytes are read
+func (w *watchdog) reader(rc io.ReadCloser) io.ReadCloser {
+	return &watchdogReader{ReadCloser: rc, watchdog: w}
+}
+
+type watchdogReader struct {
+	io.ReadCloser
+	watchdog *watchdog
+}
+
+// Read implements io.Reader
+func (r *watchdogReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.watchdog.kick()
+	}
+	return n, err
+}
@@ -20,10 +20,26 @@ package utils
 
 import (
 	"fmt"
+	"path"
+	"regexp"
 	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/opencontainers/go-digest"
 )
 
-// The RepoURL will divide a images url to <registry>/<namespace>/<repo>:<tag>
+// DefaultRegistry is the registry of an image url without registry
+const DefaultRegistry = "registry.hub.docker.com"
+
+// WildcardSuffix ends a rule source matching all repositories under a registry or namespace
+const WildcardSuffix = "/*"
+
+// anchoredTagRegexp matches a whole tag
+var anchoredTagRegexp = regexp.MustCompile(`^` + reference.TagRegexp.String() + `$`)
+
+// The RepoURL will divide a images url to <registry>/<namespace>/<repo>:<tag>@<digest> following the
+// distribution reference grammar. registry may have a port, repo may have several path components,
+// tag may be several tags separated by commas, and tag and digest are optional
 type RepoURL struct {
 	// origin url
 	url string
@@ -32,62 +48,73 @@ type RepoURL struct {
 	namespace string
 	repo      string
 	tag       string
+	digest    string
 }
 
-// NewRepoURL creates a RepoURL
+// NewRepoURL creates a RepoURL. The first path component is the registry if the url has three or more
+// components, e.g. harbor/ns/repo, or if it contains "." or ":" or is "localhost" in a two component url,
+// otherwise the registry is registry.hub.docker.com and a single component repository is in namespace library
 func NewRepoURL(url string) (*RepoURL, error) {
-	// split to registry/namespace/repoAndTag
-	slice := strings.SplitN(url, "/", 3)
-
-	var tag, repo string
-	repoAndTag := slice[len(slice)-1]
-	s := strings.Split(repoAndTag, ":")
-	if len(s) > 2 {
-		return nil, fmt.Errorf("invalid repository url: %v", url)
-	} else if len(s) == 2 {
-		repo = s[0]
-		tag = s[1]
-	} else {
-		repo = s[0]
-		tag = ""
-	}
-
-	if len(slice) == 3 {
-		return &RepoURL{
-			url:       url,
-			registry:  slice[0],
-			namespace: slice[1],
-			repo:      repo,
-			tag:       tag,
-		}, nil
-	} else if len(slice) == 2 {
-		// if first string is a domain
-		if strings.Contains(slice[0], ".") {
-			return &RepoURL{
-				url:       url,
-				registry:  slice[0],
-				namespace: "",
-				repo:      repo,
-				tag:       tag,
-			}, nil
+	name := url
+	r := &RepoURL{url: url}
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		d, err := digest.Parse(name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest of repository url %v: %v", url, err)
 		}
+		r.digest = d.String()
+		name = name[:i]
+	}
+
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		r.tag = name[i+1:]
+		name = name[:i]
+		for _, tag := range strings.Split(r.tag, ",") {
+			if !anchoredTagRegexp.MatchString(tag) {
+				return nil, fmt.Errorf("invalid tag %q of repository url: %v", tag, url)
+			}
+		}
+	}
+
+	path := name
+	r.registry = DefaultRegistry
+	if i := strings.Index(name, "/"); i >= 0 && (strings.Count(name, "/") >= 2 ||
+		strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		r.registry = name[:i]
+		path = name[i+1:]
+	} else if i < 0 {
+		path = "library/" + name
+	}
 
-		return &RepoURL{
-			url:       url,
-			registry:  "registry.hub.docker.com",
-			namespace: slice[0],
-			repo:      repo,
-			tag:       tag,
-		}, nil
+	// parsed without normalization, so a registry without "." is kept as is
+	if _, err := reference.Parse(r.registry + "/" + path); err != nil {
+		return nil, fmt.Errorf("invalid repository url %v: %v", url, err)
+	}
+
+	if i := strings.Index(path, "/"); i >= 0 {
+		r.namespace = path[:i]
+		r.repo = path[i+1:]
 	} else {
-		return &RepoURL{
-			url:       url,
-			registry:  "registry.hub.docker.com",
-			namespace: "library",
-			repo:      repo,
-			tag:       tag,
-		}, nil
+		r.repo = path
+	}
+	return r, nil
+}
+
+// JoinReference appends a tag or a digest to a repository name
+func JoinReference(name, ref string) string {
+	if ref == "" {
+		return name
+	}
+	if IsDigest(ref) {
+		return name + "@" + ref
 	}
+	return name + ":" + ref
+}
+
+// IsDigest returns true if ref is a digest rather than a tag, tags can not contain ":"
+func IsDigest(ref string) bool {
+	return strings.Contains(ref, ":")
 }
 
 // GetURL returns the whole url
@@ -96,6 +123,9 @@ func (r *RepoURL) GetURL() string {
 	if r.tag != "" {
 		url = url + ":" + r.tag
 	}
+	if r.digest != "" {
+		url = url + "@" + r.digest
+	}
 	return url
 }
 
@@ -124,6 +154,20 @@ func (r *RepoURL) GetTag() string {
 	return r.tag
 }
 
+// GetDigest returns the digest in a url
+func (r *RepoURL) GetDigest() string {
+	return r.digest
+}
+
+// GetReference returns the digest in a url if it has one, otherwise the tag,
+// images are pulled and pushed by it
+func (r *RepoURL) GetReference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
 // GetRepoWithNamespace returns namespace/repository in a url
 func (r *RepoURL) GetRepoWithNamespace() string {
 	if r.namespace == "" {
@@ -132,12 +176,9 @@ func (r *RepoURL) GetRepoWithNamespace() string {
 	return r.namespace + "/" + r.repo
 }
 
-// GetRepoWithTag returns repository:tag in a url
+// GetRepoWithTag returns repository:tag or repository@digest in a url
 func (r *RepoURL) GetRepoWithTag() string {
-	if r.tag == "" {
-		return r.repo
-	}
-	return r.repo + ":" + r.tag
+	return JoinReference(r.repo, r.GetReference())
 }
 
 // GetURLWithoutTag returns registry/namespace/repository in a url
@@ -148,9 +189,50 @@ func (r *RepoURL) GetURLWithoutTag() string {
 	return r.registry + "/" + r.namespace + "/" + r.repo
 }
 
-// CheckIfIncludeTag checks if a repository string includes tag
+// IsWildcardURL reports whether url is like registry/* or registry/namespace/*
+func IsWildcardURL(url string) bool {
+	return strings.HasSuffix(url, WildcardSuffix)
+}
+
+// CheckIfIncludeTag checks if a repository string includes tag or digest,
+// a colon before the last path component is a registry port
 func CheckIfIncludeTag(repository string) bool {
-	return strings.Contains(repository, ":")
+	last := repository[strings.LastIndex(repository, "/")+1:]
+	return strings.ContainsAny(last, ":@")
+}
+
+// NameFilter selects names by glob patterns of path.Match, a name is selected if it matches
+// one of Include or Include is empty, and matches none of Exclude
+type NameFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Validate checks the syntax of the patterns
+func (f NameFilter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether name is selected by the filter
+func (f NameFilter) Match(name string) bool {
+	if len(f.Include) != 0 && !matchAny(f.Include, name) {
+		return false
+	}
+	return !matchAny(f.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
 }
 
 // IsContain judge the item is in items or not
@@ -0,0 +1,70 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import "testing"
+
+func TestNewRepoURL(t *testing.T) {
+	const d = "sha256:3708aa6feb7aa84d1689ed60b621e8ea0a5f84848da4732afe174172e8e6aacb"
+	for _, tc := range []struct {
+		url       string
+		registry  string
+		namespace string
+		repo      string
+		tag       string
+		digest    string
+		reference string
+	}{
+		{url: "nginx", registry: DefaultRegistry, namespace: "library", repo: "nginx"},
+		{url: "nginx:1.19", registry: DefaultRegistry, namespace: "library", repo: "nginx", tag: "1.19", reference: "1.19"},
+		{url: "myorg/app:v1,v2", registry: DefaultRegistry, namespace: "myorg", repo: "app", tag: "v1,v2", reference: "v1,v2"},
+		{url: "localhost/app", registry: "localhost", repo: "app"},
+		{url: "registry.example.com:5000/team/app:v1", registry: "registry.example.com:5000",
+			namespace: "team", repo: "app", tag: "v1", reference: "v1"},
+		{url: "127.0.0.1:5000/team/sub/app", registry: "127.0.0.1:5000", namespace: "team", repo: "sub/app"},
+		{url: "registry/a/b/c:tag", registry: "registry", namespace: "a", repo: "b/c", tag: "tag", reference: "tag"},
+		{url: "harbor/ns/repo", registry: "harbor", namespace: "ns", repo: "repo"},
+		{url: "registry.example.com/app", registry: "registry.example.com", repo: "app"},
+		{url: "registry.example.com:5000/team/sub/app@" + d, registry: "registry.example.com:5000",
+			namespace: "team", repo: "sub/app", digest: d, reference: d},
+		{url: "registry.example.com/team/app:v1@" + d, registry: "registry.example.com",
+			namespace: "team", repo: "app", tag: "v1", digest: d, reference: d},
+	} {
+		r, err := NewRepoURL(tc.url)
+		if err != nil {
+			t.Errorf("NewRepoURL(%q) error: %v", tc.url, err)
+			continue
+		}
+		if r.GetRegistry() != tc.registry || r.GetNamespace() != tc.namespace || r.GetRepo() != tc.repo ||
+			r.GetTag() != tc.tag || r.GetDigest() != tc.digest || r.GetReference() != tc.reference {
+			t.Errorf("NewRepoURL(%q) = %s, %s, %s, %s, %s, %s", tc.url, r.GetRegistry(), r.GetNamespace(),
+				r.GetRepo(), r.GetTag(), r.GetDigest(), r.GetReference())
+		}
+	}
+
+	for _, url := range []string{
+		"registry.example.com/team/app:v1@sha256:invalid",
+		"registry.example.com/team/app:-v1",
+		"registry.example.com/Team/app",
+	} {
+		if _, err := NewRepoURL(url); err == nil {
+			t.Errorf("NewRepoURL(%q) should fail", url)
+		}
+	}
+}
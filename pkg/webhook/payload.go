@@ -0,0 +1,155 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// KindHarbor is the payload of Harbor webhook, TCR Enterprise uses the same format
+	KindHarbor = "harbor"
+	// KindTCR is the payload of TCR Enterprise webhook trigger
+	KindTCR = "tcr"
+	// KindRegistry is the payload of Docker Registry notifications endpoint
+	KindRegistry = "registry"
+)
+
+// PushEvent is an image tag pushed to a registry
+type PushEvent struct {
+	// Registry may be empty if the payload does not contain the registry host
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// URL returns registry/repository:tag of the pushed image
+func (e PushEvent) URL() string {
+	url := e.Repository + ":" + e.Tag
+	if e.Registry != "" {
+		url = e.Registry + "/" + url
+	}
+	return url
+}
+
+// harborPayload is the payload of Harbor v1/v2 and TCR Enterprise webhook
+type harborPayload struct {
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			Digest      string `json:"digest"`
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			Name         string `json:"name"`
+			Namespace    string `json:"namespace"`
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// registryPayload is the envelope of Docker Registry notifications
+type registryPayload struct {
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			MediaType  string `json:"mediaType"`
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+			Digest     string `json:"digest"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+}
+
+// ParsePushEvents parses the payload of kind and returns the pushed tags, other events are ignored
+func ParsePushEvents(kind string, body []byte) ([]PushEvent, error) {
+	switch kind {
+	case KindHarbor, KindTCR:
+		return parseHarbor(body)
+	case KindRegistry:
+		return parseRegistry(body)
+	default:
+		return nil, fmt.Errorf("unsupported webhook kind %q", kind)
+	}
+}
+
+func parseHarbor(body []byte) ([]PushEvent, error) {
+	var payload harborPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("unmarshal harbor payload error: %v", err)
+	}
+
+	// harbor v1 and tcr use pushImage, harbor v2 uses PUSH_ARTIFACT
+	if payload.Type != "pushImage" && payload.Type != "PUSH_ARTIFACT" {
+		return nil, nil
+	}
+
+	repository := payload.EventData.Repository.RepoFullName
+	if repository == "" {
+		repository = payload.EventData.Repository.Namespace + "/" + payload.EventData.Repository.Name
+	}
+
+	var events []PushEvent
+	for _, res := range payload.EventData.Resources {
+		if res.Tag == "" {
+			continue
+		}
+		// resource_url is registry/namespace/repo:tag or registry/namespace/repo@digest
+		registry := ""
+		if i := strings.Index(res.ResourceURL, "/"); i > 0 {
+			registry = res.ResourceURL[:i]
+		}
+		events = append(events, PushEvent{
+			Registry:   registry,
+			Repository: repository,
+			Tag:        res.Tag,
+			Digest:     res.Digest,
+		})
+	}
+	return events, nil
+}
+
+func parseRegistry(body []byte) ([]PushEvent, error) {
+	var payload registryPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("unmarshal registry notification error: %v", err)
+	}
+
+	var events []PushEvent
+	for _, ev := range payload.Events {
+		// blob pushes are notified too, only manifests pushed by tag are interesting
+		if ev.Action != "push" || ev.Target.Tag == "" {
+			continue
+		}
+		events = append(events, PushEvent{
+			Registry:   ev.Request.Host,
+			Repository: ev.Target.Repository,
+			Tag:        ev.Target.Tag,
+			Digest:     ev.Target.Digest,
+		})
+	}
+	return events, nil
+}
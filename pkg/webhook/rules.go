@@ -0,0 +1,125 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package webhook
+
+import (
+	"sort"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// MatchRules maps a pushed tag against the rules of a rule file and returns
+// the source and target urls with tag to be transferred, ok is false if no rule matches.
+// If the event has no registry, only the repository of rules is compared.
+// If several rules match, the most specific one is used: a rule of the repository is preferred to
+// a wildcard rule, a rule with tags to a rule without tags, and then the longest rule source
+func MatchRules(rules map[string]string, ev PushEvent) (source string, target string, ok bool) {
+	ruleSources := make([]string, 0, len(rules))
+	for ruleSource := range rules {
+		ruleSources = append(ruleSources, ruleSource)
+	}
+	sort.Strings(ruleSources)
+
+	best := -1
+	for _, ruleSource := range ruleSources {
+		matchedSource, matchedTarget, matched := matchRule(ruleSource, rules[ruleSource], ev)
+		if !matched {
+			continue
+		}
+		if score := ruleSpecificity(ruleSource); score > best {
+			best = score
+			source, target, ok = matchedSource, matchedTarget, true
+		}
+	}
+	return source, target, ok
+}
+
+// ruleSpecificity scores how specific a rule source is, a higher score is more specific
+func ruleSpecificity(ruleSource string) int {
+	score := len(ruleSource)
+	if !utils.IsWildcardURL(ruleSource) {
+		score += 1 << 20
+		if sourceURL, err := utils.NewRepoURL(ruleSource); err == nil && sourceURL.GetTag() != "" {
+			score += 1 << 19
+		}
+	}
+	return score
+}
+
+// matchRule maps a pushed tag against a rule
+func matchRule(ruleSource, ruleTarget string, ev PushEvent) (source string, target string, ok bool) {
+	if utils.IsWildcardURL(ruleSource) {
+		return matchWildcardRule(ruleSource, ruleTarget, ev)
+	}
+
+	sourceURL, err := utils.NewRepoURL(ruleSource)
+	if err != nil {
+		return "", "", false
+	}
+	if ev.Registry != "" && sourceURL.GetRegistry() != ev.Registry {
+		return "", "", false
+	}
+	if sourceURL.GetRepoWithNamespace() != ev.Repository {
+		return "", "", false
+	}
+
+	sourceTags := sourceURL.GetTag()
+	if sourceTags != "" && !utils.IsContain(strings.Split(sourceTags, ","), ev.Tag) {
+		return "", "", false
+	}
+
+	// an empty target uses default registry, which is resolved by the client
+	if ruleTarget == "" {
+		return sourceURL.GetURLWithoutTag() + ":" + ev.Tag, "", true
+	}
+
+	targetURL, err := utils.NewRepoURL(ruleTarget)
+	if err != nil {
+		return "", "", false
+	}
+	// keep the target tag only if the rule maps one tag to another
+	targetTag := ev.Tag
+	if targetURL.GetTag() != "" && !strings.Contains(sourceTags, ",") {
+		targetTag = targetURL.GetTag()
+	}
+	return sourceURL.GetURLWithoutTag() + ":" + ev.Tag, targetURL.GetURLWithoutTag() + ":" + targetTag, true
+}
+
+// matchWildcardRule maps a pushed tag against a rule like registry/namespace/*, the path of
+// the repository after the source prefix is appended to the target prefix
+func matchWildcardRule(ruleSource, ruleTarget string, ev PushEvent) (source string, target string, ok bool) {
+	parts := strings.SplitN(strings.TrimSuffix(ruleSource, utils.WildcardSuffix), "/", 2)
+	registry, rel := parts[0], ev.Repository
+	if ev.Registry != "" && registry != ev.Registry {
+		return "", "", false
+	}
+	if len(parts) == 2 {
+		if !strings.HasPrefix(ev.Repository, parts[1]+"/") {
+			return "", "", false
+		}
+		rel = strings.TrimPrefix(ev.Repository, parts[1]+"/")
+	}
+
+	source = registry + "/" + ev.Repository + ":" + ev.Tag
+	if ruleTarget == "" {
+		return source, "", true
+	}
+	return source, strings.TrimSuffix(ruleTarget, utils.WildcardSuffix) + "/" + rel + ":" + ev.Tag, true
+}
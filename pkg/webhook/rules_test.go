@@ -0,0 +1,64 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package webhook
+
+import "testing"
+
+func TestMatchRulesMostSpecific(t *testing.T) {
+	rules := map[string]string{
+		"harbor.example.com/*":                   "tcr.example.com/all/*",
+		"harbor.example.com/team/*":              "tcr.example.com/team/*",
+		"harbor.example.com/team/app":            "tcr.example.com/team/app",
+		"harbor.example.com/team/app:v1,v2":      "tcr.example.com/release/app",
+		"harbor.example.com/team/app:v3":         "tcr.example.com/release/app:stable",
+		"harbor.example.com/other/app:v1":        "tcr.example.com/other/app",
+		"harbor.example.com/team/sub/tool:v1,v2": "",
+	}
+	for _, tc := range []struct {
+		ev     PushEvent
+		source string
+		target string
+	}{
+		{ev: PushEvent{Registry: "harbor.example.com", Repository: "team/app", Tag: "v1"},
+			source: "harbor.example.com/team/app:v1", target: "tcr.example.com/release/app:v1"},
+		{ev: PushEvent{Registry: "harbor.example.com", Repository: "team/app", Tag: "v3"},
+			source: "harbor.example.com/team/app:v3", target: "tcr.example.com/release/app:stable"},
+		{ev: PushEvent{Registry: "harbor.example.com", Repository: "team/app", Tag: "v4"},
+			source: "harbor.example.com/team/app:v4", target: "tcr.example.com/team/app:v4"},
+		{ev: PushEvent{Repository: "team/web", Tag: "v1"},
+			source: "harbor.example.com/team/web:v1", target: "tcr.example.com/team/web:v1"},
+		{ev: PushEvent{Registry: "harbor.example.com", Repository: "ops/web", Tag: "v1"},
+			source: "harbor.example.com/ops/web:v1", target: "tcr.example.com/all/ops/web:v1"},
+		{ev: PushEvent{Registry: "harbor.example.com", Repository: "team/sub/tool", Tag: "v2"},
+			source: "harbor.example.com/team/sub/tool:v2", target: ""},
+	} {
+		// maps are iterated in random order, the result should not depend on it
+		for i := 0; i < 20; i++ {
+			source, target, ok := MatchRules(rules, tc.ev)
+			if !ok || source != tc.source || target != tc.target {
+				t.Fatalf("MatchRules(%s) = %s, %s, %v, want %s, %s", tc.ev.URL(), source, target, ok,
+					tc.source, tc.target)
+			}
+		}
+	}
+
+	if _, _, ok := MatchRules(rules, PushEvent{Registry: "docker.io", Repository: "team/app", Tag: "v1"}); ok {
+		t.Errorf("MatchRules should not match an image of another registry")
+	}
+}